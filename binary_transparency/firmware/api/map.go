@@ -23,6 +23,10 @@ const (
 	MapHTTPGetTile = "ftmap/v0/tile"
 	// MapHTTPGetAggregation is the path of the URL to get aggregated FW info.
 	MapHTTPGetAggregation = "ftmap/v0/aggregation"
+	// MapHTTPListLeaves is the path of the URL to list the map leaves under a key prefix.
+	MapHTTPListLeaves = "ftmap/v0/list-leaves"
+	// MapHTTPListRevisions is the path of the URL to list the revisions of the map.
+	MapHTTPListRevisions = "ftmap/v0/revisions"
 
 	// MapPrefixStrata is the number of prefix strata in the FT map.
 	MapPrefixStrata = 1
@@ -57,6 +61,18 @@ type MapCheckpoint struct {
 	Revision      uint64
 }
 
+// MapRevision describes a revision of the map, so that monitors can track how
+// the map has grown and spot unexpected changes to its root.
+type MapRevision struct {
+	Revision uint64
+	// WrittenNanos is the time that the revision was written, in nanoseconds
+	// since the epoch.
+	WrittenNanos int64
+	// LogSize is the number of entries from the FW Log committed to.
+	LogSize  uint64
+	RootHash []byte
+}
+
 // MapTile is a subtree of the whole map.
 type MapTile struct {
 	// The path from the root of the map to the root of this tile.
@@ -76,6 +92,25 @@ type MapTileLeaf struct {
 	Hash []byte
 }
 
+// MapLeafList is a page of the leaves in the map whose keys have a given
+// prefix, in key order.
+type MapLeafList struct {
+	// The map revision that the leaves were read from.
+	Revision uint64
+	Leaves   []MapLeaf
+	// If set then there are more leaves, which can be listed by requesting
+	// the leaves after this key.
+	Next []byte `json:",omitempty"`
+}
+
+// MapLeaf is one of the values that the map commits to.
+type MapLeaf struct {
+	// The path from the root of the map to this leaf.
+	Key []byte
+	// The hash value being committed to.
+	Hash []byte
+}
+
 // MapInclusionProof contains the value at the requested key and the proof to the
 // requested Checkpoint.
 type MapInclusionProof struct {
@@ -28,6 +28,8 @@ import (
 var (
 	listenAddr = flag.String("listen", ":8001", "address:port to listen for requests on")
 	mapDBAddr  = flag.String("map_db", "", "Connection path for map database")
+	cacheSize  = flag.Int("tile_cache_size", 1000, "The number of map tiles to cache in memory, or 0 to disable caching")
+	selfVerify = flag.Bool("self_verify", false, "If set then each aggregation is verified against the map tiles before it is returned, catching corruption of the map DB at the cost of reading the tiles on its path")
 )
 
 func main() {
@@ -35,8 +37,10 @@ func main() {
 
 	ctx := context.Background()
 	if err := impl.Main(ctx, impl.MapServerOpts{
-		ListenAddr: *listenAddr,
-		MapDBAddr:  *mapDBAddr,
+		ListenAddr:    *listenAddr,
+		MapDBAddr:     *mapDBAddr,
+		TileCacheSize: *cacheSize,
+		SelfVerify:    *selfVerify,
 	}); err != nil {
 		glog.Exit(err.Error())
 	}
@@ -0,0 +1,109 @@
+// Copyright 2021 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/google/trillian/experimental/batchmap"
+	"github.com/google/trillian/types"
+)
+
+// tileKey identifies a tile within the map.
+type tileKey struct {
+	revision int
+	path     string
+}
+
+type cachedTile struct {
+	key  tileKey
+	tile *batchmap.Tile
+}
+
+// tileCache is a MapReader that keeps the most recently used tiles read from
+// the underlying MapReader in memory. Tiles are never modified once their
+// revision has been written, so they can be cached without checking whether
+// they are stale. The whole cache is dropped when the latest revision
+// advances, as the tiles that clients want will then mostly be in the new one.
+type tileCache struct {
+	MapReader
+	size int
+
+	mu      sync.Mutex
+	latest  int
+	lru     *list.List // of *cachedTile, most recently used at the front.
+	entries map[tileKey]*list.Element
+}
+
+// newTileCache returns a MapReader that caches up to size tiles read from db.
+func newTileCache(db MapReader, size int) *tileCache {
+	return &tileCache{
+		MapReader: db,
+		size:      size,
+		latest:    -1,
+		lru:       list.New(),
+		entries:   make(map[tileKey]*list.Element),
+	}
+}
+
+// LatestRevision gets the metadata for the last completed write, dropping
+// all cached tiles if this is a later revision than any seen before.
+func (c *tileCache) LatestRevision() (int, types.LogRootV1, int64, error) {
+	rev, logRoot, count, err := c.MapReader.LatestRevision()
+	if err != nil {
+		return rev, logRoot, count, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if rev > c.latest {
+		if c.latest >= 0 {
+			c.lru.Init()
+			c.entries = make(map[tileKey]*list.Element)
+		}
+		c.latest = rev
+	}
+	return rev, logRoot, count, nil
+}
+
+// Tile gets the tile at the given path in the given revision of the map,
+// reading it from the underlying MapReader if it isn't cached.
+func (c *tileCache) Tile(revision int, path []byte) (*batchmap.Tile, error) {
+	key := tileKey{revision: revision, path: string(path)}
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(e)
+		c.mu.Unlock()
+		tileCacheHitsTotal.Inc()
+		return e.Value.(*cachedTile).tile, nil
+	}
+	c.mu.Unlock()
+	tileCacheMissesTotal.Inc()
+
+	tile, err := c.MapReader.Tile(revision, path)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok {
+		c.entries[key] = c.lru.PushFront(&cachedTile{key: key, tile: tile})
+		for c.lru.Len() > c.size {
+			oldest := c.lru.Remove(c.lru.Back()).(*cachedTile)
+			delete(c.entries, oldest.key)
+		}
+	}
+	return tile, nil
+}
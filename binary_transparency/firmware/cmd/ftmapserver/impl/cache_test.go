@@ -0,0 +1,74 @@
+// Copyright 2021 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"testing"
+
+	gomock "github.com/golang/mock/gomock"
+	"github.com/google/trillian/experimental/batchmap"
+	"github.com/google/trillian/types"
+)
+
+func TestTileCache(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mmr := NewMockMapReader(ctrl)
+	cache := newTileCache(mmr, 2)
+
+	tiles := make(map[string]*batchmap.Tile)
+	for _, p := range []string{"\x01", "\x02", "\x03"} {
+		tiles[p] = &batchmap.Tile{Path: []byte(p)}
+	}
+	read := func(rev int, path string) {
+		t.Helper()
+		got, err := cache.Tile(rev, []byte(path))
+		if err != nil {
+			t.Fatalf("Tile(%d, %x): %v", rev, path, err)
+		}
+		if want := tiles[path]; got != want {
+			t.Errorf("Tile(%d, %x) = %v, want %v", rev, path, got, want)
+		}
+	}
+	latest := func(rev int) {
+		t.Helper()
+		mmr.EXPECT().LatestRevision().Return(rev, types.LogRootV1{}, int64(0), nil /* err */)
+		if got, _, _, err := cache.LatestRevision(); err != nil || got != rev {
+			t.Fatalf("LatestRevision() = %d, %v; want %d", got, err, rev)
+		}
+	}
+
+	latest(1)
+	mmr.EXPECT().Tile(1, []byte("\x01")).Return(tiles["\x01"], nil /* err */)
+	mmr.EXPECT().Tile(1, []byte("\x02")).Return(tiles["\x02"], nil /* err */)
+	read(1, "\x01")
+	read(1, "\x02")
+	read(1, "\x01")
+	read(1, "\x02")
+
+	// Reading a third tile evicts the least recently used.
+	mmr.EXPECT().Tile(1, []byte("\x03")).Return(tiles["\x03"], nil /* err */)
+	read(1, "\x01")
+	read(1, "\x03")
+	read(1, "\x01")
+	mmr.EXPECT().Tile(1, []byte("\x02")).Return(tiles["\x02"], nil /* err */)
+	read(1, "\x02")
+
+	// The same revision keeps the cache, a new one drops it.
+	latest(1)
+	read(1, "\x02")
+	latest(2)
+	mmr.EXPECT().Tile(1, []byte("\x02")).Return(tiles["\x02"], nil /* err */)
+	read(1, "\x02")
+}
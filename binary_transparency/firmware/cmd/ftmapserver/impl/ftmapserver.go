@@ -16,8 +16,11 @@
 package impl
 
 import (
+	"bytes"
 	"context"
+	"database/sql"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -32,6 +35,8 @@ import (
 	"github.com/google/trillian/types"
 
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	_ "github.com/mattn/go-sqlite3" // Load drivers for sqlite3
 )
@@ -45,12 +50,24 @@ type MapReader interface {
 
 	// Aggregation gets the aggregation for the firmware at the given log index.
 	Aggregation(revision int, fwLogIndex uint64) (api.AggregatedFirmware, error)
+
+	// ListRevisions gets the metadata for every completed revision, in order.
+	ListRevisions() ([]ftmap.RevisionInfo, error)
+
+	// Revision gets the metadata for the given completed revision.
+	Revision(revision int) (ftmap.RevisionInfo, error)
 }
 
 // MapServerOpts encapsulates options for running an FT map server.
 type MapServerOpts struct {
 	ListenAddr string
 	MapDBAddr  string
+	// TileCacheSize is the number of tiles to keep in memory, or 0 to read
+	// every tile from the map DB.
+	TileCacheSize int
+	// SelfVerify makes the server check that the map commits to each
+	// aggregation before returning it, to catch corruption of the map DB.
+	SelfVerify bool
 }
 
 func Main(ctx context.Context, opts MapServerOpts) error {
@@ -63,9 +80,15 @@ func Main(ctx context.Context, opts MapServerOpts) error {
 	}
 
 	glog.Infof("Starting FT map server...")
-	srv := Server{db: mapDB}
+	var db MapReader = mapDB
+	if opts.TileCacheSize > 0 {
+		db = newTileCache(mapDB, opts.TileCacheSize)
+	}
+	srv := Server{db: db, selfVerify: opts.SelfVerify}
 	r := mux.NewRouter()
 	srv.RegisterHandlers(r)
+	r.Handle("/metrics", promhttp.Handler())
+	prometheus.MustRegister(newRevisionAgeGauge(db))
 	hServer := &http.Server{
 		Addr:    opts.ListenAddr,
 		Handler: r,
@@ -81,19 +104,42 @@ func Main(ctx context.Context, opts MapServerOpts) error {
 	return <-e
 }
 
+// maxListedLeaves is the largest number of leaves returned in each response
+// from listLeaves.
+const maxListedLeaves = 1000
+
 // Server is the core state & handler implementation of the FT personality.
 type Server struct {
 	db MapReader
+	// selfVerify is true if aggregations are verified against the tiles
+	// before they are returned.
+	selfVerify bool
 }
 
-// getCheckpoint returns a recent MapCheckpoint.
+// getCheckpoint returns the MapCheckpoint of the latest revision, or of the
+// revision given by the "revision" query parameter, which contains the log
+// checkpoint that the revision was built from.
 func (s *Server) getCheckpoint(w http.ResponseWriter, r *http.Request) {
-	rev, logRootV1, count, err := s.db.LatestRevision()
-	if err != nil {
+	var rev int
+	var logRootV1 types.LogRootV1
+	var count int64
+	var err error
+	if v := r.URL.Query().Get("revision"); len(v) > 0 {
+		if rev, err = strconv.Atoi(v); err != nil || rev < 0 {
+			http.Error(w, fmt.Sprintf("revision should be an integer (%q)", v), http.StatusBadRequest)
+			return
+		}
+		info, err := s.db.Revision(rev)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		logRootV1, count = info.LogRoot, info.Count
+	} else if rev, logRootV1, count, err = s.db.LatestRevision(); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	glog.V(1).Infof("Latest revision: %d %+v", rev, logRootV1)
+	glog.V(1).Infof("Checkpoint of revision: %d %+v", rev, logRootV1)
 	tile, err := s.db.Tile(rev, []byte{})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -137,7 +183,7 @@ func (s *Server) getTile(w http.ResponseWriter, r *http.Request) {
 	}
 	bmt, err := s.db.Tile(int(rev), path)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), errorStatus(err))
 		return
 	}
 	leaves := make([]api.MapTileLeaf, len(bmt.Leaves))
@@ -175,7 +221,7 @@ func (s *Server) getAggregation(w http.ResponseWriter, r *http.Request) {
 
 	agg, err := s.db.Aggregation(int(rev), fwIndex)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), errorStatus(err))
 		return
 	}
 	js, err := json.Marshal(agg)
@@ -183,17 +229,212 @@ func (s *Server) getAggregation(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if s.selfVerify {
+		if err := s.verifyAggregation(int(rev), fwIndex, js); err != nil {
+			glog.Errorf("Aggregation for firmware %d failed verification in revision %d: %v", fwIndex, rev, err)
+			selfVerifyFailures.Inc()
+			http.Error(w, fmt.Sprintf("aggregation failed verification: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// listLeaves returns the leaves under a key prefix, walking down the tiles of
+// the latest revision, or of the revision given by the "revision" query
+// parameter. Leaves are listed in key order, starting after the key given by
+// the "after" query parameter, and at most "max" leaves are returned.
+func (s *Server) listLeaves(w http.ResponseWriter, r *http.Request) {
+	prefix, err := hex.DecodeString(mux.Vars(r)["prefix"])
+	if err != nil {
+		http.Error(w, fmt.Sprintf("prefix should be hex (%q)", err), http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	after, err := hex.DecodeString(q.Get("after"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("after should be hex (%q)", err), http.StatusBadRequest)
+		return
+	}
+	max := maxListedLeaves
+	if v := q.Get("max"); len(v) > 0 {
+		if max, err = strconv.Atoi(v); err != nil || max <= 0 {
+			http.Error(w, fmt.Sprintf("max should be a positive integer (%q)", v), http.StatusBadRequest)
+			return
+		}
+		if max > maxListedLeaves {
+			max = maxListedLeaves
+		}
+	}
+	var rev int
+	if v := q.Get("revision"); len(v) > 0 {
+		if rev, err = strconv.Atoi(v); err != nil || rev < 0 {
+			http.Error(w, fmt.Sprintf("revision should be an integer (%q)", v), http.StatusBadRequest)
+			return
+		}
+	} else if rev, _, _, err = s.db.LatestRevision(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// One extra leaf is collected to find out whether there are more.
+	leaves, err := s.collectLeaves(rev, []byte{}, prefix, after, max+1, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	list := api.MapLeafList{
+		Revision: uint64(rev),
+		Leaves:   leaves,
+	}
+	if len(leaves) > max {
+		list.Leaves = leaves[:max]
+		list.Next = leaves[max-1].Key
+	}
+	js, err := json.Marshal(list)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// collectLeaves appends the leaves under the tile at tilePath to leaves, until
+// there are limit leaves. Only leaves with keys that have the prefix and are
+// greater than after are collected, and tiles that can't contain any of these
+// are not read.
+func (s *Server) collectLeaves(rev int, tilePath, prefix, after []byte, limit int, leaves []api.MapLeaf) ([]api.MapLeaf, error) {
+	tile, err := s.db.Tile(rev, tilePath)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range tile.Leaves {
+		if len(leaves) >= limit {
+			break
+		}
+		path := append(append([]byte{}, tilePath...), l.Path...)
+		if !bytes.HasPrefix(path, prefix) && !bytes.HasPrefix(prefix, path) {
+			continue
+		}
+		if a := after; len(a) > 0 {
+			// Skip the leaf if every key under it is before after.
+			if len(a) > len(path) {
+				a = a[:len(path)]
+			}
+			if bytes.Compare(path, a) < 0 {
+				continue
+			}
+		}
+		if len(tilePath) < api.MapPrefixStrata {
+			// This leaf is the root of a tile in the stratum below.
+			if leaves, err = s.collectLeaves(rev, path, prefix, after, limit, leaves); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if bytes.Compare(path, after) > 0 {
+			leaves = append(leaves, api.MapLeaf{Key: path, Hash: l.Hash})
+		}
+	}
+	return leaves, nil
+}
+
+// listRevisions returns every revision of the map with its root hash, in
+// order, for monitors tracking the history of the map.
+func (s *Server) listRevisions(w http.ResponseWriter, r *http.Request) {
+	infos, err := s.db.ListRevisions()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	revs := make([]api.MapRevision, 0, len(infos))
+	for _, info := range infos {
+		tile, err := s.db.Tile(info.Revision, []byte{})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to read root tile of revision %d: %v", info.Revision, err), http.StatusInternalServerError)
+			return
+		}
+		revs = append(revs, api.MapRevision{
+			Revision:     uint64(info.Revision),
+			WrittenNanos: info.Datetime.UnixNano(),
+			LogSize:      uint64(info.Count),
+			RootHash:     tile.RootHash,
+		})
+	}
+	js, err := json.Marshal(revs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(js)
 }
 
+// readiness is the body of the response from readyz.
+type readiness struct {
+	Revision int
+	RootHash []byte
+}
+
+// healthz reports that the server is up.
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+// readyz reports whether the server can serve the map, which it can once the
+// latest revision and its root tile can be read from the map DB. Until then
+// it responds with 503, and afterwards it returns the revision being served
+// and its root hash.
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	rev, _, _, err := s.db.LatestRevision()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read latest revision: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	tile, err := s.db.Tile(rev, []byte{})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read root tile of revision %d: %v", rev, err), http.StatusServiceUnavailable)
+		return
+	}
+	js, err := json.Marshal(readiness{Revision: rev, RootHash: tile.RootHash})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// errorStatus returns the HTTP status code for an error reading from the map.
+func errorStatus(err error) int {
+	if errors.Is(err, sql.ErrNoRows) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
 // RegisterHandlers registers HTTP handlers for the endpoints.
 func (s *Server) RegisterHandlers(r *mux.Router) {
-	r.HandleFunc(fmt.Sprintf("/%s", api.MapHTTPGetCheckpoint), s.getCheckpoint).Methods("GET")
+	checkpoint := instrument("get-checkpoint", s.getCheckpoint)
+	tile := instrument("tile", s.getTile)
+	aggregation := instrument("aggregation", s.getAggregation)
+	listLeaves := instrument("list-leaves", s.listLeaves)
+	listRevisions := instrument("list-revisions", s.listRevisions)
+
+	r.Handle(fmt.Sprintf("/%s", api.MapHTTPGetCheckpoint), checkpoint).Methods("GET")
 	// Empty tile path is normal for requesting the root tile
-	r.HandleFunc(fmt.Sprintf("/%s/in-revision/{revision:[0-9]+}/at-path/", api.MapHTTPGetTile), s.getTile).Methods("GET")
-	r.HandleFunc(fmt.Sprintf("/%s/in-revision/{revision:[0-9]+}/at-path/{path}", api.MapHTTPGetTile), s.getTile).Methods("GET")
-	r.HandleFunc(fmt.Sprintf("/%s/in-revision/{revision:[0-9]+}/for-firmware-at-index/{fwIndex:[0-9]+}", api.MapHTTPGetAggregation), s.getAggregation).Methods("GET")
+	r.Handle(fmt.Sprintf("/%s/in-revision/{revision:[0-9]+}/at-path/", api.MapHTTPGetTile), tile).Methods("GET")
+	r.Handle(fmt.Sprintf("/%s/in-revision/{revision:[0-9]+}/at-path/{path}", api.MapHTTPGetTile), tile).Methods("GET")
+	r.Handle(fmt.Sprintf("/%s/in-revision/{revision:[0-9]+}/for-firmware-at-index/{fwIndex:[0-9]+}", api.MapHTTPGetAggregation), aggregation).Methods("GET")
+	// Empty prefix lists all of the leaves in the map
+	r.Handle(fmt.Sprintf("/%s/with-prefix/", api.MapHTTPListLeaves), listLeaves).Methods("GET")
+	r.Handle(fmt.Sprintf("/%s/with-prefix/{prefix}", api.MapHTTPListLeaves), listLeaves).Methods("GET")
+	r.Handle(fmt.Sprintf("/%s", api.MapHTTPListRevisions), listRevisions).Methods("GET")
+	// Probes for orchestration, which aren't counted as requests served.
+	r.HandleFunc("/healthz", s.healthz).Methods("GET")
+	r.HandleFunc("/readyz", s.readyz).Methods("GET")
 }
 
 func parseBase64Param(r *http.Request, name string) ([]byte, error) {
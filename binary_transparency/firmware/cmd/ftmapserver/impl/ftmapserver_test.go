@@ -15,15 +15,19 @@
 package impl
 
 import (
+	"database/sql"
 	"encoding/base64"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	gomock "github.com/golang/mock/gomock"
+	"github.com/google/go-cmp/cmp"
 	"github.com/google/trillian-examples/binary_transparency/firmware/api"
+	"github.com/google/trillian-examples/binary_transparency/firmware/internal/ftmap"
 	"github.com/google/trillian/experimental/batchmap"
 	"github.com/google/trillian/types"
 	"github.com/gorilla/mux"
@@ -87,6 +91,161 @@ func TestRoot(t *testing.T) {
 	}
 }
 
+func TestReadyz(t *testing.T) {
+	for _, test := range []struct {
+		desc     string
+		revErr   error
+		tileErr  error
+		wantCode int
+		wantBody string
+	}{
+		{
+			desc:     "ready",
+			wantCode: http.StatusOK,
+			wantBody: `{"Revision":42,"RootHash":"NBI="}`,
+		},
+		{
+			desc:     "no revisions",
+			revErr:   sql.ErrNoRows,
+			wantCode: http.StatusServiceUnavailable,
+		},
+		{
+			desc:     "no root tile",
+			tileErr:  sql.ErrNoRows,
+			wantCode: http.StatusServiceUnavailable,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			mmr := NewMockMapReader(ctrl)
+			server := Server{db: mmr}
+
+			mmr.EXPECT().LatestRevision().Return(42, types.LogRootV1{}, int64(111), test.revErr)
+			if test.revErr == nil {
+				mmr.EXPECT().Tile(42, []byte{}).Return(&batchmap.Tile{RootHash: []byte{0x34, 0x12}}, test.tileErr)
+			}
+
+			r := mux.NewRouter()
+			server.RegisterHandlers(r)
+			ts := httptest.NewServer(r)
+			defer ts.Close()
+
+			resp, err := ts.Client().Get(ts.URL + "/readyz")
+			if err != nil {
+				t.Fatalf("error response: %v", err)
+			}
+			if resp.StatusCode != test.wantCode {
+				t.Errorf("status code got %d, want %d", resp.StatusCode, test.wantCode)
+			}
+			if test.wantCode != http.StatusOK {
+				return
+			}
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Errorf("failed to read body: %v", err)
+			}
+			if string(body) != test.wantBody {
+				t.Errorf("got '%s' want '%s'", string(body), test.wantBody)
+			}
+		})
+	}
+}
+
+func TestListRevisions(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mmr := NewMockMapReader(ctrl)
+	server := Server{db: mmr}
+
+	mmr.EXPECT().ListRevisions().Return([]ftmap.RevisionInfo{
+		{Revision: 0, Datetime: time.Unix(0, 1000), Count: 10},
+		{Revision: 1, Datetime: time.Unix(0, 2000), Count: 25},
+	}, nil)
+	mmr.EXPECT().Tile(0, []byte{}).Return(&batchmap.Tile{RootHash: []byte{0x12, 0x34}}, nil)
+	mmr.EXPECT().Tile(1, []byte{}).Return(&batchmap.Tile{RootHash: []byte{0x34, 0x12}}, nil)
+
+	r := mux.NewRouter()
+	server.RegisterHandlers(r)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	resp, err := ts.Client().Get(fmt.Sprintf("%s/%s", ts.URL, api.MapHTTPListRevisions))
+	if err != nil {
+		t.Fatalf("error response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status code not OK: %v", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Errorf("failed to read body: %v", err)
+	}
+	want := `[{"Revision":0,"WrittenNanos":1000,"LogSize":10,"RootHash":"EjQ="},{"Revision":1,"WrittenNanos":2000,"LogSize":25,"RootHash":"NBI="}]`
+	if string(body) != want {
+		t.Errorf("got '%s' want '%s'", string(body), want)
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	// The map isn't read, so the server is healthy even if it can't serve.
+	server := Server{db: NewMockMapReader(ctrl)}
+	r := mux.NewRouter()
+	server.RegisterHandlers(r)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	resp, err := ts.Client().Get(ts.URL + "/healthz")
+	if err != nil {
+		t.Fatalf("error response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status code not OK: %v", resp.StatusCode)
+	}
+}
+
+func TestRootAtRevision(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mmr := NewMockMapReader(ctrl)
+	server := Server{db: mmr}
+
+	logroot := types.LogRootV1{TreeSize: 42, RootHash: []byte{0x12, 0x34}, TimestampNanos: 12345}
+	mmr.EXPECT().Revision(7).Return(ftmap.RevisionInfo{Revision: 7, LogRoot: logroot, Count: 111}, nil)
+	mmr.EXPECT().Tile(7, []byte{}).Return(&batchmap.Tile{RootHash: []byte{0x34, 0x12}}, nil)
+	mmr.EXPECT().Revision(8).Return(ftmap.RevisionInfo{}, fmt.Errorf("failed to get revision 8: %w", sql.ErrNoRows))
+
+	ts := httptest.NewServer(http.HandlerFunc(server.getCheckpoint))
+	defer ts.Close()
+
+	resp, err := ts.Client().Get(ts.URL + "?revision=7")
+	if err != nil {
+		t.Fatalf("error response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status code not OK: %v", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Errorf("failed to read body: %v", err)
+	}
+	want := `{"LogCheckpoint":"RmlybXdhcmUgVHJhbnNwYXJlbmN5IExvZyB2MAo0MgpFalE9CjEyMzQ1Cg==","LogSize":111,"RootHash":"NBI=","Revision":7}`
+	if string(body) != want {
+		t.Errorf("got '%s' want '%s'", string(body), want)
+	}
+
+	for query, wantCode := range map[string]int{
+		"?revision=8":   http.StatusNotFound,
+		"?revision=bad": http.StatusBadRequest,
+	} {
+		resp, err := ts.Client().Get(ts.URL + query)
+		if err != nil {
+			t.Fatalf("error response: %v", err)
+		}
+		if resp.StatusCode != wantCode {
+			t.Errorf("%s: status code got %d, want %d", query, resp.StatusCode, wantCode)
+		}
+	}
+}
+
 func TestTile(t *testing.T) {
 	for _, test := range []struct {
 		desc     string
@@ -145,6 +304,28 @@ func TestTile(t *testing.T) {
 	}
 }
 
+func TestTileNotFound(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mmr := NewMockMapReader(ctrl)
+	server := Server{db: mmr}
+
+	mmr.EXPECT().Tile(42, []byte{0x01}).Return(nil, sql.ErrNoRows)
+
+	r := mux.NewRouter()
+	server.RegisterHandlers(r)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	url := fmt.Sprintf("%s/%s/in-revision/%d/at-path/%s", ts.URL, api.MapHTTPGetTile, 42, base64.URLEncoding.EncodeToString([]byte{0x01}))
+
+	resp, err := ts.Client().Get(url)
+	if err != nil {
+		t.Fatalf("error response: %v", err)
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got status code %v, want %v", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
 func TestAggregation(t *testing.T) {
 	for _, test := range []struct {
 		desc       string
@@ -199,3 +380,101 @@ func TestAggregation(t *testing.T) {
 		})
 	}
 }
+
+func TestListLeaves(t *testing.T) {
+	tiles := map[string]*batchmap.Tile{
+		"": {Path: []byte{}, Leaves: []*batchmap.TileLeaf{
+			{Path: []byte{0x01}, Hash: []byte{0x01}},
+			{Path: []byte{0x02}, Hash: []byte{0x02}},
+		}},
+		"\x01": {Path: []byte{0x01}, Leaves: []*batchmap.TileLeaf{
+			{Path: []byte{0x10, 0x00}, Hash: []byte{0xa0}},
+		}},
+		"\x02": {Path: []byte{0x02}, Leaves: []*batchmap.TileLeaf{
+			{Path: []byte{0x10, 0x00}, Hash: []byte{0xb0}},
+			{Path: []byte{0x10, 0x01}, Hash: []byte{0xb1}},
+			{Path: []byte{0x20, 0x00}, Hash: []byte{0xb2}},
+		}},
+	}
+	for _, test := range []struct {
+		desc      string
+		query     string
+		wantReads []string
+		wantBody  string
+	}{
+		{
+			desc:      "all",
+			query:     "with-prefix/",
+			wantReads: []string{"", "\x01", "\x02"},
+			wantBody:  `{"Revision":42,"Leaves":[{"Key":"ARAA","Hash":"oA=="},{"Key":"AhAA","Hash":"sA=="},{"Key":"AhAB","Hash":"sQ=="},{"Key":"AiAA","Hash":"sg=="}]}`,
+		},
+		{
+			desc:      "tile prefix",
+			query:     "with-prefix/02",
+			wantReads: []string{"", "\x02"},
+			wantBody:  `{"Revision":42,"Leaves":[{"Key":"AhAA","Hash":"sA=="},{"Key":"AhAB","Hash":"sQ=="},{"Key":"AiAA","Hash":"sg=="}]}`,
+		},
+		{
+			desc:      "prefix within tile",
+			query:     "with-prefix/0210",
+			wantReads: []string{"", "\x02"},
+			wantBody:  `{"Revision":42,"Leaves":[{"Key":"AhAA","Hash":"sA=="},{"Key":"AhAB","Hash":"sQ=="}]}`,
+		},
+		{
+			desc:      "no matches",
+			query:     "with-prefix/03",
+			wantReads: []string{""},
+			wantBody:  `{"Revision":42,"Leaves":null}`,
+		},
+		{
+			desc:      "first page",
+			query:     "with-prefix/?max=2",
+			wantReads: []string{"", "\x01", "\x02"},
+			wantBody:  `{"Revision":42,"Leaves":[{"Key":"ARAA","Hash":"oA=="},{"Key":"AhAA","Hash":"sA=="}],"Next":"AhAA"}`,
+		},
+		{
+			desc:      "next page",
+			query:     "with-prefix/?max=2&after=021000",
+			wantReads: []string{"", "\x02"},
+			wantBody:  `{"Revision":42,"Leaves":[{"Key":"AhAB","Hash":"sQ=="},{"Key":"AiAA","Hash":"sg=="}]}`,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			mmr := NewMockMapReader(ctrl)
+			server := Server{db: mmr}
+
+			var reads []string
+			mmr.EXPECT().LatestRevision().Return(42, types.LogRootV1{}, int64(0), nil /* err */)
+			mmr.EXPECT().Tile(42, gomock.Any()).DoAndReturn(func(rev int, path []byte) (*batchmap.Tile, error) {
+				reads = append(reads, string(path))
+				return tiles[string(path)], nil
+			}).AnyTimes()
+
+			r := mux.NewRouter()
+			server.RegisterHandlers(r)
+			ts := httptest.NewServer(r)
+			defer ts.Close()
+			url := fmt.Sprintf("%s/%s/%s", ts.URL, api.MapHTTPListLeaves, test.query)
+
+			client := ts.Client()
+			resp, err := client.Get(url)
+			if err != nil {
+				t.Fatalf("error response: %v", err)
+			}
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("status code not OK: %v (%s)", resp.StatusCode, url)
+			}
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Errorf("failed to read body: %v", err)
+			}
+			if string(body) != test.wantBody {
+				t.Errorf("got '%s' want '%s'", string(body), test.wantBody)
+			}
+			if diff := cmp.Diff(test.wantReads, reads); diff != "" {
+				t.Errorf("tiles read diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
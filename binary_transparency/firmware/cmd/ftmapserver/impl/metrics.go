@@ -0,0 +1,81 @@
+// Copyright 2021 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// Exported at /metrics by the server. The not-found rate is the rate of
+	// requests with code 404.
+	requestsServed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ftmap_requests_total",
+		Help: "Number of requests served, by handler and HTTP status code.",
+	}, []string{"handler", "code"})
+	tileCacheHitsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ftmap_tile_cache_hits_total",
+		Help: "Number of tiles read that were in the tile cache.",
+	})
+	tileCacheMissesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ftmap_tile_cache_misses_total",
+		Help: "Number of tiles read that were not in the tile cache.",
+	})
+	selfVerifyFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ftmap_self_verify_failures_total",
+		Help: "Number of aggregations that were not committed to by the map tiles when verified with --self_verify.",
+	})
+)
+
+// instrument wraps the handler so that its responses are counted.
+func instrument(handler string, h http.HandlerFunc) http.Handler {
+	return promhttp.InstrumentHandlerCounter(requestsServed.MustCurryWith(prometheus.Labels{"handler": handler}), h)
+}
+
+// newRevisionAgeGauge returns a gauge of how long ago the latest revision of
+// the map was written. The latest revision is read from the map each time
+// that the gauge is collected, so that this keeps growing if the map stops
+// being updated even if no requests are being served.
+func newRevisionAgeGauge(db MapReader) prometheus.GaugeFunc {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "ftmap_served_revision_age_seconds",
+		Help: "Seconds since the latest revision of the map was written.",
+	}, func() float64 {
+		return revisionAge(db, time.Now())
+	})
+}
+
+// revisionAge returns the number of seconds between the time that the latest
+// revision of the map was written and now, or NaN if this can't be read.
+func revisionAge(db MapReader, now time.Time) float64 {
+	rev, _, _, err := db.LatestRevision()
+	if err != nil {
+		glog.Warningf("Failed to get latest revision: %v", err)
+		return math.NaN()
+	}
+	info, err := db.Revision(rev)
+	if err != nil {
+		glog.Warningf("Failed to get time of revision %d: %v", rev, err)
+		return math.NaN()
+	}
+	return now.Sub(info.Datetime).Seconds()
+}
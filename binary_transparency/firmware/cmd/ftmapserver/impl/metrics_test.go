@@ -0,0 +1,68 @@
+// Copyright 2021 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	gomock "github.com/golang/mock/gomock"
+	"github.com/google/trillian-examples/binary_transparency/firmware/internal/ftmap"
+	"github.com/google/trillian/types"
+)
+
+func TestRevisionAge(t *testing.T) {
+	now := time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		desc    string
+		latest  error
+		written time.Time
+		wantNaN bool
+		want    float64
+	}{
+		{
+			desc:    "stale",
+			written: now.Add(-90 * time.Minute),
+			want:    5400,
+		},
+		{
+			desc:    "no revisions",
+			latest:  errors.New("no revisions found"),
+			wantNaN: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			mmr := NewMockMapReader(ctrl)
+			mmr.EXPECT().LatestRevision().Return(3, types.LogRootV1{}, int64(0), test.latest)
+			if test.latest == nil {
+				mmr.EXPECT().Revision(3).Return(ftmap.RevisionInfo{Revision: 3, Datetime: test.written}, nil /* err */)
+			}
+
+			got := revisionAge(mmr, now)
+			if test.wantNaN {
+				if !math.IsNaN(got) {
+					t.Errorf("revisionAge() = %v, want NaN", got)
+				}
+				return
+			}
+			if got != test.want {
+				t.Errorf("revisionAge() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
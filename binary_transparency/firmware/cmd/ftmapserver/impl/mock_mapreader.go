@@ -8,6 +8,7 @@ import (
 
 	gomock "github.com/golang/mock/gomock"
 	api "github.com/google/trillian-examples/binary_transparency/firmware/api"
+	ftmap "github.com/google/trillian-examples/binary_transparency/firmware/internal/ftmap"
 	batchmap "github.com/google/trillian/experimental/batchmap"
 	types "github.com/google/trillian/types"
 )
@@ -67,6 +68,36 @@ func (mr *MockMapReaderMockRecorder) LatestRevision() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LatestRevision", reflect.TypeOf((*MockMapReader)(nil).LatestRevision))
 }
 
+// ListRevisions mocks base method.
+func (m *MockMapReader) ListRevisions() ([]ftmap.RevisionInfo, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListRevisions")
+	ret0, _ := ret[0].([]ftmap.RevisionInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListRevisions indicates an expected call of ListRevisions.
+func (mr *MockMapReaderMockRecorder) ListRevisions() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListRevisions", reflect.TypeOf((*MockMapReader)(nil).ListRevisions))
+}
+
+// Revision mocks base method.
+func (m *MockMapReader) Revision(arg0 int) (ftmap.RevisionInfo, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Revision", arg0)
+	ret0, _ := ret[0].(ftmap.RevisionInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Revision indicates an expected call of Revision.
+func (mr *MockMapReaderMockRecorder) Revision(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Revision", reflect.TypeOf((*MockMapReader)(nil).Revision), arg0)
+}
+
 // Tile mocks base method.
 func (m *MockMapReader) Tile(arg0 int, arg1 []byte) (*batchmap.Tile, error) {
 	m.ctrl.T.Helper()
@@ -0,0 +1,111 @@
+// Copyright 2021 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"fmt"
+
+	"github.com/google/trillian-examples/binary_transparency/firmware/api"
+	"github.com/google/trillian/experimental/batchmap"
+	"github.com/google/trillian/merkle/coniks"
+	"github.com/google/trillian/merkle/smt"
+	"github.com/google/trillian/merkle/smt/node"
+)
+
+// verifyAggregation checks that the map revision commits to value as the
+// aggregation for the firmware at the given log index. The tiles on the path
+// to its key are hashed from the bottom up, checking that each tile holds the
+// hash of the one below it, up to the root hash stored for the revision.
+func (s *Server) verifyAggregation(rev int, fwIndex uint64, value []byte) error {
+	kbs := sha512.Sum512_256([]byte(fmt.Sprintf("summary:%d", fwIndex)))
+	leafID := node.NewID(string(kbs[:]), 256)
+	want := coniks.Default.HashLeaf(api.MapTreeID, leafID, value)
+	for depth := api.MapPrefixStrata; depth >= 0; depth-- {
+		path := kbs[:depth]
+		tile, err := s.db.Tile(rev, path)
+		if err != nil {
+			return fmt.Errorf("failed to read tile %x: %v", path, err)
+		}
+		// Tiles in the last stratum hold the rest of the key, and the others
+		// hold the roots of the tiles below them.
+		leafPath := kbs[depth : depth+1]
+		if depth == api.MapPrefixStrata {
+			leafPath = kbs[depth:]
+		}
+		if got := tileLeafHash(tile, leafPath); !bytes.Equal(got, want) {
+			return fmt.Errorf("tile %x has hash %x at %x, want %x", path, got, leafPath, want)
+		}
+		root, err := tileRoot(tile)
+		if err != nil {
+			return fmt.Errorf("failed to hash tile %x: %v", path, err)
+		}
+		if !bytes.Equal(root, tile.RootHash) {
+			return fmt.Errorf("tile %x hashes to %x but has root hash %x", path, root, tile.RootHash)
+		}
+		want = root
+	}
+	return nil
+}
+
+// tileLeafHash returns the hash of the leaf at the given path in the tile, or
+// nil if there is no such leaf.
+func tileLeafHash(tile *batchmap.Tile, path []byte) []byte {
+	for _, l := range tile.Leaves {
+		if bytes.Equal(l.Path, path) {
+			return l.Hash
+		}
+	}
+	return nil
+}
+
+// tileRoot computes the root hash of the tile from its leaves, as batchmap
+// does when it constructs the tile.
+func tileRoot(tile *batchmap.Tile) ([]byte, error) {
+	if len(tile.Leaves) == 0 {
+		return nil, fmt.Errorf("tile %x has no leaves", tile.Path)
+	}
+	nodes := make([]smt.Node, len(tile.Leaves))
+	for i, l := range tile.Leaves {
+		path := append(append([]byte{}, tile.Path...), l.Path...)
+		nodes[i] = smt.Node{ID: node.NewID(string(path), uint(len(path))*8), Hash: l.Hash}
+	}
+	if err := smt.Prepare(nodes, nodes[0].ID.BitLen()); err != nil {
+		return nil, err
+	}
+	hs, err := smt.NewHStar3(nodes, coniks.Default.HashChildren, nodes[0].ID.BitLen(), uint(len(tile.Path))*8)
+	if err != nil {
+		return nil, err
+	}
+	roots, err := hs.Update(emptyTree{})
+	if err != nil {
+		return nil, err
+	}
+	if len(roots) != 1 {
+		return nil, fmt.Errorf("expected single root but got %d", len(roots))
+	}
+	return roots[0].Hash, nil
+}
+
+// emptyTree is an smt.NodeAccessor for the empty subtrees around the leaves
+// of a tile in the FT map.
+type emptyTree struct{}
+
+func (emptyTree) Get(id node.ID) ([]byte, error) {
+	return coniks.Default.HashEmpty(api.MapTreeID, id), nil
+}
+
+func (emptyTree) Set(id node.ID, hash []byte) {}
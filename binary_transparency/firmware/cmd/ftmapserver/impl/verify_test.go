@@ -0,0 +1,144 @@
+// Copyright 2021 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package impl
+
+import (
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	gomock "github.com/golang/mock/gomock"
+	"github.com/google/trillian-examples/binary_transparency/firmware/api"
+	"github.com/google/trillian/experimental/batchmap"
+	"github.com/google/trillian/merkle/coniks"
+	"github.com/google/trillian/merkle/smt/node"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// singleEntryTiles returns the tiles of a map containing only the aggregation
+// for the firmware at fwIndex. The hashes are computed directly up the path
+// to the key, independently of the tile hashing being tested.
+func singleEntryTiles(t *testing.T, fwIndex uint64, agg api.AggregatedFirmware) map[string]*batchmap.Tile {
+	t.Helper()
+	value, err := json.Marshal(agg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kbs := sha512.Sum512_256([]byte(fmt.Sprintf("summary:%d", fwIndex)))
+	leafID := node.NewID(string(kbs[:]), 256)
+	hasher := coniks.Default
+	leafHash := hasher.HashLeaf(api.MapTreeID, leafID, value)
+	// hashes[d] is the hash of the node at depth d bits on the path to the key.
+	hashes := make(map[uint][]byte)
+	hashes[256] = leafHash
+	for d := uint(256); d > 0; d-- {
+		stem := leafID.Prefix(d)
+		sib := hasher.HashEmpty(api.MapTreeID, stem.Sibling())
+		left, right := hashes[d], sib
+		if last, bits := stem.LastByte(); last&(1<<(8-bits)) != 0 {
+			left, right = right, left
+		}
+		hashes[d-1] = hasher.HashChildren(left, right)
+	}
+	return map[string]*batchmap.Tile{
+		"": {
+			Path:     []byte{},
+			RootHash: hashes[0],
+			Leaves:   []*batchmap.TileLeaf{{Path: kbs[:1], Hash: hashes[8]}},
+		},
+		string(kbs[:1]): {
+			Path:     kbs[:1],
+			RootHash: hashes[8],
+			Leaves:   []*batchmap.TileLeaf{{Path: kbs[1:], Hash: leafHash}},
+		},
+	}
+}
+
+func TestVerifyAggregation(t *testing.T) {
+	const rev, fwIndex = 3, 7
+	agg := api.AggregatedFirmware{Index: fwIndex, Good: true}
+	for _, test := range []struct {
+		desc    string
+		corrupt func(tiles map[string]*batchmap.Tile, bottom string)
+		wantErr bool
+	}{
+		{
+			desc:    "valid",
+			corrupt: func(map[string]*batchmap.Tile, string) {},
+		},
+		{
+			desc: "wrong value",
+			corrupt: func(tiles map[string]*batchmap.Tile, bottom string) {
+				tiles[bottom].Leaves[0].Hash = []byte("corrupt")
+			},
+			wantErr: true,
+		},
+		{
+			desc: "wrong root hash",
+			corrupt: func(tiles map[string]*batchmap.Tile, bottom string) {
+				tiles[""].RootHash = []byte("corrupt")
+			},
+			wantErr: true,
+		},
+		{
+			desc: "missing leaf",
+			corrupt: func(tiles map[string]*batchmap.Tile, bottom string) {
+				tiles[""].Leaves[0].Path = []byte{tiles[""].Leaves[0].Path[0] + 1}
+			},
+			wantErr: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			tiles := singleEntryTiles(t, fwIndex, agg)
+			kbs := sha512.Sum512_256([]byte(fmt.Sprintf("summary:%d", fwIndex)))
+			test.corrupt(tiles, string(kbs[:1]))
+
+			ctrl := gomock.NewController(t)
+			mmr := NewMockMapReader(ctrl)
+			mmr.EXPECT().Tile(rev, gomock.Any()).DoAndReturn(func(_ int, path []byte) (*batchmap.Tile, error) {
+				return tiles[string(path)], nil
+			}).AnyTimes()
+			mmr.EXPECT().Aggregation(rev, uint64(fwIndex)).Return(agg, nil /* err */)
+			server := Server{db: mmr, selfVerify: true}
+
+			r := mux.NewRouter()
+			server.RegisterHandlers(r)
+			ts := httptest.NewServer(r)
+			defer ts.Close()
+			url := fmt.Sprintf("%s/%s/in-revision/%d/for-firmware-at-index/%d", ts.URL, api.MapHTTPGetAggregation, rev, fwIndex)
+
+			failures := testutil.ToFloat64(selfVerifyFailures)
+			resp, err := ts.Client().Get(url)
+			if err != nil {
+				t.Fatalf("error response: %v", err)
+			}
+			resp.Body.Close()
+			wantStatus, wantFailures := http.StatusOK, failures
+			if test.wantErr {
+				wantStatus, wantFailures = http.StatusInternalServerError, failures+1
+			}
+			if resp.StatusCode != wantStatus {
+				t.Errorf("status code = %d, want %d", resp.StatusCode, wantStatus)
+			}
+			if got := testutil.ToFloat64(selfVerifyFailures); got != wantFailures {
+				t.Errorf("self verify failures = %v, want %v", got, wantFailures)
+			}
+		})
+	}
+}
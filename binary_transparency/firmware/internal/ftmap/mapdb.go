@@ -94,6 +94,52 @@ func (d *MapDB) LatestRevision() (rev int, logroot types.LogRootV1, count int64,
 	return 0, types.LogRootV1{}, 0, NoRevisionsFound(errors.New("no revisions found"))
 }
 
+// RevisionInfo is the metadata for a completed revision of the map.
+type RevisionInfo struct {
+	Revision int
+	// Datetime is the time that the revision was written.
+	Datetime time.Time
+	// LogRoot is the root of the log that the revision was built from.
+	LogRoot types.LogRootV1
+	// Count is the number of log entries that the revision was built from.
+	Count int64
+}
+
+// ListRevisions returns the metadata for every completed revision, in order.
+func (d *MapDB) ListRevisions() ([]RevisionInfo, error) {
+	rows, err := d.db.Query("SELECT revision, datetime, logroot, count FROM revisions ORDER BY revision")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query revisions: %v", err)
+	}
+	defer rows.Close()
+	var infos []RevisionInfo
+	for rows.Next() {
+		var info RevisionInfo
+		var lcpRaw []byte
+		if err := rows.Scan(&info.Revision, &info.Datetime, &lcpRaw, &info.Count); err != nil {
+			return nil, fmt.Errorf("failed to scan revision: %v", err)
+		}
+		if err := info.LogRoot.UnmarshalBinary(lcpRaw); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal log root of revision %d: %v", info.Revision, err)
+		}
+		infos = append(infos, info)
+	}
+	return infos, rows.Err()
+}
+
+// Revision gets the metadata for the given completed revision.
+func (d *MapDB) Revision(revision int) (RevisionInfo, error) {
+	info := RevisionInfo{Revision: revision}
+	var lcpRaw []byte
+	if err := d.db.QueryRow("SELECT datetime, logroot, count FROM revisions WHERE revision=?", revision).Scan(&info.Datetime, &lcpRaw, &info.Count); err != nil {
+		return RevisionInfo{}, fmt.Errorf("failed to get revision %d: %w", revision, err)
+	}
+	if err := info.LogRoot.UnmarshalBinary(lcpRaw); err != nil {
+		return RevisionInfo{}, fmt.Errorf("failed to unmarshal log root of revision %d: %v", revision, err)
+	}
+	return info, nil
+}
+
 // Tile gets the tile at the given path in the given revision of the map.
 func (d *MapDB) Tile(revision int, path []byte) (*batchmap.Tile, error) {
 	var bs []byte
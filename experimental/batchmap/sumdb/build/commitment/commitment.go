@@ -0,0 +1,101 @@
+// Copyright 2021 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package commitment allows the root of each map revision to be committed to
+// by a Trillian log. This creates an auditable history of map roots that
+// verifiers can follow, and which can be gossiped.
+package commitment
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/google/trillian"
+	"github.com/google/trillian/client"
+	"github.com/google/trillian/types"
+	"google.golang.org/grpc"
+)
+
+// Leaf is the data that is logged for each map revision.
+type Leaf struct {
+	Revision   int
+	RootHash   []byte
+	Checkpoint []byte
+}
+
+// Log is a Trillian log that map revisions are committed to.
+type Log struct {
+	conn   *grpc.ClientConn
+	log    trillian.TrillianLogClient
+	client *client.LogClient
+}
+
+// NewLog connects to the Trillian log with the given tree ID via the gRPC
+// server at addr. The Log returned should have Close called when done.
+func NewLog(ctx context.Context, addr string, treeID int64) (*Log, error) {
+	conn, err := grpc.DialContext(ctx, addr, grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		return nil, fmt.Errorf("did not connect to trillian on %v: %v", addr, err)
+	}
+	tree, err := trillian.NewTrillianAdminClient(conn).GetTree(ctx, &trillian.GetTreeRequest{TreeId: treeID})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to get tree %d: %v", treeID, err)
+	}
+	log := trillian.NewTrillianLogClient(conn)
+	// This trusts whatever state the log reports; commitments are appended
+	// blindly and it is up to verifiers following the log to check it.
+	c, err := client.NewFromTree(log, tree, types.LogRootV1{})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create log client: %v", err)
+	}
+	return &Log{
+		conn:   conn,
+		log:    log,
+		client: c,
+	}, nil
+}
+
+// Commit appends the leaf to the log, waits for it to be integrated, and
+// returns the index it was assigned in the log.
+func (l *Log) Commit(ctx context.Context, leaf Leaf) (int64, error) {
+	data, err := json.Marshal(leaf)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal leaf: %v", err)
+	}
+	if err := l.client.AddLeaf(ctx, data); err != nil {
+		return 0, fmt.Errorf("failed to add leaf: %v", err)
+	}
+	root := l.client.GetRoot()
+	resp, err := l.log.GetInclusionProofByHash(ctx, &trillian.GetInclusionProofByHashRequest{
+		LogId:    l.client.LogID,
+		LeafHash: l.client.BuildLeaf(data).MerkleLeafHash,
+		TreeSize: int64(root.TreeSize),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get inclusion proof: %v", err)
+	}
+	if len(resp.Proof) == 0 {
+		return 0, errors.New("no inclusion proof returned for committed leaf")
+	}
+	return resp.Proof[0].LeafIndex, nil
+}
+
+// Close closes the connection to the log.
+func (l *Log) Close() error {
+	return l.conn.Close()
+}
@@ -0,0 +1,215 @@
+// Copyright 2021 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"golang.org/x/mod/sumdb/note"
+
+	"github.com/google/trillian-examples/experimental/batchmap/sumdb/build/pipeline"
+	"github.com/google/trillian-examples/experimental/batchmap/sumdb/mapdb"
+	"github.com/google/trillian-examples/experimental/batchmap/sumdb/mirror"
+)
+
+// TestMain initializes Beam so that pipelines can be run with beamx, as
+// ptest can't be used alongside the flags that beamx registers.
+func TestMain(m *testing.M) {
+	flag.Parse()
+	beam.Init()
+	os.Exit(m.Run())
+}
+
+func TestDiffBuildParams(t *testing.T) {
+	want := mapdb.BuildParams{
+		TreeID:       12345,
+		PrefixStrata: 2,
+		StratumBits:  pipeline.StratumBits,
+		Hash:         pipeline.Hash.String(),
+	}
+	// Params recorded by an early build, before most of the fields existed.
+	var old mapdb.BuildParams
+	if err := json.Unmarshal([]byte(fmt.Sprintf(`{"TreeID":12345,"PrefixStrata":2,"Hash":%q}`, pipeline.Hash)), &old); err != nil {
+		t.Fatalf("failed to parse build params: %v", err)
+	}
+	if diffs := diffBuildParams(old, want); len(diffs) > 0 {
+		t.Errorf("diffBuildParams() for old params = %q, want none", diffs)
+	}
+
+	other := want
+	other.KeyDomain = "other"
+	other.StratumBits = 4
+	if diffs, wantDiffs := diffBuildParams(other, want), []string{"StratumBits is 4, want 8", "KeyDomain is other, want "}; !reflect.DeepEqual(diffs, wantDiffs) {
+		t.Errorf("diffBuildParams() = %q, want %q", diffs, wantDiffs)
+	}
+}
+
+func TestCheckDeterministic(t *testing.T) {
+	schema, err := mirror.NewSchema(*leafTable, *leafColumns, *checkpointTable, *checkpointColumns)
+	if err != nil {
+		t.Fatalf("NewSchema(): %v", err)
+	}
+	// The fixture has 40 entries, versions v1.0.0 to v1.3.0 of 10 modules,
+	// and a checkpoint with their root hash.
+	m, err := mirror.New("sqlite3", "testdata/sum.db", schema, false)
+	if err != nil {
+		t.Fatalf("New(): %v", err)
+	}
+	for _, test := range []struct {
+		name         string
+		prefixStrata int
+		versionList  bool
+	}{
+		{name: "no prefix strata", prefixStrata: 0},
+		{name: "two prefix strata", prefixStrata: 2},
+		{name: "version list", prefixStrata: 1, versionList: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			pb := pipeline.NewMapBuilder(m, 12345, test.prefixStrata, test.versionList)
+			root, err := checkDeterministic(pb, -1, test.prefixStrata)
+			if err != nil {
+				t.Fatalf("checkDeterministic(): %v", err)
+			}
+			if got, want := len(root), pipeline.Hash.Size(); got != want {
+				t.Errorf("checkDeterministic() returned root of length %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestCheckpointFile(t *testing.T) {
+	schema, err := mirror.NewSchema(*leafTable, *leafColumns, *checkpointTable, *checkpointColumns)
+	if err != nil {
+		t.Fatalf("NewSchema(): %v", err)
+	}
+	skey, vkey, err := note.GenerateKey(rand.Reader, "sum.golang.org")
+	if err != nil {
+		t.Fatalf("GenerateKey(): %v", err)
+	}
+	signer, err := note.NewSigner(skey)
+	if err != nil {
+		t.Fatalf("NewSigner(): %v", err)
+	}
+	_, otherKey, err := note.GenerateKey(rand.Reader, "sum.golang.org")
+	if err != nil {
+		t.Fatalf("GenerateKey(): %v", err)
+	}
+	// This is the root hash of the 40 leaves in the fixture.
+	const root = "X4VdD+72l/CA2GOCR4McV1TC62wIU4s/2D3nhVowPjs="
+
+	for _, test := range []struct {
+		name        string
+		text        string
+		vkey        string
+		wantErr     bool
+		wantHeadErr bool
+	}{
+		{name: "verifies", text: "go.sum database tree\n40\n" + root + "\n", vkey: vkey},
+		{name: "wrong key", text: "go.sum database tree\n40\n" + root + "\n", vkey: otherKey, wantErr: true},
+		{name: "not a checkpoint", text: "hello\n", vkey: vkey, wantErr: true},
+		{name: "beyond mirror", text: "go.sum database tree\n41\n" + root + "\n", vkey: vkey, wantHeadErr: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			signed, err := note.Sign(&note.Note{Text: test.text}, signer)
+			if err != nil {
+				t.Fatalf("Sign(): %v", err)
+			}
+			path := filepath.Join(t.TempDir(), "checkpoint")
+			if err := ioutil.WriteFile(path, signed, 0644); err != nil {
+				t.Fatal(err)
+			}
+			cp, err := readCheckpointFile(path, test.vkey)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("readCheckpointFile() = %v, wantErr %t", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			// The mirror's own checkpoint is ignored, and the tree size
+			// of the file is checked even without use_checkpoint_size.
+			m, err := mirror.New("sqlite3", "testdata/sum.db", schema, false)
+			if err != nil {
+				t.Fatalf("New(): %v", err)
+			}
+			defer m.Close()
+			m.Checkpoint = cp
+			gotCP, size, err := m.Head()
+			if (err != nil) != test.wantHeadErr {
+				t.Fatalf("Head() = %v, wantHeadErr %t", err, test.wantHeadErr)
+			}
+			if err != nil {
+				return
+			}
+			if !bytes.Equal(gotCP, signed) || size != 40 {
+				t.Errorf("Head() = %q, %d; want %q, 40", gotCP, size, signed)
+			}
+			if err := m.VerifyTree(40); err != nil {
+				t.Errorf("VerifyTree(40): %v", err)
+			}
+		})
+	}
+}
+
+func TestCountBuildWithoutMetrics(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "map.db")
+	mapDB, err := mapdb.NewTileDB(location)
+	if err != nil {
+		t.Fatalf("NewTileDB(): %v", err)
+	}
+	defer mapDB.Close()
+	if err := mapDB.Init(); err != nil {
+		t.Fatalf("Init(): %v", err)
+	}
+	db, err := sql.Open("sqlite3", location)
+	if err != nil {
+		t.Fatalf("sql.Open(): %v", err)
+	}
+	defer db.Close()
+	for _, path := range []string{"", "\x01"} {
+		if _, err := db.Exec("INSERT INTO tiles (revision, path, tile) VALUES (?, ?, ?)", 0, []byte(path), []byte("{}")); err != nil {
+			t.Fatalf("failed to write tile: %v", err)
+		}
+	}
+
+	for _, test := range []struct {
+		sink string
+		want mapdb.BuildCounts
+	}{
+		{sink: "sqlite", want: mapdb.BuildCounts{Records: 40, Entries: -1, Tiles: 2, Source: "map_db"}},
+		{sink: "gcs", want: mapdb.BuildCounts{Records: 40, Entries: -1, Tiles: -1, Source: "map_db"}},
+	} {
+		t.Run(test.sink, func(t *testing.T) {
+			defer func(old string) { *sink = old }(*sink)
+			*sink = test.sink
+			// The direct runner doesn't report metrics, so has a nil result.
+			got, err := countBuild(mapDB, 0, nil, 40)
+			if err != nil || got != test.want {
+				t.Errorf("countBuild() = %+v, %v; want %+v, nil", got, err, test.want)
+			}
+		})
+	}
+}
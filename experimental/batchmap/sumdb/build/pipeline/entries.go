@@ -15,9 +15,14 @@
 package pipeline
 
 import (
+	"context"
 	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
 	"reflect"
+	"regexp"
+	"strings"
 
 	"github.com/apache/beam/sdks/go/pkg/beam"
 	"github.com/google/trillian/experimental/batchmap"
@@ -25,14 +30,30 @@ import (
 	"github.com/google/trillian/merkle/smt/node"
 )
 
+const (
+	counterNamespace       = "pipeline"
+	recordsSkippedCounter  = "records-skipped"
+	recordsFilteredCounter = "records-filtered"
+)
+
+var (
+	cntRecordsSkipped  = beam.NewCounter(counterNamespace, recordsSkippedCounter)
+	cntRecordsFiltered = beam.NewCounter(counterNamespace, recordsFilteredCounter)
+)
+
 func init() {
 	beam.RegisterType(reflect.TypeOf((*mapEntryFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*validateRecordFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*filterModuleFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*kvEntryFn)(nil)).Elem())
 }
 
-const hash = crypto.SHA512_256
+// Hash is the hash function used to construct the keys and values in the map.
+const Hash = crypto.SHA512_256
 
 // Metadata is the audit.Metadata object with the addition of an ID field.
-// It must map to the scheme of the leafMetadata table.
+// It must map to the scheme of the leafMetadata table, or to a query aliasing
+// the columns of another table to the names of its fields.
 type Metadata struct {
 	ID       int64
 	Module   string
@@ -41,20 +62,206 @@ type Metadata struct {
 	ModHash  string
 }
 
+// FilterRecords returns a PCollection<Metadata> containing only the records
+// for modules that match the regular expression. If filter is empty then
+// all records are returned. The number of records dropped is counted by the
+// pipeline/records-filtered counter.
+func FilterRecords(s beam.Scope, records beam.PCollection, filter string) beam.PCollection {
+	if filter == "" {
+		return records
+	}
+	return beam.ParDo(s.Scope("filter"), &filterModuleFn{Filter: filter}, records)
+}
+
+type filterModuleFn struct {
+	Filter string
+
+	re *regexp.Regexp
+}
+
+func (fn *filterModuleFn) Setup() error {
+	var err error
+	fn.re, err = regexp.Compile(fn.Filter)
+	return err
+}
+
+func (fn *filterModuleFn) ProcessElement(ctx context.Context, m Metadata, emit func(Metadata)) {
+	if fn.re.MatchString(m.Module) {
+		emit(m)
+		return
+	}
+	cntRecordsFiltered.Inc(ctx, 1)
+}
+
+// BadRecordPolicy determines what happens to records from the input log that
+// contain malformed hashes.
+type BadRecordPolicy int
+
+const (
+	// AllowBadRecords commits all records to the map without validating them.
+	AllowBadRecords BadRecordPolicy = iota
+	// SkipBadRecords drops malformed records so that they are not committed to
+	// by the map. The number of records dropped is counted by the
+	// pipeline/records-skipped counter.
+	SkipBadRecords
+	// FailOnBadRecords fails the pipeline if any record is malformed.
+	FailOnBadRecords
+)
+
+// ValidateRecords checks that the hashes in each Metadata record in the
+// PCollection are well-formed go.sum hashes, and handles malformed records
+// according to the policy. It returns a PCollection<Metadata> of the records
+// that should be committed to by the map.
+func ValidateRecords(s beam.Scope, records beam.PCollection, policy BadRecordPolicy) beam.PCollection {
+	if policy == AllowBadRecords {
+		return records
+	}
+	return beam.ParDo(s.Scope("validate"), &validateRecordFn{Fail: policy == FailOnBadRecords}, records)
+}
+
+type validateRecordFn struct {
+	Fail bool
+}
+
+func (fn *validateRecordFn) ProcessElement(ctx context.Context, m Metadata, emit func(Metadata)) error {
+	err := validateHash(m.RepoHash)
+	if err == nil {
+		err = validateHash(m.ModHash)
+	}
+	if err == nil {
+		emit(m)
+		return nil
+	}
+	if fn.Fail {
+		return fmt.Errorf("malformed record %d (%s %s): %v", m.ID, m.Module, m.Version, err)
+	}
+	cntRecordsSkipped.Inc(ctx, 1)
+	return nil
+}
+
+// SkippedRecords returns the number of records that were dropped by
+// ValidateRecords in the pipeline run that produced the result. It returns
+// false if the runner doesn't report metrics.
+func SkippedRecords(result beam.PipelineResult) (int64, bool) {
+	return counterValue(result, counterNamespace, recordsSkippedCounter)
+}
+
+// FilteredRecords returns the number of records that were dropped by
+// FilterRecords in the pipeline run that produced the result. It returns
+// false if the runner doesn't report metrics.
+func FilteredRecords(result beam.PipelineResult) (int64, bool) {
+	return counterValue(result, counterNamespace, recordsFilteredCounter)
+}
+
+func counterValue(result beam.PipelineResult, namespace, name string) (int64, bool) {
+	if result == nil {
+		return 0, false
+	}
+	var n int64
+	for _, c := range result.Metrics().AllMetrics().Counters() {
+		if c.Key.Namespace == namespace && c.Key.Name == name {
+			n += c.Result()
+		}
+	}
+	return n, true
+}
+
+// validateHash returns an error if h is not a go.sum hash of the form
+// "h1:<base64 SHA-256>", which is the only hash format used by SumDB.
+func validateHash(h string) error {
+	b64 := strings.TrimPrefix(h, "h1:")
+	if b64 == h {
+		return fmt.Errorf("hash %q does not have h1: prefix", h)
+	}
+	bs, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return fmt.Errorf("hash %q is not valid base64: %v", h, err)
+	}
+	if len(bs) != sha256.Size {
+		return fmt.Errorf("hash %q has length %d, expected %d", h, len(bs), sha256.Size)
+	}
+	return nil
+}
+
 // CreateEntries converts the PCollection<Metadata> into a PCollection<Entry> that will be
-// committed to by the map.
-func CreateEntries(s beam.Scope, treeID int64, records beam.PCollection) beam.PCollection {
-	return beam.ParDo(s.Scope("mapentries"), &mapEntryFn{treeID}, records)
+// committed to by the map, with keys in the given key domain.
+func CreateEntries(s beam.Scope, treeID int64, keyDomain string, records beam.PCollection) beam.PCollection {
+	return beam.ParDo(s.Scope("mapentries"), &mapEntryFn{TreeID: treeID, KeyDomain: keyDomain}, records)
+}
+
+// KVEntry is the key of an entry in the map for a module version, and the
+// value that its leaf hash commits to.
+type KVEntry struct {
+	Key   []byte
+	Value string
+}
+
+// CreateKVEntries converts the PCollection<Metadata> into a PCollection<KVEntry>
+// of the keys and values of the entries that CreateEntries commits to.
+func CreateKVEntries(s beam.Scope, keyDomain string, records beam.PCollection) beam.PCollection {
+	return beam.ParDo(s.Scope("kventries"), &kvEntryFn{KeyDomain: keyDomain}, records)
+}
+
+type kvEntryFn struct {
+	KeyDomain string
+}
+
+func (fn *kvEntryFn) ProcessElement(m Metadata, emit func(KVEntry)) {
+	emit(KVEntry{Key: MapKey(fn.KeyDomain, m.Module, m.Version+"/go.mod"), Value: m.ModHash})
+	emit(KVEntry{Key: MapKey(fn.KeyDomain, m.Module, m.Version), Value: m.RepoHash})
 }
 
 type mapEntryFn struct {
-	TreeID int64
+	TreeID    int64
+	KeyDomain string
+}
+
+// MapKey returns the key in the map under which the hash for the given module
+// version is stored. For the hash of the go.mod file, the version should have
+// the "/go.mod" suffix, i.e. the module and version are as they appear in a
+// go.sum file. This is the key derivation used by the pipeline, and tools that
+// look up entries in the map must use this to compute the keys.
+//
+// The key domain allows several maps to share a tree without their keys
+// colliding. It is empty by default, in which case the key does not depend on it.
+func MapKey(keyDomain, module, version string) []byte {
+	return domainKey(keyDomain, fmt.Sprintf("%s %s", module, version))
+}
+
+// ModuleLogKey returns the key in the map under which the root of the log of
+// versions for the given module is stored, in the given key domain.
+func ModuleLogKey(keyDomain, module string) []byte {
+	return domainKey(keyDomain, module)
+}
+
+// LatestVersionKey returns the key in the map under which the latest version
+// of the given module is stored, in the given key domain. Module paths can't
+// contain "@", so this can't collide with the other keys for the module.
+func LatestVersionKey(keyDomain, module string) []byte {
+	return domainKey(keyDomain, module+"@latest")
+}
+
+// ValidateKeyDomain returns an error if the key domain can't be used to
+// derive keys. Module paths can't contain newlines, so a newline separates
+// the domain from the rest of the key.
+func ValidateKeyDomain(keyDomain string) error {
+	if strings.Contains(keyDomain, "\n") {
+		return fmt.Errorf("key domain %q contains a newline", keyDomain)
+	}
+	return nil
+}
+
+func domainKey(keyDomain, name string) []byte {
+	h := Hash.New()
+	if len(keyDomain) > 0 {
+		h.Write([]byte(keyDomain + "\n"))
+	}
+	h.Write([]byte(name))
+	return h.Sum(nil)
 }
 
 func (fn *mapEntryFn) ProcessElement(m Metadata, emit func(*batchmap.Entry)) {
-	h := hash.New()
-	h.Write([]byte(fmt.Sprintf("%s %s/go.mod", m.Module, m.Version)))
-	modKey := h.Sum(nil)
+	modKey := MapKey(fn.KeyDomain, m.Module, m.Version+"/go.mod")
 	modLeafID := node.NewID(string(modKey), uint(len(modKey)*8))
 
 	emit(&batchmap.Entry{
@@ -62,9 +269,7 @@ func (fn *mapEntryFn) ProcessElement(m Metadata, emit func(*batchmap.Entry)) {
 		HashValue: coniks.Default.HashLeaf(fn.TreeID, modLeafID, []byte(m.ModHash)),
 	})
 
-	h = hash.New()
-	h.Write([]byte(fmt.Sprintf("%s %s", m.Module, m.Version)))
-	repoKey := h.Sum(nil)
+	repoKey := MapKey(fn.KeyDomain, m.Module, m.Version)
 	repoLeafID := node.NewID(string(repoKey), uint(len(repoKey)*8))
 
 	emit(&batchmap.Entry{
@@ -15,11 +15,13 @@
 package pipeline
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/apache/beam/sdks/go/pkg/beam"
 	"github.com/apache/beam/sdks/go/pkg/beam/testing/passert"
 	"github.com/apache/beam/sdks/go/pkg/beam/testing/ptest"
+	"github.com/google/trillian/experimental/batchmap"
 )
 
 func TestMain(m *testing.M) {
@@ -55,7 +57,7 @@ func TestCreateEntries(t *testing.T) {
 			p, s := beam.NewPipelineWithRoot()
 			metadata := beam.CreateList(s, test.metadata)
 
-			entries := CreateEntries(s, test.treeID, metadata)
+			entries := CreateEntries(s, test.treeID, "", metadata)
 
 			passert.Count(s, entries, "entries", test.wantCount)
 			err := ptest.Run(p)
@@ -65,3 +67,193 @@ func TestCreateEntries(t *testing.T) {
 		})
 	}
 }
+
+func TestMapKey(t *testing.T) {
+	for _, test := range []struct {
+		keyDomain       string
+		module, version string
+		want            string
+	}{
+		{
+			module:  "foo",
+			version: "v1.0.0",
+			want:    "e7c907afbe1421822521a4a621565c1f71aadc48815faba0ce932ebe0fe514c7",
+		},
+		{
+			module:  "foo",
+			version: "v1.0.0/go.mod",
+			want:    "c946f9eb0c0812b12b38366ebfc52739c2c7aa88ae2bf6faf3c478d297f9b16e",
+		},
+		{
+			module:  "github.com/google/trillian",
+			version: "v1.3.11",
+			want:    "5e66feadd2f47a002df416a2fcd4da57b22aa05879bc3578be10cc3a9f9171cd",
+		},
+		{
+			keyDomain: "tenant-a",
+			module:    "foo",
+			version:   "v1.0.0",
+			want:      "a7a31eb4ce895f83446e3ad29ddc109d7be2415a902107b5ff474a5cfe0e9e0c",
+		},
+	} {
+		if got := fmt.Sprintf("%x", MapKey(test.keyDomain, test.module, test.version)); got != test.want {
+			t.Errorf("MapKey(%q, %q, %q) = %s, want %s", test.keyDomain, test.module, test.version, got, test.want)
+		}
+	}
+}
+
+func TestModuleLogKey(t *testing.T) {
+	if got, want := fmt.Sprintf("%x", ModuleLogKey("", "foo")), "d58042e6aa5a335e03ad576c6a9e43b41591bfd2077f72dec9df7930e492055d"; got != want {
+		t.Errorf("ModuleLogKey(%q, %q) = %s, want %s", "", "foo", got, want)
+	}
+	if got, want := fmt.Sprintf("%x", ModuleLogKey("tenant-a", "foo")), "af35dce8c3dcf15de48b6d8e4d37ba11d2d71fbbc081043a4f164a20bb9f7127"; got != want {
+		t.Errorf("ModuleLogKey(%q, %q) = %s, want %s", "tenant-a", "foo", got, want)
+	}
+}
+
+func TestValidateKeyDomain(t *testing.T) {
+	if err := ValidateKeyDomain("tenant-a"); err != nil {
+		t.Errorf("ValidateKeyDomain(%q): %v", "tenant-a", err)
+	}
+	if err := ValidateKeyDomain("tenant\na"); err == nil {
+		t.Errorf("ValidateKeyDomain(%q): expected error", "tenant\na")
+	}
+}
+
+func TestCreateEntriesUsesMapKey(t *testing.T) {
+	p, s := beam.NewPipelineWithRoot()
+	metadata := beam.CreateList(s, []Metadata{
+		{
+			Module:   "foo",
+			Version:  "v1.0.0",
+			RepoHash: "abcdefab",
+			ModHash:  "deadbeef",
+		},
+	})
+
+	entries := CreateEntries(s, 12345, "tenant-a", metadata)
+
+	keys := beam.ParDo(s, func(e *batchmap.Entry) string { return fmt.Sprintf("%x", e.HashKey) }, entries)
+	passert.Equals(s, keys,
+		fmt.Sprintf("%x", MapKey("tenant-a", "foo", "v1.0.0")),
+		fmt.Sprintf("%x", MapKey("tenant-a", "foo", "v1.0.0/go.mod")))
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCreateKVEntries(t *testing.T) {
+	p, s := beam.NewPipelineWithRoot()
+	metadata := beam.Create(s, Metadata{Module: "foo", Version: "v1.0.0", RepoHash: "h1:repo", ModHash: "h1:mod"})
+
+	kv := CreateKVEntries(s, "tenant-a", metadata)
+
+	rows := beam.ParDo(s, func(e KVEntry) string { return fmt.Sprintf("%x=%s", e.Key, e.Value) }, kv)
+	passert.Equals(s, rows,
+		fmt.Sprintf("%x=h1:repo", MapKey("tenant-a", "foo", "v1.0.0")),
+		fmt.Sprintf("%x=h1:mod", MapKey("tenant-a", "foo", "v1.0.0/go.mod")))
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestValidateHash(t *testing.T) {
+	for _, test := range []struct {
+		hash    string
+		wantErr bool
+	}{
+		{hash: "h1:47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="},
+		{hash: "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=", wantErr: true},
+		{hash: "h2:47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=", wantErr: true},
+		{hash: "h1:not base64!", wantErr: true},
+		{hash: "h1:deadbeef", wantErr: true},
+		{hash: "", wantErr: true},
+	} {
+		if err := validateHash(test.hash); (err != nil) != test.wantErr {
+			t.Errorf("validateHash(%q) = %v, wantErr %t", test.hash, err, test.wantErr)
+		}
+	}
+}
+
+func TestValidateRecords(t *testing.T) {
+	const goodHash = "h1:47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="
+	records := []Metadata{
+		{ID: 0, Module: "foo", Version: "v1.0.0", RepoHash: goodHash, ModHash: goodHash},
+		{ID: 1, Module: "foo", Version: "v1.0.1", RepoHash: "abcdefab", ModHash: goodHash},
+		{ID: 2, Module: "bar", Version: "v1.0.0", RepoHash: goodHash, ModHash: "h1:"},
+	}
+
+	for _, test := range []struct {
+		name    string
+		policy  BadRecordPolicy
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:   "allow",
+			policy: AllowBadRecords,
+			want:   []string{"foo v1.0.0", "foo v1.0.1", "bar v1.0.0"},
+		},
+		{
+			name:   "skip",
+			policy: SkipBadRecords,
+			want:   []string{"foo v1.0.0"},
+		},
+		{
+			name:    "fail",
+			policy:  FailOnBadRecords,
+			wantErr: true,
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			p, s := beam.NewPipelineWithRoot()
+			valid := ValidateRecords(s, beam.CreateList(s, records), test.policy)
+			if !test.wantErr {
+				passert.Equals(s, beam.ParDo(s, func(m Metadata) string { return m.Module + " " + m.Version }, valid), beam.CreateList(s, test.want))
+			}
+			if err := ptest.Run(p); (err != nil) != test.wantErr {
+				t.Errorf("pipeline error = %v, wantErr %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestFilterRecords(t *testing.T) {
+	records := []Metadata{
+		{Module: "github.com/myorg/foo", Version: "v1.0.0"},
+		{Module: "github.com/myorg/bar", Version: "v1.0.0"},
+		{Module: "github.com/other/foo", Version: "v1.0.0"},
+		{Module: "example.com/github.com/myorg/baz", Version: "v1.0.0"},
+	}
+
+	for _, test := range []struct {
+		name   string
+		filter string
+		want   []string
+	}{
+		{
+			name: "no filter",
+			want: []string{"github.com/myorg/foo", "github.com/myorg/bar", "github.com/other/foo", "example.com/github.com/myorg/baz"},
+		},
+		{
+			name:   "prefix",
+			filter: "^github.com/myorg/",
+			want:   []string{"github.com/myorg/foo", "github.com/myorg/bar"},
+		},
+		{
+			name:   "no matches",
+			filter: "^golang.org/",
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			p, s := beam.NewPipelineWithRoot()
+			filtered := FilterRecords(s, beam.CreateList(s, records), test.filter)
+			passert.Equals(s, beam.ParDo(s, func(m Metadata) string { return m.Module }, filtered), beam.CreateList(s, test.want))
+			if err := ptest.Run(p); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2021 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/io/filesystem"
+	"github.com/apache/beam/sdks/go/pkg/beam/io/textio"
+	"github.com/apache/beam/sdks/go/pkg/beam/transforms/stats"
+
+	// Register the file systems that input files can be read from.
+	_ "github.com/apache/beam/sdks/go/pkg/beam/io/filesystem/gcs"
+	_ "github.com/apache/beam/sdks/go/pkg/beam/io/filesystem/local"
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*parseJSONLFn)(nil)).Elem())
+	beam.RegisterFunction(recordIDFn)
+	beam.RegisterType(reflect.TypeOf((*checkUniqueIDFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*checkIDCountFn)(nil)).Elem())
+}
+
+// JSONLInput is an InputLog that reads Metadata records from files of
+// newline-delimited JSON, with one object per line such as:
+//
+//	{"ID": 0, "Module": "example.com/foo", "Version": "v1.0.0", "RepoHash": "h1:...", "ModHash": "h1:..."}
+//
+// As for a SumDB mirror, the IDs of the N records must be 0 to N-1 so that
+// a map can be built from the first entries, and updated with later ones.
+// The pipeline fails if the records read by Entries don't have exactly the
+// IDs requested. There is no checkpoint for the records, so Head returns a
+// nil checkpoint.
+type JSONLInput struct {
+	glob   string
+	policy BadRecordPolicy
+	count  int64
+}
+
+// NewJSONLInput returns a JSONLInput for the files matching the glob, which
+// may be on any file system that Beam supports, e.g. gs://bucket/*.jsonl.
+// Lines that can't be parsed are handled according to the policy: they are
+// dropped by SkipBadRecords, and otherwise fail the pipeline.
+// The files are read once here to count the records in them, which doesn't
+// include lines that can't be parsed.
+func NewJSONLInput(ctx context.Context, glob string, policy BadRecordPolicy) (*JSONLInput, error) {
+	fs, err := filesystem.New(ctx, glob)
+	if err != nil {
+		return nil, err
+	}
+	defer fs.Close()
+	files, err := fs.List(ctx, glob)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %q: %v", glob, err)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no files match %q", glob)
+	}
+	var count int64
+	for _, f := range files {
+		n, err := countRecords(ctx, fs, f)
+		if err != nil {
+			return nil, err
+		}
+		count += n
+	}
+	return &JSONLInput{glob: glob, policy: policy, count: count}, nil
+}
+
+// countRecords returns the number of lines in the file that can be parsed.
+func countRecords(ctx context.Context, fs filesystem.Interface, filename string) (int64, error) {
+	r, err := fs.OpenRead(ctx, filename)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open %q: %v", filename, err)
+	}
+	defer r.Close()
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	var n int64
+	for sc.Scan() {
+		var m Metadata
+		if len(strings.TrimSpace(sc.Text())) > 0 && json.Unmarshal(sc.Bytes(), &m) == nil {
+			n++
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read %q: %v", filename, err)
+	}
+	return n, nil
+}
+
+// Head returns a nil checkpoint and the number of records in the files.
+func (i *JSONLInput) Head() ([]byte, int64, error) {
+	return nil, i.count, nil
+}
+
+// Entries returns a PCollection of Metadata, containing the records with IDs
+// in range [start, end). The pipeline fails unless there is exactly one
+// record for each ID in the range.
+func (i *JSONLInput) Entries(s beam.Scope, start, end int64) beam.PCollection {
+	lines := textio.Read(s, i.glob)
+	records := beam.ParDo(s.Scope("parseJSONL"), &parseJSONLFn{Start: start, End: end, Skip: i.policy == SkipBadRecords}, lines)
+	checkIDs(s.Scope("checkIDs"), records, start, end)
+	return records
+}
+
+// checkIDs fails the pipeline unless the records, whose IDs are all in range
+// [start, end), have each of those IDs once. This is the case if no ID is
+// repeated, and there are end-start distinct IDs.
+func checkIDs(s beam.Scope, records beam.PCollection, start, end int64) {
+	counts := stats.Count(s, beam.ParDo(s, recordIDFn, records))
+	ids := stats.CountElms(s, beam.ParDo(s, &checkUniqueIDFn{}, counts))
+	beam.ParDo0(s, &checkIDCountFn{Start: start, End: end}, ids)
+}
+
+func recordIDFn(m Metadata) int64 {
+	return m.ID
+}
+
+type checkUniqueIDFn struct{}
+
+func (fn *checkUniqueIDFn) ProcessElement(id int64, n int, emit func(int64)) error {
+	if n > 1 {
+		return fmt.Errorf("found %d records with ID %d", n, id)
+	}
+	emit(id)
+	return nil
+}
+
+type checkIDCountFn struct {
+	Start, End int64
+}
+
+func (fn *checkIDCountFn) ProcessElement(n int) error {
+	if want := fn.End - fn.Start; int64(n) != want {
+		return fmt.Errorf("found %d records with IDs in [%d, %d), want %d; the IDs of the N records must be 0 to N-1", n, fn.Start, fn.End, want)
+	}
+	return nil
+}
+
+type parseJSONLFn struct {
+	Start, End int64
+	Skip       bool
+}
+
+func (fn *parseJSONLFn) ProcessElement(ctx context.Context, line string, emit func(Metadata)) error {
+	if len(strings.TrimSpace(line)) == 0 {
+		return nil
+	}
+	var m Metadata
+	if err := json.Unmarshal([]byte(line), &m); err != nil {
+		if !fn.Skip {
+			return fmt.Errorf("malformed record %q: %v", line, err)
+		}
+		cntRecordsSkipped.Inc(ctx, 1)
+		return nil
+	}
+	if m.ID >= fn.Start && m.ID < fn.End {
+		emit(m)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2021 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/go/pkg/beam/testing/ptest"
+)
+
+func TestJSONLInput(t *testing.T) {
+	dir := t.TempDir()
+	for name, contents := range map[string]string{
+		"a.jsonl": `{"ID": 0, "Module": "foo", "Version": "v1.0.0", "RepoHash": "h1:foo", "ModHash": "h1:foomod"}
+{"ID": 2, "Module": "bar", "Version": "v1.0.0", "RepoHash": "h1:bar", "ModHash": "h1:barmod"}
+
+`,
+		"b.jsonl": `{"ID": 1, "Module": "foo", "Version": "v1.1.0", "RepoHash": "h1:foo1", "ModHash": "h1:foo1mod"}
+{"ID": 3, "Module": "baz", "Version": "v0.1.0", "RepoHash": "h1:baz", "ModHash": "h1:bazmod"}`,
+		"bad.txt": `{"ID": 4, "Module": "bad"`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx := context.Background()
+
+	t.Run("reads records in range", func(t *testing.T) {
+		input, err := NewJSONLInput(ctx, filepath.Join(dir, "*.jsonl"), FailOnBadRecords)
+		if err != nil {
+			t.Fatalf("NewJSONLInput(): %v", err)
+		}
+		if cp, n, err := input.Head(); err != nil || cp != nil || n != 4 {
+			t.Errorf("Head() = %q, %d, %v; want nil, 4, nil", cp, n, err)
+		}
+		p, s := beam.NewPipelineWithRoot()
+		passert.Equals(s, input.Entries(s, 1, 3), beam.CreateList(s, []Metadata{
+			{ID: 1, Module: "foo", Version: "v1.1.0", RepoHash: "h1:foo1", ModHash: "h1:foo1mod"},
+			{ID: 2, Module: "bar", Version: "v1.0.0", RepoHash: "h1:bar", ModHash: "h1:barmod"},
+		}))
+		if err := ptest.Run(p); err != nil {
+			t.Fatalf("pipeline failed: %v", err)
+		}
+	})
+
+	for _, test := range []struct {
+		name    string
+		policy  BadRecordPolicy
+		wantErr bool
+	}{
+		{name: "fails on bad record", policy: FailOnBadRecords, wantErr: true},
+		{name: "skips bad record", policy: SkipBadRecords},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			input, err := NewJSONLInput(ctx, filepath.Join(dir, "*"), test.policy)
+			if err != nil {
+				t.Fatalf("NewJSONLInput(): %v", err)
+			}
+			// The line that can't be parsed isn't counted.
+			if _, n, err := input.Head(); err != nil || n != 4 {
+				t.Errorf("Head() = %d, %v; want 4, nil", n, err)
+			}
+			p, s := beam.NewPipelineWithRoot()
+			passert.Count(s, input.Entries(s, 0, 4), "records", 4)
+			if err := ptest.Run(p); (err != nil) != test.wantErr {
+				t.Fatalf("pipeline returned %v, wantErr %t", err, test.wantErr)
+			}
+		})
+	}
+
+	for _, test := range []struct {
+		name     string
+		contents string
+	}{
+		{name: "missing ID", contents: `{"ID": 0, "Module": "foo", "Version": "v1.0.0"}
+{"ID": 2, "Module": "bar", "Version": "v1.0.0"}`},
+		{name: "duplicate ID", contents: `{"ID": 0, "Module": "foo", "Version": "v1.0.0"}
+{"ID": 0, "Module": "bar", "Version": "v1.0.0"}`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := ioutil.WriteFile(filepath.Join(dir, "a.jsonl"), []byte(test.contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+			input, err := NewJSONLInput(ctx, filepath.Join(dir, "*.jsonl"), FailOnBadRecords)
+			if err != nil {
+				t.Fatalf("NewJSONLInput(): %v", err)
+			}
+			_, n, err := input.Head()
+			if err != nil {
+				t.Fatalf("Head(): %v", err)
+			}
+			p, s := beam.NewPipelineWithRoot()
+			input.Entries(s, 0, n)
+			if err := ptest.Run(p); err == nil {
+				t.Error("pipeline succeeded, want error")
+			}
+		})
+	}
+
+	if _, err := NewJSONLInput(ctx, filepath.Join(dir, "*.json"), FailOnBadRecords); err == nil {
+		t.Error("NewJSONLInput() with no matching files: expected error")
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2021 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"reflect"
+
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/google/trillian/experimental/batchmap"
+	"github.com/google/trillian/merkle/coniks"
+	"github.com/google/trillian/merkle/smt/node"
+	"golang.org/x/mod/semver"
+)
+
+func init() {
+	beam.RegisterFunction(moduleSemverFn)
+	beam.RegisterFunction(maxVersionFn)
+	beam.RegisterType(reflect.TypeOf((*latestVersionEntryFn)(nil)).Elem())
+}
+
+// MakeLatestVersions takes the Metadata for all modules and finds the highest
+// semantic version logged for each module. This method returns a PCollection
+// of type Entry, with one entry per module that commits to its latest version
+// under the LatestVersionKey in the given key domain. Versions that aren't
+// valid semantic versions are ignored.
+//
+// The latest version can only be found from the complete list of versions
+// of a module, so this can't be used to update a map from a delta.
+func MakeLatestVersions(s beam.Scope, treeID int64, keyDomain string, metadata beam.PCollection) beam.PCollection {
+	s = s.Scope("MakeLatestVersions")
+	versions := beam.ParDo(s, moduleSemverFn, metadata)
+	latest := beam.CombinePerKey(s, maxVersionFn, versions)
+	return beam.ParDo(s, &latestVersionEntryFn{TreeID: treeID, KeyDomain: keyDomain}, latest)
+}
+
+func moduleSemverFn(m Metadata, emit func(string, string)) {
+	if semver.IsValid(m.Version) {
+		emit(m.Module, m.Version)
+	}
+}
+
+func maxVersionFn(a, b string) string {
+	if semver.Compare(a, b) < 0 {
+		return b
+	}
+	return a
+}
+
+type latestVersionEntryFn struct {
+	TreeID    int64
+	KeyDomain string
+}
+
+func (fn *latestVersionEntryFn) ProcessElement(module, version string) *batchmap.Entry {
+	key := LatestVersionKey(fn.KeyDomain, module)
+	leafID := node.NewID(string(key), uint(len(key)*8))
+	return &batchmap.Entry{
+		HashKey:   key,
+		HashValue: coniks.Default.HashLeaf(fn.TreeID, leafID, []byte(version)),
+	}
+}
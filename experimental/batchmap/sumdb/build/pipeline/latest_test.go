@@ -0,0 +1,60 @@
+// Copyright 2021 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/go/pkg/beam/testing/ptest"
+	"github.com/google/trillian/experimental/batchmap"
+)
+
+func TestMakeLatestVersions(t *testing.T) {
+	p, s := beam.NewPipelineWithRoot()
+	metadata := beam.CreateList(s, []Metadata{
+		{ID: 0, Module: "foo", Version: "v1.2.0"},
+		{ID: 1, Module: "foo", Version: "v1.10.0"},
+		{ID: 2, Module: "foo", Version: "v1.9.1"},
+		{ID: 3, Module: "bar", Version: "v0.1.0"},
+		{ID: 4, Module: "bar", Version: "v0.2.0-pre"},
+		{ID: 5, Module: "bar", Version: "not-semver"},
+		{ID: 6, Module: "baz", Version: "not-semver"},
+	})
+
+	entries := MakeLatestVersions(s, treeID, "tenant-a", metadata)
+
+	entryToString := func(e *batchmap.Entry) string { return fmt.Sprintf("%x=%x", e.HashKey, e.HashValue) }
+	fn := &latestVersionEntryFn{TreeID: treeID, KeyDomain: "tenant-a"}
+	passert.Equals(s, beam.ParDo(s, entryToString, entries),
+		entryToString(fn.ProcessElement("foo", "v1.10.0")),
+		entryToString(fn.ProcessElement("bar", "v0.2.0-pre")))
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestLatestVersionKey(t *testing.T) {
+	if got, want := fmt.Sprintf("%x", LatestVersionKey("", "foo")), "00d2ce750219c4d03b3fc716801d76f18e64ef5f54d87034badaf045933953cc"; got != want {
+		t.Errorf("LatestVersionKey(%q, %q) = %s, want %s", "", "foo", got, want)
+	}
+	// This must not collide with the key of the version log for the module.
+	if got, other := LatestVersionKey("", "foo"), ModuleLogKey("", "foo"); bytes.Equal(got, other) {
+		t.Errorf("LatestVersionKey(%q, %q) = ModuleLogKey(%q, %q)", "", "foo", "", "foo")
+	}
+}
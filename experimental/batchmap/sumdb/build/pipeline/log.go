@@ -15,6 +15,7 @@
 package pipeline
 
 import (
+	"context"
 	"fmt"
 	"reflect"
 	"sort"
@@ -30,32 +31,121 @@ import (
 )
 
 func init() {
-	beam.RegisterFunction(makeModuleVersionLogFn)
+	beam.RegisterType(reflect.TypeOf((*makeModuleVersionLogFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*mergeModuleVersionLogFn)(nil)).Elem())
 	beam.RegisterType(reflect.TypeOf((*moduleLogHashFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*countVersionLogFn)(nil)).Elem())
 }
 
 // ModuleVersionLog represents the versions found for a single
 // Go Module within the SumDB log. The versions are sorted by
 // the order they are logged in SumDB.
+//
+// A log with no versions records a module whose log was skipped as bad. It
+// isn't added to the map, but is kept with the other logs so that updates know
+// that the module's earlier versions are missing, and keep skipping it rather
+// than starting a log from just its new versions.
 type ModuleVersionLog struct {
 	Module   string
 	Versions []string
 }
 
+var cntVersionLogsSkipped = beam.NewCounter(counterNamespace, versionLogsSkippedCounter)
+
 // MakeVersionLogs takes the Metadata for all modules and processes this by
 // module in order to create logs of versions. The versions for each module
 // are sorted (by ID in the original log), and a log is constructed for each
 // module. This method returns two PCollections: the first is of type Entry
-// and is the key/value data to include in the map, the second is of type
-// ModuleVersionLog.
-func MakeVersionLogs(s beam.Scope, treeID int64, metadata beam.PCollection) (beam.PCollection, beam.PCollection) {
+// and is the key/value data to include in the map, with keys in the given key
+// domain, the second is of type ModuleVersionLog.
+//
+// Unless the policy is AllowBadRecords, the records for each module are
+// checked to make sure that they can be logged: each must have a version, and
+// no two can have the same ID. A module with bad records fails the pipeline
+// with FailOnBadRecords, and with SkipBadRecords its log is left out of the
+// map, along with any other log that can't be built, and the number of
+// modules left out is counted by the pipeline/version-logs-skipped counter.
+// The second output has an empty log for each module left out.
+func MakeVersionLogs(s beam.Scope, treeID int64, keyDomain string, policy BadRecordPolicy, metadata beam.PCollection) (beam.PCollection, beam.PCollection) {
 	keyed := beam.ParDo(s, func(m Metadata) (string, Metadata) { return m.Module, m }, metadata)
-	logs := beam.ParDo(s, makeModuleVersionLogFn, beam.GroupByKey(s, keyed))
-	return beam.ParDo(s, &moduleLogHashFn{TreeID: treeID}, logs), logs
+	logs := beam.ParDo(s, &makeModuleVersionLogFn{Policy: policy}, beam.GroupByKey(s, keyed))
+	return beam.ParDo(s, &moduleLogHashFn{TreeID: treeID, KeyDomain: keyDomain}, logs), logs
+}
+
+// SkippedVersionLogs returns the number of modules whose version logs were
+// left out of the map by MakeVersionLogs or UpdateVersionLogs with
+// SkipBadRecords in the pipeline run that produced the result. It returns
+// false if the runner doesn't report metrics.
+func SkippedVersionLogs(result beam.PipelineResult) (int64, bool) {
+	return counterValue(result, counterNamespace, versionLogsSkippedCounter)
+}
+
+// CountVersionLogs builds the version logs for the Metadata as MakeVersionLogs
+// does, but discards them after counting them. The number of logs, which is
+// the number of entries they would add to the map, is counted by the
+// pipeline/version-logs counter, and the number of versions in them by the
+// pipeline/version-log-entries counter.
+func CountVersionLogs(s beam.Scope, treeID int64, metadata beam.PCollection) {
+	s = s.Scope("CountVersionLogs")
+	_, logs := MakeVersionLogs(s, treeID, "", AllowBadRecords, metadata)
+	beam.ParDo0(s, &countVersionLogFn{}, logs)
+}
+
+// VersionLogCounts returns the number of version logs and the total number of
+// versions in them that were counted by CountVersionLogs in the pipeline run
+// that produced the result. It returns false if the runner doesn't report
+// metrics.
+func VersionLogCounts(result beam.PipelineResult) (logs, versions int64, ok bool) {
+	if logs, ok = counterValue(result, counterNamespace, versionLogsCounter); !ok {
+		return 0, 0, false
+	}
+	versions, _ = counterValue(result, counterNamespace, versionLogEntriesCounter)
+	return logs, versions, true
+}
+
+type countVersionLogFn struct {
+	logs, versions beam.Counter
+}
+
+func (fn *countVersionLogFn) Setup() {
+	fn.logs = beam.NewCounter(counterNamespace, versionLogsCounter)
+	fn.versions = beam.NewCounter(counterNamespace, versionLogEntriesCounter)
+}
+
+func (fn *countVersionLogFn) ProcessElement(ctx context.Context, log *ModuleVersionLog) {
+	fn.logs.Inc(ctx, 1)
+	fn.versions.Inc(ctx, int64(len(log.Versions)))
+}
+
+// UpdateVersionLogs takes the ModuleVersionLogs from a previous build of the
+// map, and the Metadata for the entries being added to the map, and updates
+// the logs for any modules that have new versions. The new versions must all
+// have been logged after the versions in the previous logs, i.e. the Metadata
+// must be entries in the input log after those used to build the base logs.
+// This method returns two PCollections: the first is of type Entry and is the
+// key/value data that has changed in the map, with keys in the given key
+// domain, the second is of type ModuleVersionLog and contains the logs for all
+// modules, whether they changed or not.
+// The new records are checked according to the policy as for MakeVersionLogs.
+// With SkipBadRecords, a module whose log can't be updated keeps its log from
+// the previous build, without the new versions, and is counted as skipped.
+// This includes modules with several base logs, which keep the longest one,
+// and modules skipped by earlier builds, which stay skipped. New versions of
+// skipped modules are counted as skipped each time. With other policies,
+// updating a base in which any module was skipped fails the pipeline, as the
+// version list would otherwise be left incomplete without being counted. Maps built before skipped
+// modules were recorded have no empty logs for them, so on the first update
+// such a module with new versions gets a log of only those versions.
+func UpdateVersionLogs(s beam.Scope, treeID int64, keyDomain string, policy BadRecordPolicy, base, metadata beam.PCollection) (beam.PCollection, beam.PCollection) {
+	keyedBase := beam.ParDo(s, func(l *ModuleVersionLog) (string, *ModuleVersionLog) { return l.Module, l }, base)
+	keyedDelta := beam.ParDo(s, func(m Metadata) (string, Metadata) { return m.Module, m }, metadata)
+	logs, updated := beam.ParDo2(s, &mergeModuleVersionLogFn{Policy: policy}, beam.CoGroupByKey(s, keyedBase, keyedDelta))
+	return beam.ParDo(s, &moduleLogHashFn{TreeID: treeID, KeyDomain: keyDomain}, updated), logs
 }
 
 type moduleLogHashFn struct {
-	TreeID int64
+	TreeID    int64
+	KeyDomain string
 
 	rf *compact.RangeFactory
 }
@@ -73,7 +163,11 @@ func (fn *moduleLogHashFn) Setup() {
 	}
 }
 
-func (fn *moduleLogHashFn) ProcessElement(log *ModuleVersionLog) (*batchmap.Entry, error) {
+func (fn *moduleLogHashFn) ProcessElement(log *ModuleVersionLog, emit func(*batchmap.Entry)) error {
+	if len(log.Versions) == 0 {
+		// The module was skipped, so it has no log in the map.
+		return nil
+	}
 	logRange := fn.rf.NewEmptyRange(0)
 	for _, v := range log.Versions {
 		h := tlog.RecordHash([]byte(v))
@@ -81,26 +175,54 @@ func (fn *moduleLogHashFn) ProcessElement(log *ModuleVersionLog) (*batchmap.Entr
 	}
 	logRoot, err := logRange.GetRootHash(nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create log for %q: %v", log.Module, err)
+		return fmt.Errorf("failed to create log for %q: %v", log.Module, err)
 	}
-	h := hash.New()
-	h.Write([]byte(log.Module))
-	logKey := h.Sum(nil)
+	logKey := ModuleLogKey(fn.KeyDomain, log.Module)
 	leafID := node.NewID(string(logKey), uint(len(logKey)*8))
 
-	return &batchmap.Entry{
-		HashKey:   h.Sum(nil),
+	emit(&batchmap.Entry{
+		HashKey:   logKey,
 		HashValue: coniks.Default.HashLeaf(fn.TreeID, leafID, logRoot),
-	}, nil
+	})
+	return nil
 }
 
-func makeModuleVersionLogFn(module string, metadata func(*Metadata) bool) (*ModuleVersionLog, error) {
+type makeModuleVersionLogFn struct {
+	Policy BadRecordPolicy
+}
+
+func (fn *makeModuleVersionLogFn) ProcessElement(ctx context.Context, module string, metadata func(*Metadata) bool, emit func(*ModuleVersionLog)) error {
+	log, err := makeModuleVersionLog(module, metadata, fn.Policy != AllowBadRecords)
+	if err != nil {
+		if fn.Policy == SkipBadRecords {
+			cntVersionLogsSkipped.Inc(ctx, 1)
+			emit(&ModuleVersionLog{Module: module})
+			return nil
+		}
+		return err
+	}
+	emit(log)
+	return nil
+}
+
+// makeModuleVersionLog returns the log of the versions in the metadata for
+// the module. If validate is true then an error is returned if any of the
+// records can't be logged.
+func makeModuleVersionLog(module string, metadata func(*Metadata) bool, validate bool) (*ModuleVersionLog, error) {
 	// We need to ensure ordering by ID in the original log for stability.
 
 	// First build up a map from ID to version.
 	mm := make(map[int64]string)
 	var m Metadata
 	for metadata(&m) {
+		if validate {
+			if len(m.Version) == 0 {
+				return nil, fmt.Errorf("record %d for %q has no version", m.ID, module)
+			}
+			if v, ok := mm[m.ID]; ok {
+				return nil, fmt.Errorf("found multiple records with ID %d for %q (%s and %s)", m.ID, module, v, m.Version)
+			}
+		}
 		mm[m.ID] = m.Version
 	}
 
@@ -122,3 +244,79 @@ func makeModuleVersionLogFn(module string, metadata func(*Metadata) bool) (*Modu
 		Versions: versions,
 	}, nil
 }
+
+// mergeModuleVersionLogFn appends any new versions to the existing log for the
+// module. All logs are output to the first emitter, and any that have changed
+// are also output to the second emitter.
+type mergeModuleVersionLogFn struct {
+	Policy BadRecordPolicy
+}
+
+func (fn *mergeModuleVersionLogFn) ProcessElement(ctx context.Context, module string, base func(**ModuleVersionLog) bool, delta func(*Metadata) bool, emitLog, emitUpdated func(*ModuleVersionLog)) error {
+	var log *ModuleVersionLog
+	var l *ModuleVersionLog
+	var multiple bool
+	for base(&l) {
+		if log != nil {
+			multiple = true
+			if len(l.Versions) <= len(log.Versions) {
+				continue
+			}
+		}
+		log = l
+	}
+	if multiple {
+		if fn.Policy != SkipBadRecords {
+			return fmt.Errorf("found multiple base logs for %q", module)
+		}
+		// The longest log is kept, so that the module stays in the map.
+		cntVersionLogsSkipped.Inc(ctx, 1)
+		emitLog(log)
+		return nil
+	}
+	if log != nil && len(log.Versions) == 0 {
+		// The module was skipped by an earlier build, so its earlier versions
+		// aren't in a log that the new ones could be appended to, and only a
+		// build from scratch can add it back to the version list.
+		if fn.Policy != SkipBadRecords {
+			return fmt.Errorf("%q was left out of the version list of the base revision, so it can only be updated with SkipBadRecords", module)
+		}
+		var m Metadata
+		if delta(&m) {
+			cntVersionLogsSkipped.Inc(ctx, 1)
+		}
+		emitLog(log)
+		return nil
+	}
+
+	// The new versions are ordered in the same way as makeModuleVersionLogFn.
+	added, err := makeModuleVersionLog(module, delta, fn.Policy != AllowBadRecords)
+	if err != nil {
+		if fn.Policy != SkipBadRecords {
+			return err
+		}
+		cntVersionLogsSkipped.Inc(ctx, 1)
+		if log == nil {
+			log = &ModuleVersionLog{Module: module}
+		}
+		emitLog(log)
+		return nil
+	}
+
+	if log == nil {
+		log = added
+	} else if len(added.Versions) > 0 {
+		versions := make([]string, 0, len(log.Versions)+len(added.Versions))
+		versions = append(append(versions, log.Versions...), added.Versions...)
+		log = &ModuleVersionLog{
+			Module:   module,
+			Versions: versions,
+		}
+	}
+
+	emitLog(log)
+	if len(added.Versions) > 0 {
+		emitUpdated(log)
+	}
+	return nil
+}
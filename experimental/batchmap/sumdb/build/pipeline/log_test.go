@@ -16,6 +16,7 @@ package pipeline
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/apache/beam/sdks/go/pkg/beam"
@@ -108,7 +109,7 @@ func TestMakeVersionLogs(t *testing.T) {
 			p, s := beam.NewPipelineWithRoot()
 			metadata := beam.CreateList(s, test.metadata)
 
-			entries, logs := MakeVersionLogs(s, treeID, metadata)
+			entries, logs := MakeVersionLogs(s, treeID, "", AllowBadRecords, metadata)
 
 			passert.Count(s, entries, "entries", test.wantCount)
 			passert.Count(s, logs, "logs", test.wantCount)
@@ -127,3 +128,198 @@ func TestMakeVersionLogs(t *testing.T) {
 		})
 	}
 }
+
+func TestUpdateVersionLogs(t *testing.T) {
+	tests := []struct {
+		name     string
+		base     []*ModuleVersionLog
+		metadata []Metadata
+
+		wantEntries  int
+		wantLogs     int
+		wantRoot     string
+		wantVersions []string
+	}{
+		{
+			name: "new version for existing module",
+			base: []*ModuleVersionLog{
+				{Module: "foo", Versions: []string{"1"}},
+			},
+			metadata: []Metadata{
+				{
+					Module:  "foo",
+					Version: "2",
+					ID:      2,
+				},
+			},
+			wantEntries: 1,
+			wantLogs:    1,
+			// This is the same root as building the log from scratch.
+			wantRoot:     "7fadb0db3926ec36f4028452856670df932eacba6f624ed82284c4a63adc5f73",
+			wantVersions: []string{"1", "2"},
+		},
+		{
+			name: "new versions out of order",
+			base: []*ModuleVersionLog{
+				{Module: "foo", Versions: []string{"1"}},
+			},
+			metadata: []Metadata{
+				{
+					Module:  "foo",
+					Version: "3",
+					ID:      3,
+				},
+				{
+					Module:  "foo",
+					Version: "2",
+					ID:      2,
+				},
+			},
+			wantEntries:  1,
+			wantLogs:     1,
+			wantVersions: []string{"1", "2", "3"},
+		},
+		{
+			name: "new module",
+			base: []*ModuleVersionLog{
+				{Module: "foo", Versions: []string{"1"}},
+			},
+			metadata: []Metadata{
+				{
+					Module:  "bar",
+					Version: "1",
+					ID:      2,
+				},
+			},
+			wantEntries: 1,
+			wantLogs:    2,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			p, s := beam.NewPipelineWithRoot()
+			base := beam.CreateList(s, test.base)
+			metadata := beam.CreateList(s, test.metadata)
+
+			entries, logs := UpdateVersionLogs(s, treeID, "", AllowBadRecords, base, metadata)
+
+			passert.Count(s, entries, "entries", test.wantEntries)
+			passert.Count(s, logs, "logs", test.wantLogs)
+			if len(test.wantRoot) > 0 {
+				roots := beam.ParDo(s, func(e *batchmap.Entry) string { return fmt.Sprintf("%x", e.HashValue) }, entries)
+				passert.Equals(s, roots, test.wantRoot)
+			}
+			if len(test.wantVersions) > 0 {
+				versions := beam.ParDo(s, func(l *ModuleVersionLog) []string { return l.Versions }, logs)
+				passert.Equals(s, versions, test.wantVersions)
+			}
+			err := ptest.Run(p)
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestVersionLogsBadRecords(t *testing.T) {
+	metadata := []Metadata{
+		{Module: "foo", Version: "1", ID: 1},
+		{Module: "bar", Version: "1", ID: 2},
+		{Module: "bar", Version: "2", ID: 2},
+		{Module: "baz", Version: "", ID: 3},
+	}
+	for _, test := range []struct {
+		name        string
+		policy      BadRecordPolicy
+		wantEntries int
+		wantErr     bool
+	}{
+		{name: "allow", policy: AllowBadRecords, wantEntries: 3},
+		{name: "skip", policy: SkipBadRecords, wantEntries: 1},
+		{name: "fail", policy: FailOnBadRecords, wantErr: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			p, s := beam.NewPipelineWithRoot()
+			entries, logs := MakeVersionLogs(s, treeID, "", test.policy, beam.CreateList(s, metadata))
+			if !test.wantErr {
+				passert.Count(s, entries, "entries", test.wantEntries)
+				// Skipped modules have empty logs.
+				passert.Count(s, logs, "logs", 3)
+			}
+			if err := ptest.Run(p); (err != nil) != test.wantErr {
+				t.Errorf("pipeline returned %v, wantErr %t", err, test.wantErr)
+			}
+		})
+	}
+
+	t.Run("update keeps base log", func(t *testing.T) {
+		p, s := beam.NewPipelineWithRoot()
+		base := beam.CreateList(s, []*ModuleVersionLog{{Module: "foo", Versions: []string{"1"}}})
+		delta := beam.CreateList(s, []Metadata{{Module: "foo", Version: "", ID: 2}})
+		entries, logs := UpdateVersionLogs(s, treeID, "", SkipBadRecords, base, delta)
+		passert.Empty(s, entries)
+		versions := beam.ParDo(s, func(l *ModuleVersionLog) []string { return l.Versions }, logs)
+		passert.Equals(s, versions, []string{"1"})
+		if err := ptest.Run(p); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	logToString := func(l *ModuleVersionLog) string { return fmt.Sprintf("%s:%s", l.Module, strings.Join(l.Versions, ",")) }
+	for _, test := range []struct {
+		name     string
+		base     []*ModuleVersionLog
+		delta    []Metadata
+		wantLogs []string
+	}{
+		{
+			name:     "skipped module stays skipped",
+			base:     []*ModuleVersionLog{{Module: "foo"}},
+			delta:    []Metadata{{Module: "foo", Version: "2", ID: 2}},
+			wantLogs: []string{"foo:"},
+		},
+		{
+			name:     "new module with bad records is skipped",
+			delta:    []Metadata{{Module: "foo", Version: "", ID: 2}},
+			wantLogs: []string{"foo:"},
+		},
+		{
+			name:     "multiple base logs keeps longest",
+			base:     []*ModuleVersionLog{{Module: "foo", Versions: []string{"1"}}, {Module: "foo", Versions: []string{"1", "2"}}},
+			delta:    []Metadata{{Module: "foo", Version: "3", ID: 3}},
+			wantLogs: []string{"foo:1,2"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			p, s := beam.NewPipelineWithRoot()
+			base := beam.CreateList(s, append([]*ModuleVersionLog{{Module: "bar", Versions: []string{"1"}}}, test.base...))
+			entries, logs := UpdateVersionLogs(s, treeID, "", SkipBadRecords, base, beam.CreateList(s, test.delta))
+			passert.Empty(s, entries)
+			passert.Equals(s, beam.ParDo(s, logToString, logs), beam.CreateList(s, append([]string{"bar:1"}, test.wantLogs...)))
+			if err := ptest.Run(p); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+
+	// A module skipped by a best-effort build can't be added back by an update.
+	for _, test := range []struct {
+		name   string
+		policy BadRecordPolicy
+	}{
+		{name: "update of skipped module fails with allow", policy: AllowBadRecords},
+		{name: "update of skipped module fails with fail", policy: FailOnBadRecords},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			p, s := beam.NewPipelineWithRoot()
+			base := beam.CreateList(s, []*ModuleVersionLog{{Module: "bar", Versions: []string{"1"}}, {Module: "foo"}})
+			delta := beam.CreateList(s, []Metadata{{Module: "bar", Version: "2", ID: 2}})
+			UpdateVersionLogs(s, treeID, "", test.policy, base, delta)
+			if err := ptest.Run(p); err == nil {
+				t.Error("pipeline succeeded, want error")
+			}
+		})
+	}
+}
@@ -40,6 +40,26 @@ type InputLogMetadata struct {
 	Entries    int64
 }
 
+// ErrMirrorShrunk is returned by MapBuilder if the input log has fewer entries
+// than a map being updated already commits to. SumDB only grows, so this means
+// that the mirror has been corrupted or rolled back.
+var ErrMirrorShrunk = errors.New("mirror appears to have shrunk")
+
+// StratumBits is the height of each stratum of tiles in the map, in bits.
+// batchmap only supports 8-bit strata, so that every tile is rooted at a byte
+// boundary of the key and has up to 256 children.
+const StratumBits = 8
+
+// ValidateStratumBits returns an error if a map can't be built with strata
+// of the given height. Only StratumBits is supported, so this exists to reject
+// other heights clearly rather than silently building 8-bit strata.
+func ValidateStratumBits(bits int) error {
+	if bits != StratumBits {
+		return fmt.Errorf("strata of %d bits are not supported, batchmap only supports %d-bit strata", bits, StratumBits)
+	}
+	return nil
+}
+
 // MapBuilder contains the static configuration for a map, and allows
 // maps at different log sizes to be built using its methods.
 type MapBuilder struct {
@@ -47,6 +67,59 @@ type MapBuilder struct {
 	treeID       int64
 	prefixStrata int
 	versionLogs  bool
+
+	// SkipUnchangedTiles makes Update pass through tiles that cannot be
+	// changed by the delta without rehashing them. This produces the same
+	// map, but is faster when the delta is small compared to the map.
+	// See PartitionTilesByDelta.
+	SkipUnchangedTiles bool
+
+	// UpdateParallelism is the number of shards that Update spreads the
+	// delta entries and the tiles being updated over before passing them to
+	// batchmap.Update, so that the work leading up to the update isn't fused
+	// onto a few workers when the delta is skewed. It has no effect on the
+	// grouping within batchmap.Update. If it is zero then they are passed on
+	// as they are. See Rebalance.
+	UpdateParallelism int
+
+	// BadRecords determines how records with malformed hashes are handled.
+	// By default records are not validated.
+	BadRecords BadRecordPolicy
+
+	// BadVersionLogs determines how records that can't be added to the version
+	// logs are handled; see MakeVersionLogs. By default they are not checked.
+	// This has no effect unless the map is built with version logs.
+	BadVersionLogs BadRecordPolicy
+
+	// ModuleFilter is a regular expression that modules must match to be
+	// included in the map. If empty then all modules are included.
+	ModuleFilter string
+
+	// CountVersionLogs makes Create build the version logs only to count
+	// them with CountVersionLogs, without adding them to the map. This has
+	// no effect if the map is built with version logs.
+	CountVersionLogs bool
+
+	// KeyDomain is mixed into the derivation of every key in the map, so
+	// that several maps can share a tree. See MapKey.
+	KeyDomain string
+
+	// LatestVersions makes Create add an entry for each module committing
+	// to its latest version, as made by MakeLatestVersions. Maps with these
+	// entries can't be updated with Update.
+	LatestVersions bool
+
+	// TilePaths makes Create build only the tiles at these paths, from only
+	// the entries beneath them, so that damaged tiles of a map can be rebuilt
+	// without building the whole map. If it is empty then every tile is
+	// built. See EntriesUnderPaths.
+	TilePaths [][]byte
+
+	// KVSink is called by Create and Update, if it is set, with the
+	// PCollection<KVEntry> of the module version entries that they add to
+	// the map, so that a KV index can be written in the same pipeline as
+	// the tiles. See CreateKVEntries.
+	KVSink func(s beam.Scope, kv beam.PCollection)
 }
 
 // NewMapBuilder returns a MapBuilder for a map with the given configuration.
@@ -71,17 +144,34 @@ func (b *MapBuilder) Create(s beam.Scope, size int64) (beam.PCollection, beam.PC
 		return tiles, logs, InputLogMetadata{}, err
 	}
 
-	records := b.source.Entries(s.Scope("source"), 0, endID)
-	entries := CreateEntries(s, b.treeID, records)
+	records := b.records(s, 0, endID)
+	entries := CreateEntries(s, b.treeID, b.KeyDomain, records)
+	if b.KVSink != nil {
+		b.KVSink(s, CreateKVEntries(s, b.KeyDomain, records))
+	}
 
 	if b.versionLogs {
 		var logEntries beam.PCollection
-		logEntries, logs = MakeVersionLogs(s, b.treeID, records)
+		logEntries, logs = MakeVersionLogs(s, b.treeID, b.KeyDomain, b.BadVersionLogs, records)
 		entries = beam.Flatten(s, entries, logEntries)
+	} else if b.CountVersionLogs {
+		CountVersionLogs(s, b.treeID, records)
+	}
+	if b.LatestVersions {
+		entries = beam.Flatten(s, entries, MakeLatestVersions(s, b.treeID, b.KeyDomain, records))
+	}
+	if len(b.TilePaths) > 0 {
+		entries = EntriesUnderPaths(s, entries, b.TilePaths)
 	}
+	entries = countElements(s, entriesCounter, entries)
 
 	glog.Infof("Creating new map revision from range [0, %d)", endID)
-	tiles, err = batchmap.Create(s, entries, b.treeID, hash, b.prefixStrata)
+	if tiles, err = batchmap.Create(s, entries, b.treeID, Hash, b.prefixStrata); err == nil {
+		if len(b.TilePaths) > 0 {
+			tiles = TilesAtPaths(s, tiles, b.TilePaths)
+		}
+		tiles = countElements(s, tilesCounter, tiles)
+	}
 
 	return tiles, logs, InputLogMetadata{
 		Checkpoint: golden,
@@ -92,36 +182,89 @@ func (b *MapBuilder) Create(s beam.Scope, size int64) (beam.PCollection, beam.PC
 // Update builds a map using the last version built, and updating it to
 // include all the first `size` entries from the input log. If there aren't
 // enough entries then it will fail.
-// It returns a PCollection of *Tile as the first output.
-func (b *MapBuilder) Update(s beam.Scope, lastTiles beam.PCollection, provenance InputLogMetadata, size int64) (beam.PCollection, InputLogMetadata, error) {
-	var tiles beam.PCollection
-
-	if b.versionLogs {
-		return tiles, InputLogMetadata{}, errors.New("unsupported: incremental build incompatible with version logs")
-	}
+// If the map is built with version logs then lastLogs must contain the
+// ModuleVersionLogs from the last version built, otherwise it is ignored.
+// It returns a PCollection of *Tile as the first output, and any logs built
+// will be output in the second PCollection (of type ModuleVersionLog).
+func (b *MapBuilder) Update(s beam.Scope, lastTiles, lastLogs beam.PCollection, provenance InputLogMetadata, size int64) (beam.PCollection, beam.PCollection, InputLogMetadata, error) {
+	var tiles, logs beam.PCollection
 
 	endID, golden, err := b.getLogEnd(size)
 	if err != nil {
-		return tiles, InputLogMetadata{}, err
+		return tiles, logs, InputLogMetadata{}, err
+	}
+
+	if b.LatestVersions {
+		return tiles, logs, InputLogMetadata{}, errors.New("a map with latest versions can only be built from scratch")
 	}
 
 	startID := provenance.Entries
+	if err := b.CheckLogSize(startID); err != nil {
+		return tiles, logs, InputLogMetadata{}, err
+	}
 	if startID >= endID {
-		return tiles, InputLogMetadata{}, fmt.Errorf("startID (%d) >= endID (%d)", startID, endID)
+		return tiles, logs, InputLogMetadata{}, fmt.Errorf("startID (%d) >= endID (%d)", startID, endID)
 	}
 
-	records := b.source.Entries(s.Scope("source"), startID, endID)
-	entries := CreateEntries(s, b.treeID, records)
+	records := b.records(s, startID, endID)
+	entries := CreateEntries(s, b.treeID, b.KeyDomain, records)
+	if b.KVSink != nil {
+		b.KVSink(s, CreateKVEntries(s, b.KeyDomain, records))
+	}
+
+	if b.versionLogs {
+		if !lastLogs.IsValid() {
+			return tiles, logs, InputLogMetadata{}, errors.New("lastLogs must be provided to update a map with version logs")
+		}
+		var logEntries beam.PCollection
+		logEntries, logs = UpdateVersionLogs(s, b.treeID, b.KeyDomain, b.BadVersionLogs, lastLogs, records)
+		entries = beam.Flatten(s, entries, logEntries)
+	}
+	entries = countElements(s, entriesCounter, entries)
 
 	glog.Infof("Updating with range [%d, %d)", startID, endID)
-	tiles, err = batchmap.Update(s, lastTiles, entries, b.treeID, hash, b.prefixStrata)
+	entries = Rebalance(s, b.UpdateParallelism, entries)
+	if b.SkipUnchangedTiles {
+		affected, unaffected := PartitionTilesByDelta(s, lastTiles, entries, b.prefixStrata)
+		if tiles, err = batchmap.Update(s, Rebalance(s, b.UpdateParallelism, affected), entries, b.treeID, Hash, b.prefixStrata); err == nil {
+			tiles = beam.Flatten(s, tiles, unaffected)
+		}
+	} else {
+		tiles, err = batchmap.Update(s, Rebalance(s, b.UpdateParallelism, lastTiles), entries, b.treeID, Hash, b.prefixStrata)
+	}
+	if err == nil {
+		tiles = countElements(s, tilesCounter, tiles)
+	}
 
-	return tiles, InputLogMetadata{
+	return tiles, logs, InputLogMetadata{
 		Checkpoint: golden,
 		Entries:    endID,
 	}, err
 }
 
+// CheckLogSize returns an error wrapping ErrMirrorShrunk if the input log has
+// fewer than the given number of entries, which should be the number that the
+// map being updated commits to. This is checked by Update, and is exported so
+// that callers can check before building the rest of their pipeline.
+func (b *MapBuilder) CheckLogSize(entries int64) error {
+	_, totalLeaves, err := b.source.Head()
+	if err != nil {
+		return fmt.Errorf("failed to get Head of input log: %v", err)
+	}
+	if totalLeaves < entries {
+		return fmt.Errorf("%w: it has %d entries but the map already commits to %d", ErrMirrorShrunk, totalLeaves, entries)
+	}
+	return nil
+}
+
+// records returns the PCollection<Metadata> of the entries in range [start, end)
+// in the input log that should be committed to by the map.
+func (b *MapBuilder) records(s beam.Scope, start, end int64) beam.PCollection {
+	records := countElements(s, recordsCounter, b.source.Entries(s.Scope("source"), start, end))
+	records = FilterRecords(s, records, b.ModuleFilter)
+	return ValidateRecords(s, records, b.BadRecords)
+}
+
 func (b *MapBuilder) getLogEnd(requiredEntries int64) (int64, []byte, error) {
 	golden, totalLeaves, err := b.source.Head()
 	if err != nil {
@@ -15,6 +15,7 @@
 package pipeline
 
 import (
+	"errors"
 	"fmt"
 	"reflect"
 	"testing"
@@ -40,6 +41,13 @@ func TestCreateAndUpdateEquivalence(t *testing.T) {
 
 			wantRoot: "5d424e362148da02610565795788f3856c6d225bbfcf9963baa26abc569b6c71",
 		},
+		{
+			name:   "With logs",
+			treeID: 12345,
+			logs:   true,
+
+			wantRoot: "d15c145af270b1ee3b9f1ae1652f1de9a82ca34b8ff013df62fb10c8d91f4507",
+		},
 	}
 
 	inputLog := fakeLog{
@@ -70,11 +78,11 @@ func TestCreateAndUpdateEquivalence(t *testing.T) {
 				t.Errorf("failed to Create(): %v", err)
 			}
 
-			updateTiles, _, updateMetadata, err := mb.Create(s, 1)
+			updateTiles, updateLogs, updateMetadata, err := mb.Create(s, 1)
 			if err != nil {
 				t.Errorf("failed to Create(): %v", err)
 			}
-			updateTiles, updateMetadata, err = mb.Update(s, updateTiles, updateMetadata, 2)
+			updateTiles, _, updateMetadata, err = mb.Update(s, updateTiles, updateLogs, updateMetadata, 2)
 			if err != nil {
 				t.Errorf("failed to Update(): %v", err)
 			}
@@ -95,6 +103,135 @@ func TestCreateAndUpdateEquivalence(t *testing.T) {
 	}
 }
 
+func TestCreateCountVersionLogs(t *testing.T) {
+	inputLog := fakeLog{
+		entries: []Metadata{
+			{Module: "foo", Version: "v1.0.0", RepoHash: "abcdefab", ModHash: "deadbeef"},
+			{Module: "bar", Version: "v0.0.1", RepoHash: "abcdefab", ModHash: "deadbeef"},
+		},
+		head: []byte("this is just passed around"),
+	}
+	mb := NewMapBuilder(inputLog, 12345, 0, false)
+	mb.CountVersionLogs = true
+	p, s := beam.NewPipelineWithRoot()
+	tiles, logs, _, err := mb.Create(s, 2)
+	if err != nil {
+		t.Fatalf("failed to Create(): %v", err)
+	}
+	if logs.IsValid() {
+		t.Error("Create() output version logs when only counting them")
+	}
+	// Counting the logs must not add them to the map, so the root is the
+	// same as for the map built without logs.
+	rootToString := func(t *batchmap.Tile) string { return fmt.Sprintf("%x", t.RootHash) }
+	passert.Equals(s, beam.ParDo(s, rootToString, tiles), "5d424e362148da02610565795788f3856c6d225bbfcf9963baa26abc569b6c71")
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestUpdateLatestVersions(t *testing.T) {
+	inputLog := fakeLog{
+		entries: []Metadata{
+			{Module: "foo", Version: "v1.0.0", RepoHash: "abcdefab", ModHash: "deadbeef"},
+			{Module: "foo", Version: "v0.9.0", RepoHash: "abcdefab", ModHash: "deadbeef"},
+		},
+		head: []byte("this is just passed around"),
+	}
+	mb := NewMapBuilder(inputLog, 12345, 0, false)
+	mb.LatestVersions = true
+	p, s := beam.NewPipelineWithRoot()
+	tiles, _, metadata, err := mb.Create(s, 1)
+	if err != nil {
+		t.Fatalf("failed to Create(): %v", err)
+	}
+	// The latest version of foo can't be found from the second entry alone.
+	if _, _, _, err := mb.Update(s, tiles, beam.PCollection{}, metadata, 2); err == nil {
+		t.Error("Update() of a map with latest versions: expected error")
+	}
+	passert.Count(s, tiles, "tiles", 1)
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestKVSink(t *testing.T) {
+	inputLog := fakeLog{
+		entries: []Metadata{
+			{Module: "foo", Version: "v1.0.0", RepoHash: "h1:foo", ModHash: "h1:foomod"},
+			{Module: "bar", Version: "v0.0.1", RepoHash: "h1:bar", ModHash: "h1:barmod"},
+		},
+		head: []byte("this is just passed around"),
+	}
+	mb := NewMapBuilder(inputLog, 12345, 0, false)
+	// Create and Update must each pass the values of only the entries that
+	// they add to the map.
+	wantValues := [][]interface{}{{"h1:foo", "h1:foomod"}, {"h1:bar", "h1:barmod"}}
+	var calls int
+	mb.KVSink = func(s beam.Scope, kv beam.PCollection) {
+		values := beam.ParDo(s, func(e KVEntry) string { return e.Value }, kv)
+		passert.Equals(s, values, wantValues[calls]...)
+		calls++
+	}
+	p, s := beam.NewPipelineWithRoot()
+	tiles, logs, metadata, err := mb.Create(s, 1)
+	if err != nil {
+		t.Fatalf("failed to Create(): %v", err)
+	}
+	if _, _, _, err := mb.Update(s, tiles, logs, metadata, 2); err != nil {
+		t.Fatalf("failed to Update(): %v", err)
+	}
+	if calls != 2 {
+		t.Fatalf("KVSink called %d times, want 2", calls)
+	}
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestUpdateMirrorShrunk(t *testing.T) {
+	inputLog := fakeLog{
+		entries: []Metadata{
+			{Module: "foo", Version: "v1.0.0", RepoHash: "abcdefab", ModHash: "deadbeef"},
+			{Module: "bar", Version: "v0.0.1", RepoHash: "abcdefab", ModHash: "deadbeef"},
+		},
+		head: []byte("this is just passed around"),
+	}
+	mb := NewMapBuilder(inputLog, 12345, 0, false)
+	for _, test := range []struct {
+		desc       string
+		entries    int64
+		size       int64
+		wantShrunk bool
+	}{
+		{desc: "unchanged", entries: 2, size: -1},
+		{desc: "size too small", entries: 2, size: 1},
+		{desc: "shrunk", entries: 3, size: -1, wantShrunk: true},
+		{desc: "shrunk to size", entries: 3, size: 2, wantShrunk: true},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			_, s := beam.NewPipelineWithRoot()
+			tiles, _, _, err := mb.Create(s, 1)
+			if err != nil {
+				t.Fatalf("failed to Create(): %v", err)
+			}
+			_, _, _, err = mb.Update(s, tiles, beam.PCollection{}, InputLogMetadata{Entries: test.entries}, test.size)
+			if err == nil {
+				t.Fatal("Update(): expected error")
+			}
+			if got := errors.Is(err, ErrMirrorShrunk); got != test.wantShrunk {
+				t.Errorf("Update() err = %v, want ErrMirrorShrunk %t", err, test.wantShrunk)
+			}
+			if got := errors.Is(mb.CheckLogSize(test.entries), ErrMirrorShrunk); got != test.wantShrunk {
+				t.Errorf("CheckLogSize(%d) returned ErrMirrorShrunk %t, want %t", test.entries, got, test.wantShrunk)
+			}
+		})
+	}
+	if err := mb.CheckLogSize(1); err != nil {
+		t.Errorf("CheckLogSize(1): %v", err)
+	}
+}
+
 type fakeLog struct {
 	entries []Metadata
 	head    []byte
@@ -105,5 +242,16 @@ func (l fakeLog) Head() ([]byte, int64, error) {
 }
 
 func (l fakeLog) Entries(s beam.Scope, start, end int64) beam.PCollection {
-	return beam.CreateList(s, l.entries)
+	return beam.CreateList(s, l.entries[start:end])
+}
+
+func TestValidateStratumBits(t *testing.T) {
+	if err := ValidateStratumBits(8); err != nil {
+		t.Errorf("ValidateStratumBits(8): %v", err)
+	}
+	for _, bits := range []int{0, 4, 16} {
+		if err := ValidateStratumBits(bits); err == nil {
+			t.Errorf("ValidateStratumBits(%d): expected error", bits)
+		}
+	}
 }
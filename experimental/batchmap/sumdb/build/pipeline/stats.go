@@ -0,0 +1,117 @@
+// Copyright 2021 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/apache/beam/sdks/go/pkg/beam"
+)
+
+const (
+	recordsCounter        = "records"
+	entriesCounter        = "entries"
+	tilesCounter          = "tiles"
+	tilesUnchangedCounter = "tiles-unchanged"
+
+	versionLogsCounter        = "version-logs"
+	versionLogEntriesCounter  = "version-log-entries"
+	versionLogsSkippedCounter = "version-logs-skipped"
+
+	// batchmapNamespace is the namespace of the counters reported by
+	// batchmap.Create and batchmap.Update.
+	batchmapNamespace = "batchmap"
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*countElementsFn)(nil)).Elem())
+}
+
+// BuildStats summarizes the work done by the pipeline that built a revision
+// of the map, as reported by the pipeline metrics.
+type BuildStats struct {
+	// Records is the number of records read from the input log, before any
+	// were filtered or skipped.
+	Records int64
+	// Entries is the number of map entries written, including those for
+	// version logs. Each SumDB record produces two entries.
+	Entries int64
+	// Tiles is the number of tiles output for the new revision.
+	Tiles int64
+	// CreatedTiles, UpdatedTiles and CopiedTiles are the number of tiles
+	// that batchmap.Update created from scratch, rehashed with new leaves,
+	// and copied from the previous revision because none of their leaves
+	// changed. For a map built from scratch, CreatedTiles is the number of
+	// tiles hashed.
+	CreatedTiles, UpdatedTiles, CopiedTiles int64
+	// UnchangedTiles is the number of tiles that were passed through from
+	// the previous revision without being rehashed. This is only non-zero
+	// if MapBuilder.SkipUnchangedTiles was set.
+	UnchangedTiles int64
+	// FilteredRecords and SkippedRecords are as for the functions of the
+	// same names.
+	FilteredRecords int64
+	SkippedRecords  int64
+	// SkippedVersionLogs is as for the function of the same name.
+	SkippedVersionLogs int64
+	// TileSizes summarizes the sizes of the tiles in each stratum, if they
+	// were measured by MeasureTileSizes.
+	TileSizes []StratumTileSizes
+}
+
+// Stats returns the BuildStats for the pipeline run that produced the result.
+// It returns false if the runner doesn't report metrics.
+func Stats(result beam.PipelineResult) (BuildStats, bool) {
+	if result == nil {
+		return BuildStats{}, false
+	}
+	var stats BuildStats
+	stats.Records, _ = counterValue(result, counterNamespace, recordsCounter)
+	stats.Entries, _ = counterValue(result, counterNamespace, entriesCounter)
+	stats.Tiles, _ = counterValue(result, counterNamespace, tilesCounter)
+	stats.UnchangedTiles, _ = counterValue(result, counterNamespace, tilesUnchangedCounter)
+	stats.FilteredRecords, _ = counterValue(result, counterNamespace, recordsFilteredCounter)
+	stats.SkippedRecords, _ = counterValue(result, counterNamespace, recordsSkippedCounter)
+	stats.SkippedVersionLogs, _ = counterValue(result, counterNamespace, versionLogsSkippedCounter)
+	hashed, _ := counterValue(result, batchmapNamespace, "tiles-hashed")
+	created, _ := counterValue(result, batchmapNamespace, "tiles-created")
+	stats.CreatedTiles = hashed + created
+	stats.UpdatedTiles, _ = counterValue(result, batchmapNamespace, "tiles-updated")
+	stats.CopiedTiles, _ = counterValue(result, batchmapNamespace, "tiles-copied")
+	stats.TileSizes = tileSizes(result.Metrics().AllMetrics().Distributions())
+	return stats, true
+}
+
+// countElements returns the elements of col unchanged, counting them with
+// the named counter.
+func countElements(s beam.Scope, name string, col beam.PCollection) beam.PCollection {
+	return beam.ParDo(s.Scope("count-"+name), &countElementsFn{Name: name}, col)
+}
+
+type countElementsFn struct {
+	Name string
+
+	counter beam.Counter
+}
+
+func (fn *countElementsFn) Setup() {
+	fn.counter = beam.NewCounter(counterNamespace, fn.Name)
+}
+
+func (fn *countElementsFn) ProcessElement(ctx context.Context, x beam.T, emit func(beam.T)) {
+	fn.counter.Inc(ctx, 1)
+	emit(x)
+}
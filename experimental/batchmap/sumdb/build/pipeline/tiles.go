@@ -0,0 +1,398 @@
+// Copyright 2021 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/metrics"
+	"github.com/apache/beam/sdks/go/pkg/beam/transforms/filter"
+	"github.com/golang/glog"
+	"github.com/google/trillian/experimental/batchmap"
+
+	"github.com/google/trillian-examples/experimental/batchmap/sumdb/mapdb"
+)
+
+const (
+	tilesOversizedCounter = "tiles-oversized"
+	// tileBytesPrefix is followed by the stratum in the names of the
+	// distributions recorded by MeasureTileSizes.
+	tileBytesPrefix = "tile-bytes-stratum-"
+	// shardElementsDist records the number of elements in each shard made
+	// by Rebalance, which shows how evenly the work was spread.
+	shardElementsDist = "rebalance-shard-elements"
+)
+
+var (
+	cntTilesAffected  = beam.NewCounter(counterNamespace, "tiles-affected")
+	cntTilesUnchanged = beam.NewCounter(counterNamespace, tilesUnchangedCounter)
+	cntTilesOversized = beam.NewCounter(counterNamespace, tilesOversizedCounter)
+	distShardElements = beam.NewDistribution(counterNamespace, shardElementsDist)
+)
+
+func init() {
+	beam.RegisterFunction(tilePathFn)
+	beam.RegisterType(reflect.TypeOf((*affectedTilePathsFn)(nil)).Elem())
+	beam.RegisterFunction(affectedPathFn)
+	beam.RegisterFunction(partitionTilesFn)
+	beam.RegisterType(reflect.TypeOf((*checkTileSizeFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*measureTileSizeFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*assignShardFn)(nil)).Elem())
+	beam.RegisterFunction(unshardFn)
+	beam.RegisterType(reflect.TypeOf((*entriesUnderPathsFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*tilesAtPathsFn)(nil)).Elem())
+}
+
+// OversizedTilePolicy determines what happens to tiles that are larger than
+// the limit passed to CheckTileSizes.
+type OversizedTilePolicy int
+
+const (
+	// FailOnOversizedTiles fails the pipeline if any tile is too large.
+	FailOnOversizedTiles OversizedTilePolicy = iota
+	// SkipOversizedTiles drops tiles that are too large so that they are not
+	// written. The map will be missing these tiles, so proofs through them
+	// can't be constructed. The number of tiles dropped is counted by the
+	// pipeline/tiles-oversized counter.
+	SkipOversizedTiles
+)
+
+// CheckTileSizes guards against writing pathologically large tiles, which
+// happen when the number of prefix strata is too small for the number of
+// entries. The size of each *batchmap.Tile in the PCollection is measured as
+// encoded by mapdb.EncodeTile, and tiles of more than maxBytes are handled
+// according to the policy. If maxBytes is zero then tiles are not checked.
+func CheckTileSizes(s beam.Scope, tiles beam.PCollection, maxBytes int, compress bool, policy OversizedTilePolicy) beam.PCollection {
+	if maxBytes <= 0 {
+		return tiles
+	}
+	return beam.ParDo(s.Scope("CheckTileSizes"), &checkTileSizeFn{MaxBytes: maxBytes, Compress: compress, Fail: policy == FailOnOversizedTiles}, tiles)
+}
+
+// OversizedTiles returns the number of tiles that were dropped by
+// CheckTileSizes in the pipeline run that produced the result. It returns
+// false if the runner doesn't report metrics.
+func OversizedTiles(result beam.PipelineResult) (int64, bool) {
+	return counterValue(result, counterNamespace, tilesOversizedCounter)
+}
+
+type checkTileSizeFn struct {
+	MaxBytes int
+	Compress bool
+	Fail     bool
+}
+
+func (fn *checkTileSizeFn) ProcessElement(ctx context.Context, t *batchmap.Tile, emit func(*batchmap.Tile)) error {
+	bs, err := mapdb.EncodeTile(t, fn.Compress)
+	if err != nil {
+		return fmt.Errorf("failed to encode tile %x: %v", t.Path, err)
+	}
+	if len(bs) <= fn.MaxBytes {
+		emit(t)
+		return nil
+	}
+	if fn.Fail {
+		return fmt.Errorf("tile %x with %d leaves is %d bytes, which is more than the limit of %d; consider using more prefix strata", t.Path, len(t.Leaves), len(bs), fn.MaxBytes)
+	}
+	glog.Warningf("Dropping tile %x with %d leaves, which is %d bytes", t.Path, len(t.Leaves), len(bs))
+	cntTilesOversized.Inc(ctx, 1)
+	return nil
+}
+
+// MeasureTileSizes returns the PCollection of *batchmap.Tile unchanged,
+// recording the size of each tile as encoded by mapdb.EncodeTile in a
+// distribution for its stratum. The stratum of a tile is the length of its
+// path, so the root tile is in stratum 0. The sizes are reported in the
+// TileSizes of the BuildStats for the pipeline run.
+func MeasureTileSizes(s beam.Scope, tiles beam.PCollection, compress bool) beam.PCollection {
+	return beam.ParDo(s.Scope("MeasureTileSizes"), &measureTileSizeFn{Compress: compress}, tiles)
+}
+
+// StratumTileSizes summarizes the sizes of the tiles in a stratum of the map.
+type StratumTileSizes struct {
+	Stratum                               int
+	Tiles, MinBytes, MaxBytes, TotalBytes int64
+}
+
+// AvgBytes returns the mean size of the tiles in the stratum.
+func (s StratumTileSizes) AvgBytes() int64 {
+	if s.Tiles == 0 {
+		return 0
+	}
+	return s.TotalBytes / s.Tiles
+}
+
+// tileSizes summarizes the distributions recorded by MeasureTileSizes,
+// ordered by stratum.
+func tileSizes(dists []metrics.DistributionResult) []StratumTileSizes {
+	byStratum := make(map[int]*StratumTileSizes)
+	for _, d := range dists {
+		if d.Key.Namespace != counterNamespace || !strings.HasPrefix(d.Key.Name, tileBytesPrefix) {
+			continue
+		}
+		stratum, err := strconv.Atoi(strings.TrimPrefix(d.Key.Name, tileBytesPrefix))
+		if err != nil {
+			continue
+		}
+		v := d.Result()
+		if v.Count == 0 {
+			continue
+		}
+		// The distribution for a stratum may be reported by several steps.
+		sizes, ok := byStratum[stratum]
+		if !ok {
+			byStratum[stratum] = &StratumTileSizes{Stratum: stratum, Tiles: v.Count, MinBytes: v.Min, MaxBytes: v.Max, TotalBytes: v.Sum}
+			continue
+		}
+		sizes.Tiles += v.Count
+		sizes.TotalBytes += v.Sum
+		if v.Min < sizes.MinBytes {
+			sizes.MinBytes = v.Min
+		}
+		if v.Max > sizes.MaxBytes {
+			sizes.MaxBytes = v.Max
+		}
+	}
+	var sizes []StratumTileSizes
+	for _, s := range byStratum {
+		sizes = append(sizes, *s)
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i].Stratum < sizes[j].Stratum })
+	return sizes
+}
+
+type measureTileSizeFn struct {
+	Compress bool
+
+	dists map[int]beam.Distribution
+}
+
+func (fn *measureTileSizeFn) Setup() {
+	fn.dists = make(map[int]beam.Distribution)
+}
+
+func (fn *measureTileSizeFn) ProcessElement(ctx context.Context, t *batchmap.Tile, emit func(*batchmap.Tile)) error {
+	bs, err := mapdb.EncodeTile(t, fn.Compress)
+	if err != nil {
+		return fmt.Errorf("failed to encode tile %x: %v", t.Path, err)
+	}
+	d, ok := fn.dists[len(t.Path)]
+	if !ok {
+		d = beam.NewDistribution(counterNamespace, tileBytesPrefix+strconv.Itoa(len(t.Path)))
+		fn.dists[len(t.Path)] = d
+	}
+	d.Update(ctx, int64(len(bs)))
+	emit(t)
+	return nil
+}
+
+// PartitionTilesByDelta splits the tiles of a map into those that may be
+// changed by applying the delta entries, and those that cannot be. A tile
+// is affected if the path of any delta entry passes through it.
+//
+// batchmap.Update copies a tile without rehashing if none of its leaves have
+// changed, but the root of every tile in a stratum is passed as a leaf to the
+// stratum above, so all tiles above the last stratum are rehashed regardless.
+// Passing only the affected tiles to batchmap.Update avoids this, and the
+// unaffected tiles can be flattened back in as they are. This is only worth
+// the extra shuffle when the delta is small compared to the map.
+//
+// tiles is a PCollection of *batchmap.Tile and entries is a PCollection of
+// *batchmap.Entry. Both outputs are PCollections of *batchmap.Tile.
+func PartitionTilesByDelta(s beam.Scope, tiles, entries beam.PCollection, prefixStrata int) (affected, unaffected beam.PCollection) {
+	s = s.Scope("PartitionTilesByDelta")
+	keyedTiles := beam.ParDo(s, tilePathFn, tiles)
+	paths := beam.ParDo(s, affectedPathFn, affectedTilePaths(s, entries, prefixStrata))
+	return beam.ParDo2(s, partitionTilesFn, beam.CoGroupByKey(s, keyedTiles, paths))
+}
+
+// affectedTilePaths returns the distinct paths of the tiles that the entries
+// pass through. Every entry passes through the root tile and the tiles near
+// it, so these are deduplicated with a combine, which runners can lift to
+// before the shuffle, rather than grouping the whole delta under a few keys.
+func affectedTilePaths(s beam.Scope, entries beam.PCollection, prefixStrata int) beam.PCollection {
+	return filter.Distinct(s, beam.ParDo(s, &affectedTilePathsFn{PrefixStrata: prefixStrata}, entries))
+}
+
+func tilePathFn(t *batchmap.Tile) ([]byte, *batchmap.Tile) {
+	return t.Path, t
+}
+
+// affectedTilePathsFn outputs the path of each tile that the entry passes
+// through, from the root tile down to the tile containing the leaf.
+type affectedTilePathsFn struct {
+	PrefixStrata int
+}
+
+func (fn *affectedTilePathsFn) ProcessElement(e *batchmap.Entry, emit func([]byte)) error {
+	if len(e.HashKey) < fn.PrefixStrata {
+		return fmt.Errorf("entry key %x is too short for %d prefix strata", e.HashKey, fn.PrefixStrata)
+	}
+	for d := 0; d <= fn.PrefixStrata; d++ {
+		emit(e.HashKey[:d])
+	}
+	return nil
+}
+
+func affectedPathFn(path []byte) ([]byte, bool) {
+	return path, true
+}
+
+func partitionTilesFn(ctx context.Context, path []byte, tiles func(**batchmap.Tile) bool, deltas func(*bool) bool, affected, unaffected func(*batchmap.Tile)) error {
+	var tile *batchmap.Tile
+	if !tiles(&tile) {
+		// There is no existing tile for this path; batchmap.Update will create it.
+		return nil
+	}
+	var extra *batchmap.Tile
+	if tiles(&extra) {
+		return fmt.Errorf("found multiple tiles at path %x", path)
+	}
+	var d bool
+	if deltas(&d) {
+		cntTilesAffected.Inc(ctx, 1)
+		affected(tile)
+	} else {
+		cntTilesUnchanged.Inc(ctx, 1)
+		unaffected(tile)
+	}
+	return nil
+}
+
+// Rebalance redistributes the elements of col evenly over the given number of
+// shards, which is a reshuffle into a fixed number of keys. The elements are
+// dealt out in turn rather than by their content, so the shards are balanced
+// however skewed the keys of the elements are. The output contains the same
+// elements as col, and if shards is not positive then col is returned as is.
+//
+// batchmap.Update groups entries by the tile they fall in, and this is fused
+// with the stages reading and hashing the delta. When the delta is skewed,
+// e.g. many new versions of a few modules, a handful of workers can end up
+// doing most of this work. Rebalancing the entries and tiles before the update
+// breaks the fusion so that the work leading up to the grouping is spread over
+// the shards. This is one reshuffle ahead of batchmap.Update, not a hint to
+// each of its strata: batchmap doesn't expose the grouping it does for each
+// stratum, so skew within that grouping is unaffected. The size of each shard
+// is recorded in the pipeline/rebalance-shard-elements distribution.
+func Rebalance(s beam.Scope, shards int, col beam.PCollection) beam.PCollection {
+	if shards <= 0 {
+		return col
+	}
+	s = s.Scope("Rebalance")
+	return beam.ParDo(s, unshardFn, beam.GroupByKey(s, shardElements(s, shards, col)))
+}
+
+// shardElements returns a PCollection<KV<int, T>> assigning each element of
+// the PCollection<T> to a shard in [0, shards).
+func shardElements(s beam.Scope, shards int, col beam.PCollection) beam.PCollection {
+	return beam.ParDo(s, &assignShardFn{Shards: shards}, col)
+}
+
+// assignShardFn deals elements out to the shards in turn. Each bundle starts
+// at a random shard so that small bundles don't all favour the first shards.
+type assignShardFn struct {
+	Shards int
+
+	next int
+}
+
+func (fn *assignShardFn) StartBundle() {
+	fn.next = rand.Intn(fn.Shards)
+}
+
+func (fn *assignShardFn) ProcessElement(x beam.T) (int, beam.T) {
+	shard := fn.next
+	fn.next = (fn.next + 1) % fn.Shards
+	return shard, x
+}
+
+func unshardFn(ctx context.Context, shard int, elems func(*beam.T) bool, emit func(beam.T)) {
+	var n int64
+	var x beam.T
+	for elems(&x) {
+		n++
+		emit(x)
+	}
+	distShardElements.Update(ctx, n)
+}
+
+// EntriesUnderPaths returns the entries whose keys begin with at least one of
+// the tile paths, which are the entries that the tiles at those paths are
+// built from. Tiles built from only these entries are correct at the given
+// paths and below them, but not above them.
+//
+// entries is a PCollection of *batchmap.Entry, and so is the output.
+func EntriesUnderPaths(s beam.Scope, entries beam.PCollection, paths [][]byte) beam.PCollection {
+	return beam.ParDo(s.Scope("EntriesUnderPaths"), &entriesUnderPathsFn{Paths: paths}, entries)
+}
+
+// TilesAtPaths returns only the tiles at the given paths.
+//
+// tiles is a PCollection of *batchmap.Tile, and so is the output.
+func TilesAtPaths(s beam.Scope, tiles beam.PCollection, paths [][]byte) beam.PCollection {
+	return beam.ParDo(s.Scope("TilesAtPaths"), &tilesAtPathsFn{Paths: paths}, tiles)
+}
+
+type entriesUnderPathsFn struct {
+	Paths [][]byte
+
+	paths  map[string]bool
+	maxLen int
+}
+
+func (fn *entriesUnderPathsFn) Setup() {
+	fn.paths = make(map[string]bool)
+	for _, p := range fn.Paths {
+		fn.paths[string(p)] = true
+		if len(p) > fn.maxLen {
+			fn.maxLen = len(p)
+		}
+	}
+}
+
+func (fn *entriesUnderPathsFn) ProcessElement(e *batchmap.Entry, emit func(*batchmap.Entry)) {
+	for d := 0; d <= fn.maxLen && d <= len(e.HashKey); d++ {
+		if fn.paths[string(e.HashKey[:d])] {
+			emit(e)
+			return
+		}
+	}
+}
+
+type tilesAtPathsFn struct {
+	Paths [][]byte
+
+	paths map[string]bool
+}
+
+func (fn *tilesAtPathsFn) Setup() {
+	fn.paths = make(map[string]bool)
+	for _, p := range fn.Paths {
+		fn.paths[string(p)] = true
+	}
+}
+
+func (fn *tilesAtPathsFn) ProcessElement(t *batchmap.Tile, emit func(*batchmap.Tile)) {
+	if fn.paths[string(t.Path)] {
+		emit(t)
+	}
+}
@@ -0,0 +1,324 @@
+// Copyright 2021 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/core/metrics"
+	"github.com/apache/beam/sdks/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/go/pkg/beam/testing/ptest"
+	"github.com/apache/beam/sdks/go/pkg/beam/transforms/stats"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/trillian/experimental/batchmap"
+)
+
+func TestPartitionTilesByDelta(t *testing.T) {
+	p, s := beam.NewPipelineWithRoot()
+	tiles := beam.CreateList(s, []*batchmap.Tile{
+		{Path: []byte{}},
+		{Path: []byte{0x12}},
+		{Path: []byte{0x34}},
+		{Path: []byte{0x12, 0x56}},
+		{Path: []byte{0x34, 0x56}},
+	})
+	entries := beam.CreateList(s, []*batchmap.Entry{
+		{HashKey: []byte{0x12, 0x56, 0x78}},
+		// This entry will be in a new tile at depth 2.
+		{HashKey: []byte{0x34, 0x78, 0x78}},
+	})
+
+	affected, unaffected := PartitionTilesByDelta(s, tiles, entries, 2)
+
+	pathToString := func(t *batchmap.Tile) string { return fmt.Sprintf("%x", t.Path) }
+	passert.Equals(s, beam.ParDo(s, pathToString, affected), "", "12", "34", "1256")
+	passert.Equals(s, beam.ParDo(s, pathToString, unaffected), "3456")
+
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestAffectedTilePaths(t *testing.T) {
+	p, s := beam.NewPipelineWithRoot()
+	entries := beam.CreateList(s, []*batchmap.Entry{
+		{HashKey: []byte{0x12, 0x56, 0x78}},
+		{HashKey: []byte{0x12, 0x56, 0x79}},
+		{HashKey: []byte{0x12, 0x57, 0x78}},
+		{HashKey: []byte{0x34, 0x78, 0x78}},
+	})
+
+	// Each path is output once, however many entries pass through it.
+	paths := affectedTilePaths(s, entries, 2)
+	passert.Equals(s, beam.ParDo(s, func(p []byte) string { return fmt.Sprintf("%x", p) }, paths), "", "12", "34", "1256", "1257", "3478")
+
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestUpdateSkipUnchangedTiles(t *testing.T) {
+	var entries []Metadata
+	for i := 0; i < 40; i++ {
+		entries = append(entries, Metadata{
+			Module:   fmt.Sprintf("example.com/m%d", i),
+			Version:  "v1.0.0",
+			RepoHash: "abcdefab",
+			ModHash:  "deadbeef",
+		})
+	}
+	inputLog := fakeLog{
+		entries: entries,
+		head:    []byte("this is just passed around"),
+	}
+
+	for _, logs := range []bool{false, true} {
+		logs := logs
+		t.Run(fmt.Sprintf("logs=%t", logs), func(t *testing.T) {
+			mb := NewMapBuilder(inputLog, 12345, 1, logs)
+			p, s := beam.NewPipelineWithRoot()
+
+			createTiles, _, _, err := mb.Create(s, 40)
+			if err != nil {
+				t.Fatalf("failed to Create(): %v", err)
+			}
+
+			baseTiles, baseLogs, baseMetadata, err := mb.Create(s, 38)
+			if err != nil {
+				t.Fatalf("failed to Create(): %v", err)
+			}
+			mb.SkipUnchangedTiles = true
+			updateTiles, _, _, err := mb.Update(s, baseTiles, baseLogs, baseMetadata, 40)
+			if err != nil {
+				t.Fatalf("failed to Update(): %v", err)
+			}
+
+			tileToString := func(t *batchmap.Tile) string { return fmt.Sprintf("%x:%x", t.Path, t.RootHash) }
+			passert.Equals(s, beam.ParDo(s, tileToString, updateTiles), beam.ParDo(s, tileToString, createTiles))
+
+			if err := ptest.Run(p); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	// All of the entries are in the same tile, as for a skewed delta.
+	var entries []*batchmap.Entry
+	var want []string
+	for i := 0; i < 10; i++ {
+		entries = append(entries, &batchmap.Entry{HashKey: []byte{0x12, 0x34, byte(i)}})
+		want = append(want, fmt.Sprintf("1234%02x", i))
+	}
+	p, s := beam.NewPipelineWithRoot()
+	col := beam.CreateList(s, entries)
+
+	// The 10 entries are dealt out to 4 shards, wherever the dealing starts.
+	shards := beam.DropValue(s, shardElements(s, 4, col))
+	passert.Equals(s, beam.DropKey(s, stats.Count(s, shards)), 3, 3, 2, 2)
+
+	keyToString := func(e *batchmap.Entry) string { return fmt.Sprintf("%x", e.HashKey) }
+	passert.Equals(s, beam.ParDo(s, keyToString, Rebalance(s, 4, col)), beam.CreateList(s, want))
+	passert.Equals(s, beam.ParDo(s, keyToString, Rebalance(s, 0, col)), beam.CreateList(s, want))
+
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestUpdateParallelism(t *testing.T) {
+	// The delta is many versions of the same module.
+	var entries []Metadata
+	for i := 0; i < 40; i++ {
+		module := fmt.Sprintf("example.com/m%d", i)
+		if i >= 20 {
+			module = "example.com/hot"
+		}
+		entries = append(entries, Metadata{
+			Module:   module,
+			Version:  fmt.Sprintf("v1.0.%d", i),
+			RepoHash: "abcdefab",
+			ModHash:  "deadbeef",
+		})
+	}
+	inputLog := fakeLog{
+		entries: entries,
+		head:    []byte("this is just passed around"),
+	}
+
+	for _, skip := range []bool{false, true} {
+		skip := skip
+		t.Run(fmt.Sprintf("skip=%t", skip), func(t *testing.T) {
+			mb := NewMapBuilder(inputLog, 12345, 1, true)
+			p, s := beam.NewPipelineWithRoot()
+
+			createTiles, _, _, err := mb.Create(s, 40)
+			if err != nil {
+				t.Fatalf("failed to Create(): %v", err)
+			}
+
+			baseTiles, baseLogs, baseMetadata, err := mb.Create(s, 20)
+			if err != nil {
+				t.Fatalf("failed to Create(): %v", err)
+			}
+			mb.SkipUnchangedTiles = skip
+			mb.UpdateParallelism = 3
+			updateTiles, _, _, err := mb.Update(s, baseTiles, baseLogs, baseMetadata, 40)
+			if err != nil {
+				t.Fatalf("failed to Update(): %v", err)
+			}
+
+			tileToString := func(t *batchmap.Tile) string { return fmt.Sprintf("%x:%x", t.Path, t.RootHash) }
+			passert.Equals(s, beam.ParDo(s, tileToString, updateTiles), beam.ParDo(s, tileToString, createTiles))
+
+			if err := ptest.Run(p); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestCreateTilePaths(t *testing.T) {
+	var entries []Metadata
+	for i := 0; i < 40; i++ {
+		entries = append(entries, Metadata{
+			Module:   fmt.Sprintf("example.com/m%d", i),
+			Version:  "v1.0.0",
+			RepoHash: "abcdefab",
+			ModHash:  "deadbeef",
+		})
+	}
+	inputLog := fakeLog{
+		entries: entries,
+		head:    []byte("this is just passed around"),
+	}
+	// The tiles containing two of the entries in the last stratum.
+	paths := [][]byte{
+		MapKey("", "example.com/m0", "v1.0.0")[:1],
+		MapKey("", "example.com/m1", "v1.0.0")[:1],
+	}
+
+	mb := NewMapBuilder(inputLog, 12345, 1, false)
+	p, s := beam.NewPipelineWithRoot()
+	createTiles, _, _, err := mb.Create(s, 40)
+	if err != nil {
+		t.Fatalf("failed to Create(): %v", err)
+	}
+	mb.TilePaths = paths
+	partialTiles, _, _, err := mb.Create(s, 40)
+	if err != nil {
+		t.Fatalf("failed to Create(): %v", err)
+	}
+
+	tileToString := func(t *batchmap.Tile) string { return fmt.Sprintf("%x:%x", t.Path, t.RootHash) }
+	passert.Equals(s, beam.ParDo(s, tileToString, partialTiles), beam.ParDo(s, tileToString, TilesAtPaths(s, createTiles, paths)))
+	passert.Count(s, partialTiles, "partialTiles", len(paths))
+
+	if err := ptest.Run(p); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCheckTileSizes(t *testing.T) {
+	leaves := func(n int) []*batchmap.TileLeaf {
+		var ls []*batchmap.TileLeaf
+		for i := 0; i < n; i++ {
+			ls = append(ls, &batchmap.TileLeaf{Path: []byte{byte(i)}, Hash: make([]byte, 32)})
+		}
+		return ls
+	}
+	tiles := []*batchmap.Tile{
+		{Path: []byte{}, RootHash: make([]byte, 32), Leaves: leaves(2)},
+		{Path: []byte{0x01}, RootHash: make([]byte, 32), Leaves: leaves(200)},
+	}
+
+	for _, test := range []struct {
+		name     string
+		maxBytes int
+		policy   OversizedTilePolicy
+		want     []string
+		wantErr  bool
+	}{
+		{
+			name:   "disabled",
+			policy: FailOnOversizedTiles,
+			want:   []string{"", "01"},
+		},
+		{
+			name:     "skip",
+			maxBytes: 1000,
+			policy:   SkipOversizedTiles,
+			want:     []string{""},
+		},
+		{
+			name:     "fail",
+			maxBytes: 1000,
+			policy:   FailOnOversizedTiles,
+			wantErr:  true,
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			p, s := beam.NewPipelineWithRoot()
+			checked := CheckTileSizes(s, beam.CreateList(s, tiles), test.maxBytes, false, test.policy)
+			if !test.wantErr {
+				passert.Equals(s, beam.ParDo(s, func(t *batchmap.Tile) string { return fmt.Sprintf("%x", t.Path) }, checked), beam.CreateList(s, test.want))
+			}
+			if err := ptest.Run(p); (err != nil) != test.wantErr {
+				t.Errorf("pipeline error = %v, wantErr %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestMeasureTileSizes(t *testing.T) {
+	tiles := []*batchmap.Tile{
+		{Path: []byte{}, RootHash: make([]byte, 32)},
+		{Path: []byte{0x01}, RootHash: make([]byte, 32)},
+		{Path: []byte{0x02}, RootHash: make([]byte, 32)},
+	}
+	p, s := beam.NewPipelineWithRoot()
+	measured := MeasureTileSizes(s, beam.CreateList(s, tiles), false)
+	passert.Equals(s, beam.ParDo(s, func(t *batchmap.Tile) string { return fmt.Sprintf("%x", t.Path) }, measured), "", "01", "02")
+	if err := ptest.Run(p); err != nil {
+		t.Fatalf("pipeline failed: %v", err)
+	}
+}
+
+func TestTileSizes(t *testing.T) {
+	dist := func(step, name string, v metrics.DistributionValue) metrics.DistributionResult {
+		return metrics.DistributionResult{Attempted: v, Key: metrics.StepKey{Step: step, Name: name, Namespace: counterNamespace}}
+	}
+	got := tileSizes([]metrics.DistributionResult{
+		dist("a", "tile-bytes-stratum-1", metrics.DistributionValue{Count: 2, Sum: 300, Min: 100, Max: 200}),
+		dist("b", "tile-bytes-stratum-1", metrics.DistributionValue{Count: 2, Sum: 500, Min: 50, Max: 450}),
+		dist("a", "tile-bytes-stratum-0", metrics.DistributionValue{Count: 1, Sum: 80, Min: 80, Max: 80}),
+		dist("a", "tile-bytes-stratum-2", metrics.DistributionValue{}),
+		dist("a", "other", metrics.DistributionValue{Count: 1, Sum: 1, Min: 1, Max: 1}),
+	})
+	want := []StratumTileSizes{
+		{Stratum: 0, Tiles: 1, MinBytes: 80, MaxBytes: 80, TotalBytes: 80},
+		{Stratum: 1, Tiles: 4, MinBytes: 50, MaxBytes: 450, TotalBytes: 800},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("tileSizes() diff (-want +got):\n%s", diff)
+	}
+	if got, want := want[1].AvgBytes(), int64(200); got != want {
+		t.Errorf("AvgBytes() = %d, want %d", got, want)
+	}
+}
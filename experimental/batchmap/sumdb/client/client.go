@@ -0,0 +1,211 @@
+// Copyright 2021 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package client verifies that module versions are committed to by a
+// revision of the map, fetching the tiles that it needs over HTTP.
+//
+// The map has no serving API of its own: tiles are served as static files,
+// e.g. from the directory written by the files sink, or from the bucket
+// written by the gcs sink. Each tile is fetched from
+// <baseURL>/<mapdb.TileName><TileSuffix>, and the SumDB checkpoint that the
+// revision commits to from <baseURL>/<mapdb.CheckpointName>.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/google/trillian/experimental/batchmap"
+
+	"github.com/google/trillian-examples/experimental/batchmap/sumdb/build/pipeline"
+	"github.com/google/trillian-examples/experimental/batchmap/sumdb/mapdb"
+	"github.com/google/trillian-examples/experimental/batchmap/sumdb/verification"
+)
+
+var (
+	// ErrNotFound is returned by Verify if the tiles fetched verify up to
+	// the pinned root hash of the map, and have no value for the module version.
+	ErrNotFound = errors.New("module version not found in map")
+	// ErrValueMismatch is returned by Verify if the tiles fetched verify up
+	// to the pinned root hash of the map, and commit to a different hash for
+	// the module version.
+	ErrValueMismatch = errors.New("map has a different hash for module version")
+	// ErrProofMismatch is returned by Verify if the tiles fetched don't
+	// verify up to the pinned root hash of the map.
+	ErrProofMismatch = errors.New("proof does not verify against the map root")
+	// ErrNoCheckpoint is returned by Checkpoint if no checkpoint is served
+	// for the pinned revision, as for revisions built before they were written.
+	ErrNoCheckpoint = errors.New("no checkpoint for map revision")
+)
+
+// Client verifies module versions against a pinned revision of the map.
+type Client struct {
+	baseURL      string
+	revision     int
+	root         []byte
+	prefixStrata int
+	treeID       int64
+	keyDomain    string
+	hash         crypto.Hash
+
+	// TileSuffix is appended to the name of each tile to get its URL. This
+	// is ".json" by default, as written by the files sink. Set this to ""
+	// for tiles served from a bucket written by the gcs sink.
+	TileSuffix string
+	// HTTPClient is used to fetch tiles. This is http.DefaultClient by default.
+	HTTPClient *http.Client
+}
+
+// New returns a Client that verifies against the given revision of the map
+// with tiles under baseURL, which must have the given root hash.
+//
+// The keys and tiles that the client fetches depend on how the revision was
+// built, so rather than taking only the hash, New takes all of the params
+// that the revision was built with, as recorded in the map DB or in the
+// manifest of the build. This means that none can be left as the default
+// by mistake, which would make every lookup fail.
+func New(baseURL string, revision int, mapRoot []byte, params mapdb.BuildParams) (*Client, error) {
+	hash := pipeline.Hash
+	if params.Hash != hash.String() {
+		return nil, fmt.Errorf("unsupported hash %q; the map is built with %v", params.Hash, hash)
+	}
+	if params.StratumBits != 0 && params.StratumBits != pipeline.StratumBits {
+		return nil, fmt.Errorf("unsupported stratum bits %d; tiles can only be verified with %d", params.StratumBits, pipeline.StratumBits)
+	}
+	if got, want := len(mapRoot), hash.Size(); got != want {
+		return nil, fmt.Errorf("map root has length %d, want %d", got, want)
+	}
+	return &Client{
+		baseURL:      strings.TrimSuffix(baseURL, "/"),
+		revision:     revision,
+		root:         mapRoot,
+		prefixStrata: params.PrefixStrata,
+		treeID:       params.TreeID,
+		keyDomain:    params.KeyDomain,
+		hash:         hash,
+		TileSuffix:   ".json",
+		HTTPClient:   http.DefaultClient,
+	}, nil
+}
+
+// Verify checks that the map commits to the go.sum hash for the module
+// version, whose version has the /go.mod suffix for the hash of the go.mod
+// file. A nil error is only returned if the proof verifies to the pinned
+// root. Otherwise the error will wrap one of ErrNotFound, ErrValueMismatch
+// or ErrProofMismatch, unless the tiles couldn't be fetched. ErrNotFound and
+// ErrValueMismatch are only returned if the tiles showing this verify to the
+// pinned root, so that a server can't forge them.
+func (c *Client) Verify(ctx context.Context, module, version, hash string) error {
+	fetch := func(revision int, path []byte) (*batchmap.Tile, error) {
+		return c.tile(ctx, revision, path)
+	}
+	mv := verification.NewMapVerifier(fetch, c.prefixStrata, c.treeID, c.hash)
+	root, err := mv.CheckInclusion(c.revision, pipeline.MapKey(c.keyDomain, module, version), []byte(hash))
+	notFound, valueMismatch := errors.Is(err, verification.ErrKeyNotFound), errors.Is(err, verification.ErrValueMismatch)
+	switch {
+	case errors.Is(err, errFetch):
+		return err
+	case err != nil && !notFound && !valueMismatch:
+		return fmt.Errorf("%w: %s %s: %v", ErrProofMismatch, module, version, err)
+	case !bytes.Equal(root, c.root):
+		return fmt.Errorf("%w: %s %s verifies to root %x, want %x", ErrProofMismatch, module, version, root, c.root)
+	case notFound:
+		return fmt.Errorf("%w: %s %s: %v", ErrNotFound, module, version, err)
+	case valueMismatch:
+		return fmt.Errorf("%w: %s %s: %v", ErrValueMismatch, module, version, err)
+	}
+	return nil
+}
+
+// Checkpoint fetches the SumDB checkpoint served for the pinned revision. An
+// error wrapping ErrProofMismatch is returned if it is for a different map
+// root, or wrapping ErrNoCheckpoint if there is none. The signature on the checkpoint note is not verified, as the client
+// doesn't know the SumDB key; callers should verify it with note.Open.
+func (c *Client) Checkpoint(ctx context.Context) (*mapdb.RevisionCheckpoint, error) {
+	url := fmt.Sprintf("%s/%s", c.baseURL, mapdb.CheckpointName(c.revision))
+	bs, err := c.get(ctx, url)
+	if errors.Is(err, errNotFound) {
+		return nil, fmt.Errorf("%w %d at %s", ErrNoCheckpoint, c.revision, url)
+	} else if err != nil {
+		return nil, err
+	}
+	var cp mapdb.RevisionCheckpoint
+	if err := json.Unmarshal(bs, &cp); err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint from %s: %v", url, err)
+	}
+	if cp.Revision != c.revision || !bytes.Equal(cp.RootHash, c.root) {
+		return nil, fmt.Errorf("%w: checkpoint from %s is for revision %d with root %x, want revision %d with root %x", ErrProofMismatch, url, cp.Revision, cp.RootHash, c.revision, c.root)
+	}
+	return &cp, nil
+}
+
+// errFetch is wrapped by errors that aren't caused by the map contents.
+var errFetch = errors.New("failed to fetch tile")
+
+// tile fetches and parses the tile at the given path in the given revision.
+// A nil tile is returned if there is none below the root, which the verifier
+// checks against the tile above.
+func (c *Client) tile(ctx context.Context, revision int, path []byte) (*batchmap.Tile, error) {
+	url := fmt.Sprintf("%s/%s%s", c.baseURL, mapdb.TileName(revision, path), c.TileSuffix)
+	bs, err := c.get(ctx, url)
+	switch {
+	case errors.Is(err, errNotFound) && len(path) == 0:
+		// The root tile always exists, so the map isn't where it was expected.
+		return nil, fmt.Errorf("%w: no root tile at %s", errFetch, url)
+	case errors.Is(err, errNotFound):
+		// A tile below the root only exists if some key has its path as a prefix.
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	t, err := mapdb.DecodeTile(bs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse tile from %s: %v", url, err)
+	}
+	return t, nil
+}
+
+// errNotFound is returned by get if there is nothing at the URL.
+var errNotFound = errors.New("not found")
+
+// get fetches the content at the URL. Errors other than errNotFound wrap errFetch.
+func (c *Client) get(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errFetch, err)
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errFetch, err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, errNotFound
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("%w: GET %s: %s", errFetch, url, resp.Status)
+	}
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to read %s: %v", errFetch, url, err)
+	}
+	return bs, nil
+}
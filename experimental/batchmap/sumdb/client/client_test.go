@@ -0,0 +1,271 @@
+// Copyright 2021 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/testing/ptest"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/trillian/experimental/batchmap"
+	"github.com/google/trillian/merkle/coniks"
+	"github.com/google/trillian/merkle/smt/node"
+
+	"github.com/google/trillian-examples/experimental/batchmap/sumdb/build/pipeline"
+	"github.com/google/trillian-examples/experimental/batchmap/sumdb/mapdb"
+	"github.com/google/trillian-examples/experimental/batchmap/sumdb/mapdb/files"
+)
+
+const (
+	treeID       = 12345
+	prefixStrata = 1
+	revision     = 2
+)
+
+var params = mapdb.BuildParams{
+	TreeID:       treeID,
+	PrefixStrata: prefixStrata,
+	StratumBits:  pipeline.StratumBits,
+	Hash:         pipeline.Hash.String(),
+}
+
+func TestMain(m *testing.M) {
+	ptest.Main(m)
+}
+
+func TestVerify(t *testing.T) {
+	dir := t.TempDir()
+	var entries []*batchmap.Entry
+	for i := 0; i < 50; i++ {
+		key := pipeline.MapKey("", fmt.Sprintf("example.com/mod%d", i), "v1.0.0")
+		leafID := node.NewID(string(key), uint(len(key)*8))
+		entries = append(entries, &batchmap.Entry{
+			HashKey:   key,
+			HashValue: coniks.Default.HashLeaf(treeID, leafID, []byte(fmt.Sprintf("h1:hash%d", i))),
+		})
+	}
+	p, s := beam.NewPipelineWithRoot()
+	tiles, err := batchmap.Create(s, beam.CreateList(s, entries), treeID, pipeline.Hash, prefixStrata)
+	if err != nil {
+		t.Fatalf("failed to create pipeline: %v", err)
+	}
+	files.WriteTiles(s, dir, revision, tiles)
+	if err := ptest.Run(p); err != nil {
+		t.Fatalf("pipeline failed: %v", err)
+	}
+	root, err := files.NewTileStore(dir).Tile(revision, nil)
+	if err != nil {
+		t.Fatalf("failed to read root tile: %v", err)
+	}
+
+	key := pipeline.MapKey("", "example.com/mod7", "v1.0.0")
+	leafTile, err := files.NewTileStore(dir).Tile(revision, key[:1])
+	if err != nil {
+		t.Fatalf("failed to read leaf tile: %v", err)
+	}
+	// A module whose leaf tile doesn't exist, as no key in the map shares its first byte.
+	var absent string
+	for i := 0; absent == ""; i++ {
+		m := fmt.Sprintf("example.com/absent%d", i)
+		k := pipeline.MapKey("", m, "v1.0.0")
+		if _, err := files.NewTileStore(dir).Tile(revision, k[:1]); errors.Is(err, mapdb.ErrTileNotFound) {
+			absent = m
+		}
+	}
+
+	// tampered returns a client for a server that serves the tiles, except
+	// the leaf tile of mod7, which is modified by tamper or is missing if
+	// tamper is nil.
+	tampered := func(tamper func(*batchmap.Tile)) *Client {
+		t.Helper()
+		name := "/" + mapdb.TileName(revision, key[:1]) + ".json"
+		files := http.FileServer(http.Dir(dir))
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != name {
+				files.ServeHTTP(w, r)
+				return
+			}
+			if tamper == nil {
+				http.NotFound(w, r)
+				return
+			}
+			tile := *leafTile
+			tile.Leaves = append([]*batchmap.TileLeaf{}, leafTile.Leaves...)
+			tamper(&tile)
+			bs, err := mapdb.EncodeTile(&tile, false)
+			if err != nil {
+				t.Errorf("failed to encode tile: %v", err)
+			}
+			w.Write(bs)
+		}))
+		t.Cleanup(server.Close)
+		c, err := New(server.URL, revision, root.RootHash, params)
+		if err != nil {
+			t.Fatalf("New(): %v", err)
+		}
+		return c
+	}
+	leafIndex := func(tile *batchmap.Tile) int {
+		for i, l := range tile.Leaves {
+			if bytes.Equal(l.Path, key[1:]) {
+				return i
+			}
+		}
+		t.Fatalf("leaf %x not found in tile %x", key[1:], tile.Path)
+		return 0
+	}
+	otherHash := func(tile *batchmap.Tile) {
+		i := leafIndex(tile)
+		leafID := node.NewID(string(key), uint(len(key)*8))
+		tile.Leaves[i] = &batchmap.TileLeaf{Path: key[1:], Hash: coniks.Default.HashLeaf(treeID, leafID, []byte("h1:hash8"))}
+	}
+	noLeaf := func(tile *batchmap.Tile) {
+		i := leafIndex(tile)
+		tile.Leaves = append(tile.Leaves[:i], tile.Leaves[i+1:]...)
+	}
+
+	server := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer server.Close()
+	c, err := New(server.URL, revision, root.RootHash, params)
+	if err != nil {
+		t.Fatalf("New(): %v", err)
+	}
+	wrongRoot := append([]byte{}, root.RootHash...)
+	wrongRoot[0] ^= 1
+	wrongRootClient, err := New(server.URL, revision, wrongRoot, params)
+	if err != nil {
+		t.Fatalf("New(): %v", err)
+	}
+	missingClient, err := New(server.URL+"/missing", revision, root.RootHash, params)
+	if err != nil {
+		t.Fatalf("New(): %v", err)
+	}
+
+	for _, test := range []struct {
+		name            string
+		client          *Client
+		module, version string
+		hash            string
+		wantErr         bool
+		want            error
+	}{
+		{name: "verifies", client: c, module: "example.com/mod7", version: "v1.0.0", hash: "h1:hash7"},
+		{name: "wrong hash", client: c, module: "example.com/mod7", version: "v1.0.0", hash: "h1:hash8", wantErr: true, want: ErrValueMismatch},
+		{name: "unknown version", client: c, module: "example.com/mod7", version: "v1.0.1", hash: "h1:hash7", wantErr: true, want: ErrNotFound},
+		{name: "no leaf tile", client: c, module: absent, version: "v1.0.0", hash: "h1:hash7", wantErr: true, want: ErrNotFound},
+		{name: "forged hash", client: tampered(otherHash), module: "example.com/mod7", version: "v1.0.0", hash: "h1:hash7", wantErr: true, want: ErrProofMismatch},
+		{name: "forged missing leaf", client: tampered(noLeaf), module: "example.com/mod7", version: "v1.0.0", hash: "h1:hash7", wantErr: true, want: ErrProofMismatch},
+		{name: "forged missing tile", client: tampered(nil), module: "example.com/mod7", version: "v1.0.0", hash: "h1:hash7", wantErr: true, want: ErrProofMismatch},
+		{name: "wrong root", client: wrongRootClient, module: "example.com/mod7", version: "v1.0.0", hash: "h1:hash7", wantErr: true, want: ErrProofMismatch},
+		{name: "wrong hash, wrong root", client: wrongRootClient, module: "example.com/mod7", version: "v1.0.0", hash: "h1:hash8", wantErr: true, want: ErrProofMismatch},
+		{name: "unknown version, wrong root", client: wrongRootClient, module: "example.com/mod7", version: "v1.0.1", hash: "h1:hash7", wantErr: true, want: ErrProofMismatch},
+		{name: "no map at URL", client: missingClient, module: "example.com/mod7", version: "v1.0.0", hash: "h1:hash7", wantErr: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.client.Verify(context.Background(), test.module, test.version, test.hash)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("Verify() = %v, wantErr %t", err, test.wantErr)
+			}
+			for _, sentinel := range []error{ErrNotFound, ErrValueMismatch, ErrProofMismatch} {
+				if got, want := errors.Is(err, sentinel), sentinel == test.want; got != want {
+					t.Errorf("Verify() = %v; errors.Is(err, %v) = %t, want %t", err, sentinel, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, fmt.Sprint(revision)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	want := mapdb.RevisionCheckpoint{
+		Revision:   revision,
+		RootHash:   make([]byte, pipeline.Hash.Size()),
+		Entries:    50,
+		Checkpoint: "go.sum database tree\n50\nhash\n\n— sum.golang.org sig\n",
+	}
+	if err := files.WriteCheckpoint(dir, want); err != nil {
+		t.Fatalf("WriteCheckpoint(): %v", err)
+	}
+	server := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer server.Close()
+
+	wrongRoot := make([]byte, pipeline.Hash.Size())
+	wrongRoot[0] = 1
+	for _, test := range []struct {
+		name     string
+		revision int
+		root     []byte
+		wantErr  bool
+		want     error
+	}{
+		{name: "served", revision: revision, root: want.RootHash},
+		{name: "wrong root", revision: revision, root: wrongRoot, wantErr: true, want: ErrProofMismatch},
+		{name: "missing", revision: revision + 1, root: want.RootHash, wantErr: true, want: ErrNoCheckpoint},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := New(server.URL, test.revision, test.root, params)
+			if err != nil {
+				t.Fatalf("New(): %v", err)
+			}
+			got, err := c.Checkpoint(context.Background())
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("Checkpoint() = %v, wantErr %t", err, test.wantErr)
+			}
+			for _, sentinel := range []error{ErrProofMismatch, ErrNoCheckpoint} {
+				if got, want := errors.Is(err, sentinel), sentinel == test.want; got != want {
+					t.Errorf("Checkpoint() = %v; errors.Is(err, %v) = %t, want %t", err, sentinel, got, want)
+				}
+			}
+			if err == nil {
+				if diff := cmp.Diff(want, *got); diff != "" {
+					t.Errorf("Checkpoint() diff (-want +got):\n%s", diff)
+				}
+			}
+		})
+	}
+}
+
+func TestNewRejectsUnsupportedParams(t *testing.T) {
+	otherHash := params
+	otherHash.Hash = crypto.SHA256.String()
+	otherStratumBits := params
+	otherStratumBits.StratumBits = 4
+	for _, test := range []struct {
+		name   string
+		params mapdb.BuildParams
+	}{
+		{name: "SHA256", params: otherHash},
+		{name: "4-bit strata", params: otherStratumBits},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := New("http://example.com", 0, make([]byte, 32), test.params); err == nil {
+				t.Error("New(): expected error")
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package files stores map tiles as individual JSON files in a directory on
+// the local filesystem, which makes them easy to inspect and to ship around.
+// Each tile is stored at <dir>/<mapdb.TileName>.json, and the checkpoint of
+// each revision at <dir>/<mapdb.CheckpointName>.
+package files
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/google/trillian/experimental/batchmap"
+
+	"github.com/google/trillian-examples/experimental/batchmap/sumdb/mapdb"
+)
+
+const ext = ".json"
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*writeTileFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*listTilesFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*readTileFn)(nil)).Elem())
+}
+
+// WriteTiles writes each *batchmap.Tile in the PCollection to a file in the
+// directory for the given revision.
+func WriteTiles(s beam.Scope, dir string, revision int, tiles beam.PCollection) {
+	beam.ParDo0(s.Scope("files.WriteTiles"), &writeTileFn{Dir: dir, Revision: revision}, tiles)
+}
+
+// ReadTiles returns a PCollection of *batchmap.Tile containing every tile
+// stored in the directory for the given revision.
+func ReadTiles(s beam.Scope, dir string, revision int) beam.PCollection {
+	s = s.Scope("files.ReadTiles")
+	names := beam.ParDo(s, &listTilesFn{Dir: dir, Revision: revision}, beam.Impulse(s))
+	return beam.ParDo(s, &readTileFn{Dir: dir}, beam.Reshuffle(s, names))
+}
+
+// NextWriteRevision returns the first revision that has no tiles in the
+// directory. This is used to make sure that tiles left over from a failed
+// build are not mixed in with those from a later build.
+func NextWriteRevision(dir string) (int, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to list %q: %v", dir, err)
+	}
+	next := 0
+	for _, e := range entries {
+		if rev, err := strconv.Atoi(e.Name()); err == nil && e.IsDir() && rev >= next {
+			next = rev + 1
+		}
+	}
+	return next, nil
+}
+
+// WriteCheckpoint writes the checkpoint of a revision to the directory, next
+// to its tiles. This should be done once all of the tiles have been written.
+func WriteCheckpoint(dir string, cp mapdb.RevisionCheckpoint) error {
+	bs, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(dir, filepath.FromSlash(mapdb.CheckpointName(cp.Revision)))
+	if err := ioutil.WriteFile(name, bs, 0644); err != nil {
+		return fmt.Errorf("failed to write %q: %v", name, err)
+	}
+	return nil
+}
+
+type writeTileFn struct {
+	Dir      string
+	Revision int
+}
+
+func (fn *writeTileFn) Setup() error {
+	return os.MkdirAll(filepath.Join(fn.Dir, strconv.Itoa(fn.Revision)), 0755)
+}
+
+func (fn *writeTileFn) ProcessElement(t *batchmap.Tile) error {
+	// Tiles are never compressed so that they can be inspected directly.
+	bs, err := mapdb.EncodeTile(t, false)
+	if err != nil {
+		return err
+	}
+	name := tilePath(fn.Dir, fn.Revision, t.Path)
+	if err := ioutil.WriteFile(name, bs, 0644); err != nil {
+		return fmt.Errorf("failed to write %q: %v", name, err)
+	}
+	return nil
+}
+
+type listTilesFn struct {
+	Dir      string
+	Revision int
+}
+
+func (fn *listTilesFn) ProcessElement(_ []byte, emit func(string)) error {
+	revDir := filepath.Join(fn.Dir, strconv.Itoa(fn.Revision))
+	entries, err := ioutil.ReadDir(revDir)
+	if err != nil {
+		return fmt.Errorf("failed to list tiles in %q: %v", revDir, err)
+	}
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ext) {
+			emit(filepath.Join(revDir, e.Name()))
+		}
+	}
+	return nil
+}
+
+type readTileFn struct {
+	Dir string
+}
+
+func (fn *readTileFn) ProcessElement(name string) (*batchmap.Tile, error) {
+	return readTile(name)
+}
+
+// TileStore reads tiles from a directory written by WriteTiles.
+type TileStore struct {
+	dir string
+}
+
+// NewTileStore returns a TileStore that reads tiles from the directory.
+func NewTileStore(dir string) *TileStore {
+	return &TileStore{dir: dir}
+}
+
+// Tile gets the tile at the given path in the given revision of the map.
+// This has the same signature as mapdb.TileDB.Tile so that it can be used
+// as a verification.TileFetch.
+func (s *TileStore) Tile(revision int, path []byte) (*batchmap.Tile, error) {
+	return readTile(tilePath(s.dir, revision, path))
+}
+
+func tilePath(dir string, revision int, path []byte) string {
+	return filepath.Join(dir, filepath.FromSlash(mapdb.TileName(revision, path))+ext)
+}
+
+func readTile(name string) (*batchmap.Tile, error) {
+	bs, err := ioutil.ReadFile(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: no file %q", mapdb.ErrTileNotFound, name)
+		}
+		return nil, fmt.Errorf("failed to read %q: %v", name, err)
+	}
+	tile, err := mapdb.DecodeTile(bs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse tile %q: %v", name, err)
+	}
+	return tile, nil
+}
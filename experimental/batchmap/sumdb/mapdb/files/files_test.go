@@ -0,0 +1,94 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package files
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/go/pkg/beam/testing/ptest"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/trillian/experimental/batchmap"
+
+	"github.com/google/trillian-examples/experimental/batchmap/sumdb/mapdb"
+)
+
+func TestMain(m *testing.M) {
+	ptest.Main(m)
+}
+
+func TestWriteAndReadTiles(t *testing.T) {
+	dir := t.TempDir()
+	tiles := []*batchmap.Tile{
+		{Path: []byte{}, RootHash: []byte("root")},
+		{Path: []byte{0x12}, RootHash: []byte("child"), Leaves: []*batchmap.TileLeaf{{Path: []byte{0x34}, Hash: []byte("leaf")}}},
+	}
+
+	if got, err := NextWriteRevision(dir); err != nil || got != 0 {
+		t.Fatalf("NextWriteRevision() on empty dir = %d, %v; want 0, nil", got, err)
+	}
+
+	p, s := beam.NewPipelineWithRoot()
+	WriteTiles(s, dir, 3, beam.CreateList(s, tiles))
+	if err := ptest.Run(p); err != nil {
+		t.Fatalf("pipeline to write tiles failed: %v", err)
+	}
+
+	// The files should be plain JSON so that they can be inspected.
+	for _, name := range []string{"3/root.json", "3/12.json"} {
+		bs, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("failed to read tile file: %v", err)
+		}
+		if !json.Valid(bs) {
+			t.Errorf("tile file %q is not valid JSON: %s", name, bs)
+		}
+	}
+
+	// The checkpoint is stored with the tiles, but mustn't be read as one.
+	if err := WriteCheckpoint(dir, mapdb.RevisionCheckpoint{Revision: 3, RootHash: []byte("root"), Entries: 2}); err != nil {
+		t.Fatalf("WriteCheckpoint(): %v", err)
+	}
+
+	ts := NewTileStore(dir)
+	for _, want := range tiles {
+		got, err := ts.Tile(3, want.Path)
+		if err != nil {
+			t.Fatalf("Tile(3, %x): %v", want.Path, err)
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("Tile(3, %x) diff (-want +got):\n%s", want.Path, diff)
+		}
+	}
+	if _, err := ts.Tile(2, nil); err == nil {
+		t.Error("Tile() for missing revision: expected error")
+	}
+
+	p, s = beam.NewPipelineWithRoot()
+	roots := beam.ParDo(s, func(t *batchmap.Tile) string { return fmt.Sprintf("%x:%s", t.Path, t.RootHash) }, ReadTiles(s, dir, 3))
+	passert.Equals(s, roots, ":root", "12:child")
+	if err := ptest.Run(p); err != nil {
+		t.Fatalf("pipeline to read tiles failed: %v", err)
+	}
+
+	if got, err := NextWriteRevision(dir); err != nil || got != 4 {
+		t.Errorf("NextWriteRevision() = %d, %v; want 4, nil", got, err)
+	}
+}
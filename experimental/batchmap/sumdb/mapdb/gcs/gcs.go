@@ -0,0 +1,226 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gcs stores map tiles as individual objects in a Google Cloud
+// Storage bucket, which allows them to be served directly from the bucket.
+// Tiles are named using mapdb.TileName, and the checkpoint of each revision
+// using mapdb.CheckpointName.
+package gcs
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+
+	"cloud.google.com/go/storage"
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/google/trillian/experimental/batchmap"
+	"google.golang.org/api/iterator"
+
+	"github.com/google/trillian-examples/experimental/batchmap/sumdb/mapdb"
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*writeTileFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*listTilesFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*readTileFn)(nil)).Elem())
+}
+
+// WriteTiles writes each *batchmap.Tile in the PCollection to the bucket under
+// the given revision. If compress is set then the objects will be written with
+// gzip content encoding.
+func WriteTiles(s beam.Scope, bucket string, revision int, compress bool, tiles beam.PCollection) {
+	beam.ParDo0(s.Scope("gcs.WriteTiles"), &writeTileFn{Bucket: bucket, Revision: revision, Compress: compress}, tiles)
+}
+
+// ReadTiles returns a PCollection of *batchmap.Tile containing every tile
+// stored in the bucket for the given revision.
+func ReadTiles(s beam.Scope, bucket string, revision int) beam.PCollection {
+	s = s.Scope("gcs.ReadTiles")
+	names := beam.ParDo(s, &listTilesFn{Bucket: bucket, Revision: revision}, beam.Impulse(s))
+	return beam.ParDo(s, &readTileFn{Bucket: bucket}, beam.Reshuffle(s, names))
+}
+
+// WriteCheckpoint writes the checkpoint of a revision to the bucket, next to
+// its tiles. This should be done once all of the tiles have been written.
+func WriteCheckpoint(ctx context.Context, bucket string, cp mapdb.RevisionCheckpoint) error {
+	bs, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create storage client: %v", err)
+	}
+	defer client.Close()
+	return writeObject(ctx, client.Bucket(bucket), mapdb.CheckpointName(cp.Revision), bs, false)
+}
+
+type writeTileFn struct {
+	Bucket   string
+	Revision int
+	Compress bool
+
+	client *storage.Client
+}
+
+func (fn *writeTileFn) Setup(ctx context.Context) error {
+	var err error
+	fn.client, err = storage.NewClient(ctx)
+	return err
+}
+
+func (fn *writeTileFn) ProcessElement(ctx context.Context, t *batchmap.Tile) error {
+	bs, err := mapdb.EncodeTile(t, false)
+	if err != nil {
+		return err
+	}
+	return writeObject(ctx, fn.client.Bucket(fn.Bucket), mapdb.TileName(fn.Revision, t.Path), bs, fn.Compress)
+}
+
+func (fn *writeTileFn) Teardown() error {
+	return fn.client.Close()
+}
+
+type listTilesFn struct {
+	Bucket   string
+	Revision int
+}
+
+func (fn *listTilesFn) ProcessElement(ctx context.Context, _ []byte, emit func(string)) error {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	// All tiles for a revision are named with the revision as the first path component.
+	prefix := fmt.Sprintf("%d/", fn.Revision)
+	it := client.Bucket(fn.Bucket).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to list tiles in gs://%s/%s: %v", fn.Bucket, prefix, err)
+		}
+		if attrs.Name == mapdb.CheckpointName(fn.Revision) {
+			continue
+		}
+		emit(attrs.Name)
+	}
+}
+
+type readTileFn struct {
+	Bucket string
+
+	client *storage.Client
+}
+
+func (fn *readTileFn) Setup(ctx context.Context) error {
+	var err error
+	fn.client, err = storage.NewClient(ctx)
+	return err
+}
+
+func (fn *readTileFn) ProcessElement(ctx context.Context, name string) (*batchmap.Tile, error) {
+	return readTile(ctx, fn.client.Bucket(fn.Bucket), name)
+}
+
+func (fn *readTileFn) Teardown() error {
+	return fn.client.Close()
+}
+
+// TileStore reads tiles directly from a bucket.
+type TileStore struct {
+	client *storage.Client
+	bucket *storage.BucketHandle
+}
+
+// NewTileStore returns a TileStore that reads tiles from the named bucket.
+// The TileStore returned should have Close called when done.
+func NewTileStore(ctx context.Context, bucket string) (*TileStore, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage client: %v", err)
+	}
+	return &TileStore{
+		client: client,
+		bucket: client.Bucket(bucket),
+	}, nil
+}
+
+// Tile gets the tile at the given path in the given revision of the map.
+// This has the same signature as mapdb.TileDB.Tile so that it can be used
+// as a verification.TileFetch.
+func (s *TileStore) Tile(revision int, path []byte) (*batchmap.Tile, error) {
+	return readTile(context.Background(), s.bucket, mapdb.TileName(revision, path))
+}
+
+// Close closes the underlying storage client.
+func (s *TileStore) Close() error {
+	return s.client.Close()
+}
+
+func writeObject(ctx context.Context, bucket *storage.BucketHandle, name string, data []byte, compress bool) error {
+	w := bucket.Object(name).NewWriter(ctx)
+	w.ContentType = "application/json"
+	var out io.Writer = w
+	var zw *gzip.Writer
+	if compress {
+		w.ContentEncoding = "gzip"
+		zw = gzip.NewWriter(w)
+		out = zw
+	}
+	if _, err := out.Write(data); err != nil {
+		w.Close()
+		return fmt.Errorf("failed to write %q: %v", name, err)
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			w.Close()
+			return fmt.Errorf("failed to gzip %q: %v", name, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to close %q: %v", name, err)
+	}
+	return nil
+}
+
+func readTile(ctx context.Context, bucket *storage.BucketHandle, name string) (*batchmap.Tile, error) {
+	// Objects written with gzip content encoding are transparently decompressed.
+	r, err := bucket.Object(name).NewReader(ctx)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return nil, fmt.Errorf("%w: no object %q", mapdb.ErrTileNotFound, name)
+		}
+		return nil, fmt.Errorf("failed to open %q: %v", name, err)
+	}
+	defer r.Close()
+	bs, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %q: %v", name, err)
+	}
+	tile, err := mapdb.DecodeTile(bs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse tile %q: %v", name, err)
+	}
+	return tile, nil
+}
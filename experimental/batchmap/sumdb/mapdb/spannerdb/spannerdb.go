@@ -0,0 +1,295 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package spannerdb stores map tiles and revision metadata in Cloud Spanner,
+// for serving deployments that need the map to be globally available.
+// The methods mirror those of mapdb.TileDB, and tiles are serialized using
+// mapdb.EncodeTile.
+package spannerdb
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	database "cloud.google.com/go/spanner/admin/database/apiv1"
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/google/trillian/experimental/batchmap"
+	"google.golang.org/api/iterator"
+	databasepb "google.golang.org/genproto/googleapis/spanner/admin/database/v1"
+	"google.golang.org/grpc/codes"
+
+	"github.com/google/trillian-examples/experimental/batchmap/sumdb/mapdb"
+)
+
+// schema is the DDL for each table, keyed by table name.
+var schema = map[string]string{
+	"Tiles": `CREATE TABLE Tiles (
+		Revision INT64 NOT NULL,
+		Path BYTES(MAX) NOT NULL,
+		Tile BYTES(MAX) NOT NULL,
+	) PRIMARY KEY (Revision, Path)`,
+	"Revisions": `CREATE TABLE Revisions (
+		Revision INT64 NOT NULL,
+		Datetime TIMESTAMP NOT NULL,
+		LogRoot BYTES(MAX),
+		Count INT64 NOT NULL,
+		RootHash BYTES(MAX),
+	) PRIMARY KEY (Revision)`,
+}
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*writeTilesFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*readTilesFn)(nil)).Elem())
+}
+
+// TileDB provides read/write access to map tiles and revision metadata
+// stored in a Spanner database.
+type TileDB struct {
+	database string
+	client   *spanner.Client
+}
+
+// NewTileDB creates a TileDB using the Spanner database with the given name,
+// which is of the form projects/P/instances/I/databases/D.
+// The TileDB returned should have Close called when done.
+func NewTileDB(ctx context.Context, database string) (*TileDB, error) {
+	client, err := spanner.NewClient(ctx, database)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spanner client: %v", err)
+	}
+	return &TileDB{
+		database: database,
+		client:   client,
+	}, nil
+}
+
+// Init creates the database tables if needed.
+func (d *TileDB) Init(ctx context.Context) error {
+	existing := make(map[string]bool)
+	iter := d.client.Single().Query(ctx, spanner.NewStatement("SELECT TABLE_NAME FROM INFORMATION_SCHEMA.TABLES WHERE TABLE_SCHEMA = ''"))
+	if err := iter.Do(func(r *spanner.Row) error {
+		var name string
+		if err := r.Columns(&name); err != nil {
+			return err
+		}
+		existing[name] = true
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to list tables: %v", err)
+	}
+	var ddl []string
+	for table, stmt := range schema {
+		if !existing[table] {
+			ddl = append(ddl, stmt)
+		}
+	}
+	if len(ddl) == 0 {
+		return nil
+	}
+
+	admin, err := database.NewDatabaseAdminClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create spanner admin client: %v", err)
+	}
+	defer admin.Close()
+	op, err := admin.UpdateDatabaseDdl(ctx, &databasepb.UpdateDatabaseDdlRequest{
+		Database:   d.database,
+		Statements: ddl,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create tables: %v", err)
+	}
+	if err := op.Wait(ctx); err != nil {
+		return fmt.Errorf("failed to wait for tables to be created: %v", err)
+	}
+	return nil
+}
+
+// NextWriteRevision gets the revision that the next generation of the map should be written at.
+func (d *TileDB) NextWriteRevision(ctx context.Context) (int, error) {
+	next := 0
+	for _, table := range []string{"Tiles", "Revisions"} {
+		var rev spanner.NullInt64
+		row, err := d.client.Single().Query(ctx, spanner.NewStatement(fmt.Sprintf("SELECT MAX(Revision) FROM %s", table))).Next()
+		if err != nil {
+			return 0, fmt.Errorf("failed to query max revision in %s: %v", table, err)
+		}
+		if err := row.Columns(&rev); err != nil {
+			return 0, err
+		}
+		if rev.Valid && int(rev.Int64) >= next {
+			next = int(rev.Int64) + 1
+		}
+	}
+	return next, nil
+}
+
+// LatestRevision gets the metadata for the last completed write.
+func (d *TileDB) LatestRevision(ctx context.Context) (rev int, logroot []byte, count int64, err error) {
+	iter := d.client.Single().Query(ctx, spanner.NewStatement("SELECT Revision, LogRoot, Count FROM Revisions ORDER BY Revision DESC LIMIT 1"))
+	defer iter.Stop()
+	row, err := iter.Next()
+	if err == iterator.Done {
+		return 0, nil, 0, mapdb.ErrNoRevisions
+	}
+	if err != nil {
+		return 0, nil, 0, fmt.Errorf("failed to get latest revision: %v", err)
+	}
+	var rev64 int64
+	if err := row.Columns(&rev64, &logroot, &count); err != nil {
+		return 0, nil, 0, err
+	}
+	return int(rev64), logroot, count, nil
+}
+
+// WriteRevision writes the metadata for a completed run into the database.
+// If this method isn't called then the tiles may be written but this revision will be
+// skipped by sensible readers because the provenance information isn't available.
+func (d *TileDB) WriteRevision(ctx context.Context, rev int, logCheckpoint []byte, count int64, rootHash []byte) error {
+	m := spanner.Insert("Revisions",
+		[]string{"Revision", "Datetime", "LogRoot", "Count", "RootHash"},
+		[]interface{}{int64(rev), time.Now(), logCheckpoint, count, rootHash})
+	if _, err := d.client.Apply(ctx, []*spanner.Mutation{m}); err != nil {
+		return fmt.Errorf("failed to write revision %d: %v", rev, err)
+	}
+	return nil
+}
+
+// Tile gets the tile at the given path in the given revision of the map.
+// This has the same signature as mapdb.TileDB.Tile so that it can be used
+// as a verification.TileFetch.
+func (d *TileDB) Tile(revision int, path []byte) (*batchmap.Tile, error) {
+	if path == nil {
+		// The root tile has an empty path, but NULL is not a valid key.
+		path = []byte{}
+	}
+	row, err := d.client.Single().ReadRow(context.Background(), "Tiles", spanner.Key{int64(revision), path}, []string{"Tile"})
+	if err != nil {
+		if spanner.ErrCode(err) == codes.NotFound {
+			return nil, fmt.Errorf("%w at revision %d with path %x", mapdb.ErrTileNotFound, revision, path)
+		}
+		return nil, fmt.Errorf("failed to read tile at revision %d with path %x: %v", revision, path, err)
+	}
+	var bs []byte
+	if err := row.Columns(&bs); err != nil {
+		return nil, err
+	}
+	return mapdb.DecodeTile(bs)
+}
+
+// Close closes the underlying Spanner client.
+func (d *TileDB) Close() {
+	d.client.Close()
+}
+
+// WriteTiles writes each *batchmap.Tile in the PCollection to the Spanner
+// database under the given revision. Tiles are written in batches of
+// batchSize mutations. If compress is set then the tiles will be gzipped.
+func WriteTiles(s beam.Scope, database string, revision int, batchSize int, compress bool, tiles beam.PCollection) {
+	beam.ParDo0(s.Scope("spannerdb.WriteTiles"), &writeTilesFn{Database: database, Revision: revision, BatchSize: batchSize, Compress: compress}, tiles)
+}
+
+// ReadTiles returns a PCollection of *batchmap.Tile containing every tile
+// stored in the Spanner database for the given revision.
+func ReadTiles(s beam.Scope, database string, revision int) beam.PCollection {
+	s = s.Scope("spannerdb.ReadTiles")
+	tiles := beam.ParDo(s, &readTilesFn{Database: database, Revision: revision}, beam.Impulse(s))
+	return beam.Reshuffle(s, tiles)
+}
+
+type writeTilesFn struct {
+	Database  string
+	Revision  int
+	BatchSize int
+	Compress  bool
+
+	client    *spanner.Client
+	mutations []*spanner.Mutation
+}
+
+func (fn *writeTilesFn) Setup(ctx context.Context) error {
+	var err error
+	fn.client, err = spanner.NewClient(ctx, fn.Database)
+	return err
+}
+
+func (fn *writeTilesFn) ProcessElement(ctx context.Context, t *batchmap.Tile) error {
+	bs, err := mapdb.EncodeTile(t, fn.Compress)
+	if err != nil {
+		return err
+	}
+	path := t.Path
+	if path == nil {
+		path = []byte{}
+	}
+	// InsertOrUpdate makes the write idempotent, which allows bundles to be retried.
+	fn.mutations = append(fn.mutations, spanner.InsertOrUpdate("Tiles",
+		[]string{"Revision", "Path", "Tile"},
+		[]interface{}{int64(fn.Revision), path, bs}))
+	if len(fn.mutations) >= fn.BatchSize {
+		return fn.flush(ctx)
+	}
+	return nil
+}
+
+func (fn *writeTilesFn) FinishBundle(ctx context.Context) error {
+	return fn.flush(ctx)
+}
+
+func (fn *writeTilesFn) Teardown() {
+	fn.client.Close()
+}
+
+func (fn *writeTilesFn) flush(ctx context.Context) error {
+	if len(fn.mutations) == 0 {
+		return nil
+	}
+	if _, err := fn.client.Apply(ctx, fn.mutations); err != nil {
+		return fmt.Errorf("failed to write %d tiles: %v", len(fn.mutations), err)
+	}
+	fn.mutations = nil
+	return nil
+}
+
+type readTilesFn struct {
+	Database string
+	Revision int
+}
+
+func (fn *readTilesFn) ProcessElement(ctx context.Context, _ []byte, emit func(*batchmap.Tile)) error {
+	client, err := spanner.NewClient(ctx, fn.Database)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	stmt := spanner.Statement{
+		SQL:    "SELECT Path, Tile FROM Tiles WHERE Revision = @revision",
+		Params: map[string]interface{}{"revision": int64(fn.Revision)},
+	}
+	return client.Single().Query(ctx, stmt).Do(func(r *spanner.Row) error {
+		var path, bs []byte
+		if err := r.Columns(&path, &bs); err != nil {
+			return err
+		}
+		tile, err := mapdb.DecodeTile(bs)
+		if err != nil {
+			return fmt.Errorf("failed to parse tile at path %x: %v", path, err)
+		}
+		emit(tile)
+		return nil
+	})
+}
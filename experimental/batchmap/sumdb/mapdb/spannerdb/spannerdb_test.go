@@ -0,0 +1,139 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spannerdb
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"cloud.google.com/go/spanner/spannertest"
+	"cloud.google.com/go/spanner/spansql"
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/testing/passert"
+	"github.com/apache/beam/sdks/go/pkg/beam/testing/ptest"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/trillian/experimental/batchmap"
+)
+
+const testDB = "projects/p/instances/i/databases/d"
+
+// newTestTileDB returns a TileDB backed by an in-memory fake of Spanner with
+// the tables already created. The fake doesn't support INFORMATION_SCHEMA,
+// so the schema is applied directly rather than using Init.
+func newTestTileDB(t *testing.T) *TileDB {
+	t.Helper()
+	srv, err := spannertest.NewServer("localhost:0")
+	if err != nil {
+		t.Fatalf("failed to start fake spanner: %v", err)
+	}
+	t.Cleanup(srv.Close)
+	for table, stmt := range schema {
+		ddl, err := spansql.ParseDDL(table, stmt)
+		if err != nil {
+			t.Fatalf("failed to parse DDL for %s: %v", table, err)
+		}
+		if err := srv.UpdateDDL(ddl); err != nil {
+			t.Fatalf("failed to create %s: %v", table, err)
+		}
+	}
+	// The Spanner client connects to this address instead of production,
+	// which also applies to clients created by the pipeline.
+	old, set := os.LookupEnv("SPANNER_EMULATOR_HOST")
+	os.Setenv("SPANNER_EMULATOR_HOST", srv.Addr)
+	t.Cleanup(func() {
+		if set {
+			os.Setenv("SPANNER_EMULATOR_HOST", old)
+		} else {
+			os.Unsetenv("SPANNER_EMULATOR_HOST")
+		}
+	})
+
+	db, err := NewTileDB(context.Background(), testDB)
+	if err != nil {
+		t.Fatalf("NewTileDB(): %v", err)
+	}
+	t.Cleanup(db.Close)
+	return db
+}
+
+func TestRevisions(t *testing.T) {
+	ctx := context.Background()
+	db := newTestTileDB(t)
+
+	if _, _, _, err := db.LatestRevision(ctx); err == nil {
+		t.Fatal("LatestRevision() on empty DB: expected error")
+	}
+	if got, err := db.NextWriteRevision(ctx); err != nil || got != 0 {
+		t.Fatalf("NextWriteRevision() = %d, %v; want 0, nil", got, err)
+	}
+
+	for rev, count := range []int64{10, 25} {
+		if err := db.WriteRevision(ctx, rev, []byte("checkpoint"), count, []byte("root")); err != nil {
+			t.Fatalf("WriteRevision(%d): %v", rev, err)
+		}
+	}
+	rev, logroot, count, err := db.LatestRevision(ctx)
+	if err != nil {
+		t.Fatalf("LatestRevision(): %v", err)
+	}
+	if rev != 1 || string(logroot) != "checkpoint" || count != 25 {
+		t.Errorf("LatestRevision() = %d, %q, %d; want 1, \"checkpoint\", 25", rev, logroot, count)
+	}
+	if got, err := db.NextWriteRevision(ctx); err != nil || got != 2 {
+		t.Errorf("NextWriteRevision() = %d, %v; want 2, nil", got, err)
+	}
+}
+
+func TestWriteAndReadTiles(t *testing.T) {
+	db := newTestTileDB(t)
+	tiles := []*batchmap.Tile{
+		{RootHash: []byte("root")},
+		{Path: []byte{0x12}, RootHash: []byte("child"), Leaves: []*batchmap.TileLeaf{{Path: []byte{0x34}, Hash: []byte("leaf")}}},
+	}
+
+	for _, compress := range []bool{false, true} {
+		rev := 0
+		if compress {
+			rev = 1
+		}
+		p, s := beam.NewPipelineWithRoot()
+		WriteTiles(s, testDB, rev, 1, compress, beam.CreateList(s, tiles))
+		if err := ptest.Run(p); err != nil {
+			t.Fatalf("pipeline to write tiles failed: %v", err)
+		}
+
+		for _, want := range tiles {
+			got, err := db.Tile(rev, want.Path)
+			if err != nil {
+				t.Fatalf("Tile(%d, %x): %v", rev, want.Path, err)
+			}
+			if diff := cmp.Diff(want.RootHash, got.RootHash); diff != "" {
+				t.Errorf("Tile(%d, %x) root hash diff (-want +got):\n%s", rev, want.Path, diff)
+			}
+		}
+
+		p, s = beam.NewPipelineWithRoot()
+		roots := beam.ParDo(s, func(t *batchmap.Tile) string { return string(t.RootHash) }, ReadTiles(s, testDB, rev))
+		passert.Equals(s, roots, "root", "child")
+		if err := ptest.Run(p); err != nil {
+			t.Fatalf("pipeline to read tiles failed: %v", err)
+		}
+	}
+
+	if _, err := db.Tile(5, nil); err == nil {
+		t.Error("Tile() for missing revision: expected error")
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sqldb writes map tiles from a Beam pipeline into the tiles table of
+// a map DB. Unlike databaseio, each batch of tiles is written in a transaction
+// that is retried with backoff if it fails with a transient error, which
+// allows long builds to survive the database being briefly locked.
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	backoff "github.com/cenkalti/backoff/v4"
+	"github.com/golang/glog"
+	"github.com/google/trillian/experimental/batchmap"
+	"github.com/mattn/go-sqlite3"
+
+	"github.com/google/trillian-examples/experimental/batchmap/sumdb/mapdb"
+)
+
+var (
+	cntWriteRetries = beam.NewCounter("sqldb", "write-retries")
+
+	// retryInterval is the initial interval between retries. This is a
+	// variable so that tests don't need to wait as long.
+	retryInterval = 500 * time.Millisecond
+
+	// writeSlots holds a semaphore for each database being written to by
+	// this process, which limits how many transactions are in flight at once.
+	writeSlotsMu sync.Mutex
+	writeSlots   = make(map[string]chan struct{})
+)
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*writeTilesFn)(nil)).Elem())
+}
+
+// WriteTiles writes each *batchmap.Tile in the PCollection to the tiles table
+// of the database, under the given revision. Tiles are written in transactions
+// of up to batchSize tiles. A transaction that fails with a transient error is
+// retried up to maxRetries times; any other error fails the bundle.
+// If concurrency is positive then at most that many transactions are written
+// to the database at once by each worker process, with the other bundles
+// waiting for their turn; otherwise every bundle writes as soon as it can.
+func WriteTiles(s beam.Scope, driverName, dsn string, revision, batchSize, maxRetries, concurrency int, compress bool, tiles beam.PCollection) {
+	beam.ParDo0(s.Scope("sqldb.WriteTiles"), &writeTilesFn{
+		Driver:      driverName,
+		DSN:         dsn,
+		Revision:    revision,
+		BatchSize:   batchSize,
+		MaxRetries:  maxRetries,
+		Concurrency: concurrency,
+		Compress:    compress,
+	}, tiles)
+}
+
+// slotsFor returns the semaphore shared by all writers to the database in
+// this process. The size of the semaphore is fixed by the first caller.
+func slotsFor(driverName, dsn string, concurrency int) chan struct{} {
+	writeSlotsMu.Lock()
+	defer writeSlotsMu.Unlock()
+	key := driverName + " " + dsn
+	slots, ok := writeSlots[key]
+	if !ok {
+		slots = make(chan struct{}, concurrency)
+		writeSlots[key] = slots
+	}
+	return slots
+}
+
+// IsTransient returns true if the error is one that may succeed if retried,
+// such as the database being locked by another writer.
+func IsTransient(err error) bool {
+	var serr sqlite3.Error
+	if errors.As(err, &serr) {
+		return serr.Code == sqlite3.ErrBusy || serr.Code == sqlite3.ErrLocked
+	}
+	return errors.Is(err, driver.ErrBadConn)
+}
+
+type tileRow struct {
+	path, tile []byte
+}
+
+type writeTilesFn struct {
+	Driver      string
+	DSN         string
+	Revision    int
+	BatchSize   int
+	MaxRetries  int
+	Concurrency int
+	Compress    bool
+
+	db    *sql.DB
+	slots chan struct{}
+	rows  []tileRow
+}
+
+func (fn *writeTilesFn) Setup() error {
+	if fn.Concurrency > 0 {
+		fn.slots = slotsFor(fn.Driver, fn.DSN, fn.Concurrency)
+	}
+	var err error
+	fn.db, err = sql.Open(fn.Driver, fn.DSN)
+	return err
+}
+
+func (fn *writeTilesFn) ProcessElement(ctx context.Context, t *batchmap.Tile) error {
+	bs, err := mapdb.EncodeTile(t, fn.Compress)
+	if err != nil {
+		return err
+	}
+	fn.rows = append(fn.rows, tileRow{path: t.Path, tile: bs})
+	if len(fn.rows) >= fn.BatchSize {
+		return fn.flush(ctx)
+	}
+	return nil
+}
+
+func (fn *writeTilesFn) FinishBundle(ctx context.Context) error {
+	return fn.flush(ctx)
+}
+
+func (fn *writeTilesFn) Teardown() error {
+	return fn.db.Close()
+}
+
+func (fn *writeTilesFn) flush(ctx context.Context) error {
+	if len(fn.rows) == 0 {
+		return nil
+	}
+	if fn.slots != nil {
+		select {
+		case fn.slots <- struct{}{}:
+			defer func() { <-fn.slots }()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	operation := func() error {
+		err := fn.writeBatch(ctx)
+		if err != nil && !IsTransient(err) {
+			return backoff.Permanent(err)
+		}
+		return err
+	}
+	bo := backoff.NewExponentialBackOff()
+	bo.InitialInterval = retryInterval
+	notify := func(err error, d time.Duration) {
+		cntWriteRetries.Inc(ctx, 1)
+		glog.Warningf("Retrying write of %d tiles in %v after transient error: %v", len(fn.rows), d, err)
+	}
+	if err := backoff.RetryNotify(operation, backoff.WithContext(backoff.WithMaxRetries(bo, uint64(fn.MaxRetries)), ctx), notify); err != nil {
+		return fmt.Errorf("failed to write %d tiles: %v", len(fn.rows), err)
+	}
+	fn.rows = nil
+	return nil
+}
+
+// writeBatch writes all of the pending rows in a single transaction.
+func (fn *writeTilesFn) writeBatch(ctx context.Context) error {
+	tx, err := fn.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO tiles (revision, path, tile) VALUES (?, ?, ?)")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for _, r := range fn.rows {
+		if _, err := stmt.ExecContext(ctx, fn.Revision, r.path, r.tile); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,312 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/testing/ptest"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/trillian/experimental/batchmap"
+	"github.com/mattn/go-sqlite3"
+
+	"github.com/google/trillian-examples/experimental/batchmap/sumdb/mapdb"
+)
+
+var flaky = &flakyDriver{dbs: make(map[string]*flakyDB)}
+
+func TestMain(m *testing.M) {
+	retryInterval = time.Millisecond
+	sql.Register("flaky", flaky)
+	ptest.Main(m)
+}
+
+var testTiles = []*batchmap.Tile{
+	{Path: []byte{}, RootHash: []byte("root")},
+	{Path: []byte{0x01}, RootHash: []byte("one")},
+	{Path: []byte{0x02}, RootHash: []byte("two")},
+}
+
+func TestWriteTilesRetries(t *testing.T) {
+	errBusy := sqlite3.Error{Code: sqlite3.ErrBusy}
+	for _, test := range []struct {
+		name        string
+		failCommits int
+		failErr     error
+		maxRetries  int
+
+		wantErr     bool
+		wantCommits int
+	}{
+		{
+			name:        "no failures",
+			maxRetries:  3,
+			wantCommits: 1,
+		},
+		{
+			name:        "transient failures retried",
+			failCommits: 2,
+			failErr:     errBusy,
+			maxRetries:  3,
+			wantCommits: 3,
+		},
+		{
+			name:        "too many transient failures",
+			failCommits: 5,
+			failErr:     errBusy,
+			maxRetries:  2,
+			wantErr:     true,
+			wantCommits: 3,
+		},
+		{
+			name:        "permanent failure not retried",
+			failCommits: 1,
+			failErr:     errors.New("disk on fire"),
+			maxRetries:  3,
+			wantErr:     true,
+			wantCommits: 1,
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			db := newFlakyDB(t, test.failCommits, test.failErr)
+
+			p, s := beam.NewPipelineWithRoot()
+			WriteTiles(s, "flaky", t.Name(), 1, len(testTiles), test.maxRetries, 0, false, beam.CreateList(s, testTiles))
+			err := ptest.Run(p)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("pipeline error = %v, wantErr %t", err, test.wantErr)
+			}
+
+			db.mu.Lock()
+			defer db.mu.Unlock()
+			if db.commits != test.wantCommits {
+				t.Errorf("got %d commits, want %d", db.commits, test.wantCommits)
+			}
+			wantRows := len(testTiles)
+			if test.wantErr {
+				wantRows = 0
+			}
+			if len(db.rows) != wantRows {
+				t.Errorf("got %d rows written, want %d", len(db.rows), wantRows)
+			}
+		})
+	}
+}
+
+func TestWriteTilesSQLite(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "map.db")
+	tiledb, err := mapdb.NewTileDB(location)
+	if err != nil {
+		t.Fatalf("NewTileDB(): %v", err)
+	}
+	if err := tiledb.Init(); err != nil {
+		t.Fatalf("Init(): %v", err)
+	}
+
+	for _, compress := range []bool{false, true} {
+		rev := 0
+		if compress {
+			rev = 1
+		}
+		p, s := beam.NewPipelineWithRoot()
+		// A batch size of 2 means that the writes span multiple transactions.
+		WriteTiles(s, "sqlite3", location, rev, 2, 0, 1, compress, beam.CreateList(s, testTiles))
+		if err := ptest.Run(p); err != nil {
+			t.Fatalf("pipeline failed: %v", err)
+		}
+
+		for _, want := range testTiles {
+			got, err := tiledb.Tile(rev, want.Path)
+			if err != nil {
+				t.Fatalf("Tile(%d, %x): %v", rev, want.Path, err)
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("Tile(%d, %x) diff (-want +got):\n%s", rev, want.Path, diff)
+			}
+		}
+	}
+}
+
+func TestWriteTilesConcurrency(t *testing.T) {
+	for _, concurrency := range []int{1, 2} {
+		t.Run(fmt.Sprintf("concurrency %d", concurrency), func(t *testing.T) {
+			db := newFlakyDB(t, 0, nil)
+			db.commitDelay = 10 * time.Millisecond
+
+			ctx := context.Background()
+			var wg sync.WaitGroup
+			errs := make(chan error, 5)
+			for i := 0; i < 5; i++ {
+				fn := &writeTilesFn{Driver: "flaky", DSN: t.Name(), Revision: 1, BatchSize: len(testTiles), Concurrency: concurrency}
+				if err := fn.Setup(); err != nil {
+					t.Fatalf("Setup(): %v", err)
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					defer fn.Teardown()
+					for _, tile := range testTiles {
+						if err := fn.ProcessElement(ctx, tile); err != nil {
+							errs <- err
+							return
+						}
+					}
+					errs <- fn.FinishBundle(ctx)
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				if err != nil {
+					t.Fatalf("write failed: %v", err)
+				}
+			}
+
+			db.mu.Lock()
+			defer db.mu.Unlock()
+			if got, want := len(db.rows), 5*len(testTiles); got != want {
+				t.Errorf("got %d rows written, want %d", got, want)
+			}
+			if db.maxActive > concurrency {
+				t.Errorf("got %d concurrent transactions, want at most %d", db.maxActive, concurrency)
+			}
+		})
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		want bool
+	}{
+		{err: sqlite3.Error{Code: sqlite3.ErrBusy}, want: true},
+		{err: sqlite3.Error{Code: sqlite3.ErrLocked}, want: true},
+		{err: fmt.Errorf("wrapped: %w", sqlite3.Error{Code: sqlite3.ErrBusy}), want: true},
+		{err: driver.ErrBadConn, want: true},
+		{err: sqlite3.Error{Code: sqlite3.ErrConstraint}, want: false},
+		{err: errors.New("boom"), want: false},
+	} {
+		if got := IsTransient(test.err); got != test.want {
+			t.Errorf("IsTransient(%v) = %t, want %t", test.err, got, test.want)
+		}
+	}
+}
+
+// newFlakyDB returns the fake database that will be used for connections
+// with the name of the test as the DSN. The first failCommits commits will
+// fail with failErr.
+func newFlakyDB(t *testing.T, failCommits int, failErr error) *flakyDB {
+	t.Helper()
+	db := &flakyDB{failCommits: failCommits, failErr: failErr}
+	flaky.mu.Lock()
+	defer flaky.mu.Unlock()
+	flaky.dbs[t.Name()] = db
+	return db
+}
+
+// flakyDriver is a database/sql driver for fake databases which only support
+// inserting rows, and which fail a configurable number of commits.
+type flakyDriver struct {
+	mu  sync.Mutex
+	dbs map[string]*flakyDB
+}
+
+func (d *flakyDriver) Open(name string) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	db, ok := d.dbs[name]
+	if !ok {
+		return nil, fmt.Errorf("no flaky DB named %q", name)
+	}
+	return &flakyConn{db: db}, nil
+}
+
+type flakyDB struct {
+	mu          sync.Mutex
+	failCommits int
+	failErr     error
+	commitDelay time.Duration
+	commits     int
+	rows        [][]driver.Value
+
+	// active is the number of open transactions, and maxActive the most
+	// that have been open at once.
+	active, maxActive int
+}
+
+type flakyConn struct {
+	db      *flakyDB
+	pending [][]driver.Value
+}
+
+func (c *flakyConn) Prepare(query string) (driver.Stmt, error) { return &flakyStmt{c: c}, nil }
+func (c *flakyConn) Close() error                              { return nil }
+func (c *flakyConn) Begin() (driver.Tx, error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.db.active++
+	if c.db.active > c.db.maxActive {
+		c.db.maxActive = c.db.active
+	}
+	c.pending = nil
+	return c, nil
+}
+
+func (c *flakyConn) Commit() error {
+	time.Sleep(c.db.commitDelay)
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.db.active--
+	c.db.commits++
+	if c.db.failCommits > 0 {
+		c.db.failCommits--
+		return c.db.failErr
+	}
+	c.db.rows = append(c.db.rows, c.pending...)
+	c.pending = nil
+	return nil
+}
+
+func (c *flakyConn) Rollback() error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.db.active--
+	c.pending = nil
+	return nil
+}
+
+type flakyStmt struct {
+	c *flakyConn
+}
+
+func (s *flakyStmt) Close() error  { return nil }
+func (s *flakyStmt) NumInput() int { return 3 }
+func (s *flakyStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.c.pending = append(s.c.pending, args)
+	return driver.RowsAffected(1), nil
+}
+func (s *flakyStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("query not supported")
+}
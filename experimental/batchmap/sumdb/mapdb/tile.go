@@ -0,0 +1,102 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapdb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/google/trillian/experimental/batchmap"
+)
+
+// gzipHeader is the first byte of a tile blob that contains gzipped JSON.
+// Uncompressed tiles are stored as plain JSON with no header, which is
+// compatible with databases written before compression was supported. This
+// cannot be confused with a header because JSON objects always start with '{'.
+const gzipHeader byte = 0x01
+
+// TileName returns the name used to store the tile at the given path in the
+// given revision, for stores that keep each tile as an individual object
+// rather than as a row in the map database. Tiles are named by revision and
+// the hex encoding of their path, except for the root tile which has an empty
+// path and is named "root".
+func TileName(revision int, path []byte) string {
+	if len(path) == 0 {
+		return fmt.Sprintf("%d/root", revision)
+	}
+	return fmt.Sprintf("%d/%x", revision, path)
+}
+
+// CheckpointName returns the name used to store the RevisionCheckpoint of the
+// given revision, alongside the tiles named by TileName so that it is served
+// with them. This can't collide with the name of a tile, as it isn't hex.
+func CheckpointName(revision int) string {
+	return fmt.Sprintf("%d/checkpoint", revision)
+}
+
+// RevisionCheckpoint records the SumDB checkpoint that a revision of the map
+// was built from, for stores that keep each tile as an individual object and
+// so have no revisions table. Checkpoint is the signed note as read from the
+// SumDB mirror, or empty if the input had no checkpoint, so that consumers can
+// verify its signature against the SumDB key independently of the map.
+type RevisionCheckpoint struct {
+	Revision   int
+	RootHash   []byte
+	Entries    int64
+	Checkpoint string
+}
+
+// EncodeTile serializes the tile into the format stored in the map database.
+// If compress is true then the tile will be gzipped.
+func EncodeTile(t *batchmap.Tile, compress bool) ([]byte, error) {
+	bs, err := json.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+	if !compress {
+		return bs, nil
+	}
+	var buf bytes.Buffer
+	buf.WriteByte(gzipHeader)
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(bs); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeTile parses a tile serialized by EncodeTile, whether compressed or not.
+func DecodeTile(bs []byte) (*batchmap.Tile, error) {
+	if len(bs) > 0 && bs[0] == gzipHeader {
+		zr, err := gzip.NewReader(bytes.NewReader(bs[1:]))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open gzipped tile: %v", err)
+		}
+		if bs, err = ioutil.ReadAll(zr); err != nil {
+			return nil, fmt.Errorf("failed to gunzip tile: %v", err)
+		}
+	}
+	tile := &batchmap.Tile{}
+	if err := json.Unmarshal(bs, tile); err != nil {
+		return nil, err
+	}
+	return tile, nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapdb
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/trillian/experimental/batchmap"
+)
+
+func TestTileEncoding(t *testing.T) {
+	tile := &batchmap.Tile{
+		Path:     []byte{0x12},
+		RootHash: []byte("root"),
+		Leaves: []*batchmap.TileLeaf{
+			{Path: []byte{0x34}, Hash: []byte("leaf1")},
+			{Path: []byte{0x56}, Hash: []byte("leaf2")},
+		},
+	}
+	legacy, err := json.Marshal(tile)
+	if err != nil {
+		t.Fatalf("json.Marshal(): %v", err)
+	}
+
+	for _, test := range []struct {
+		name   string
+		encode func() ([]byte, error)
+	}{
+		{
+			name:   "uncompressed",
+			encode: func() ([]byte, error) { return EncodeTile(tile, false) },
+		},
+		{
+			name:   "compressed",
+			encode: func() ([]byte, error) { return EncodeTile(tile, true) },
+		},
+		{
+			name:   "legacy",
+			encode: func() ([]byte, error) { return legacy, nil },
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			bs, err := test.encode()
+			if err != nil {
+				t.Fatalf("failed to encode: %v", err)
+			}
+			got, err := DecodeTile(bs)
+			if err != nil {
+				t.Fatalf("DecodeTile(): %v", err)
+			}
+			if diff := cmp.Diff(tile, got); diff != "" {
+				t.Errorf("tile diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDecodeTileCorrupt(t *testing.T) {
+	for _, bs := range [][]byte{
+		nil,
+		[]byte("not json"),
+		{gzipHeader, 'n', 'o', 'p', 'e'},
+	} {
+		if _, err := DecodeTile(bs); err == nil {
+			t.Errorf("DecodeTile(%x): expected error", bs)
+		}
+	}
+}
@@ -15,57 +15,218 @@
 package mapdb
 
 import (
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/google/trillian/experimental/batchmap"
 )
 
-// NoRevisionsFound is returned when the DB appears valid but has no revisions in it.
-type NoRevisionsFound = error
+// Errors returned by the methods of TileDB, wrapped with more detail. Use
+// errors.Is to check for them.
+var (
+	// ErrNoRevisions is returned when the DB appears valid but has no revisions in it.
+	ErrNoRevisions = errors.New("no revisions found")
+	// ErrRevisionNotFound is returned when the requested revision has not been written.
+	ErrRevisionNotFound = errors.New("revision not found")
+	// ErrTileNotFound is returned when there is no tile at the requested path.
+	// This is also returned by the other tile stores in the subpackages.
+	ErrTileNotFound = errors.New("tile not found")
+	// ErrNoBuildParams is returned for revisions written before build
+	// parameters were recorded.
+	ErrNoBuildParams = errors.New("no build params recorded")
+	// ErrNoBuildCounts is returned for revisions written before build
+	// counts were recorded.
+	ErrNoBuildCounts = errors.New("no build counts recorded")
+	// ErrModuleNotFound is returned when the revision has no version log for the module.
+	ErrModuleNotFound = errors.New("module not found")
+	// ErrKeyNotFound is returned when the revision has no value in its KV index for the key.
+	ErrKeyNotFound = errors.New("key not found")
+	// ErrRevisionLocked is returned when a revision has been claimed by another builder.
+	ErrRevisionLocked = errors.New("revision is locked by another builder")
+)
 
 // TileDB provides read/write access to the generated Map tiles.
 type TileDB struct {
 	db *sql.DB
+
+	mu sync.Mutex
+	// claims maps each revision claimed by ClaimRevision to the owner that
+	// was recorded for it in the buildlocks table.
+	claims map[int]string
 }
 
 // NewTileDB creates a TileDB using a file at the given location.
 // If the file doesn't exist it will be created.
+// The TileDB returned should have Close called when done.
 func NewTileDB(location string) (*TileDB, error) {
 	db, err := sql.Open("sqlite3", location)
 	if err != nil {
 		return nil, err
 	}
 	return &TileDB{
-		db: db,
+		db:     db,
+		claims: make(map[int]string),
 	}, nil
 }
 
-// Init creates the database tables if needed.
+// Close closes the underlying database, which releases the SQLite file.
+func (d *TileDB) Close() error {
+	return d.db.Close()
+}
+
+// migrations are applied in order to bring the schema of a DB up to date.
+// The schema version of a DB is the number of migrations that have been
+// applied to it. DBs created before the schema was versioned are at version 0,
+// but may already have some of the later tables and columns, so migrations
+// must be idempotent. New migrations must only ever be appended.
+var migrations = []func(tx *sql.Tx) error{
+	// 1: The baseline schema.
+	func(tx *sql.Tx) error {
+		// TODO(mhutchinson): Consider storing the entries too:
+		// CREATE TABLE IF NOT EXISTS entries (revision INTEGER, keyhash BLOB, key STRING, value STRING, PRIMARY KEY (revision, keyhash))
+		if _, err := tx.Exec("CREATE TABLE IF NOT EXISTS revisions (revision INTEGER PRIMARY KEY, datetime TIMESTAMP, logroot BLOB, count INTEGER)"); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("CREATE TABLE IF NOT EXISTS tiles (revision INTEGER, path BLOB, tile BLOB, PRIMARY KEY (revision, path))"); err != nil {
+			return err
+		}
+		_, err := tx.Exec("CREATE TABLE IF NOT EXISTS logs (module TEXT, revision INTEGER, leaves BLOB, PRIMARY KEY (module, revision))")
+		return err
+	},
+	// 2: Build parameters for each revision.
+	func(tx *sql.Tx) error {
+		_, err := tx.Exec("CREATE TABLE IF NOT EXISTS buildparams (revision INTEGER PRIMARY KEY, params BLOB)")
+		return err
+	},
+	// 3: The root hash of each revision.
+	func(tx *sql.Tx) error {
+		return addColumnIfMissing(tx, "revisions", "roothash", "BLOB")
+	},
+	// 4: The index of each revision in the commitment log.
+	func(tx *sql.Tx) error {
+		return addColumnIfMissing(tx, "revisions", "commitmentindex", "INTEGER")
+	},
+	// 5: Claims on revisions by builders.
+	func(tx *sql.Tx) error {
+		_, err := tx.Exec("CREATE TABLE IF NOT EXISTS buildlocks (revision INTEGER PRIMARY KEY, owner TEXT, datetime TIMESTAMP)")
+		return err
+	},
+	// 6: Counts of the work done by the build of each revision.
+	func(tx *sql.Tx) error {
+		_, err := tx.Exec("CREATE TABLE IF NOT EXISTS buildcounts (revision INTEGER PRIMARY KEY, counts BLOB)")
+		return err
+	},
+	// 7: The KV index of the values of the entries in each revision.
+	func(tx *sql.Tx) error {
+		_, err := tx.Exec("CREATE TABLE IF NOT EXISTS kv (revision INTEGER, map_key BLOB, value TEXT, PRIMARY KEY (revision, map_key))")
+		return err
+	},
+}
+
+// SchemaVersion is the version of the schema that this package reads and writes.
+func SchemaVersion() int {
+	return len(migrations)
+}
+
+// Init creates the database tables if needed, and migrates the schema of an
+// existing DB to SchemaVersion. It returns an error if the DB has a newer
+// schema than this package understands.
 func (d *TileDB) Init() error {
-	// TODO(mhutchinson): Consider storing the entries too:
-	// CREATE TABLE IF NOT EXISTS entries (revision INTEGER, keyhash BLOB, key STRING, value STRING, PRIMARY KEY (revision, keyhash))
+	if _, err := d.db.Exec("CREATE TABLE IF NOT EXISTS schemaversion (version INTEGER PRIMARY KEY, datetime TIMESTAMP)"); err != nil {
+		return err
+	}
+	version, err := d.schemaVersion()
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("map DB has schema version %d, but this binary only supports up to version %d", version, len(migrations))
+	}
+	for ; version < len(migrations); version++ {
+		if err := d.migrate(version); err != nil {
+			return fmt.Errorf("failed to migrate schema to version %d: %v", version+1, err)
+		}
+	}
+	return nil
+}
 
-	if _, err := d.db.Exec("CREATE TABLE IF NOT EXISTS revisions (revision INTEGER PRIMARY KEY, datetime TIMESTAMP, logroot BLOB, count INTEGER)"); err != nil {
+// schemaVersion returns the version recorded in the schemaversion table.
+func (d *TileDB) schemaVersion() (int, error) {
+	var version sql.NullInt32
+	if err := d.db.QueryRow("SELECT MAX(version) FROM schemaversion").Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to get schema version: %v", err)
+	}
+	return int(version.Int32), nil
+}
+
+// migrate applies the migration from the given version to the next one.
+func (d *TileDB) migrate(from int) error {
+	tx, err := d.db.Begin()
+	if err != nil {
 		return err
 	}
-	if _, err := d.db.Exec("CREATE TABLE IF NOT EXISTS tiles (revision INTEGER, path BLOB, tile BLOB, PRIMARY KEY (revision, path))"); err != nil {
+	defer tx.Rollback()
+	if err := migrations[from](tx); err != nil {
 		return err
 	}
-	if _, err := d.db.Exec("CREATE TABLE IF NOT EXISTS logs (module TEXT, revision INTEGER, leaves BLOB, PRIMARY KEY (module, revision))"); err != nil {
+	// Another builder may have run the same migration concurrently, which is
+	// harmless as migrations are idempotent.
+	if _, err := tx.Exec("INSERT OR IGNORE INTO schemaversion (version, datetime) VALUES (?, ?)", from+1, time.Now()); err != nil {
 		return err
 	}
-	return nil
+	return tx.Commit()
+}
+
+func addColumnIfMissing(tx *sql.Tx, table, column, colType string) error {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("failed to get columns for %s: %v", table, err)
+	}
+	var found bool
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, t string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &t, &notNull, &dflt, &pk); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan columns for %s: %v", table, err)
+		}
+		if name == column {
+			found = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return err
+	}
+	// The rows must be closed before the transaction can be used again.
+	rows.Close()
+	if found {
+		return nil
+	}
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, colType))
+	return err
 }
 
+// maxRevisionQuery selects the highest revision that has been claimed or
+// written to. Tiles may be written somewhere other than this DB, so the
+// revisions table also needs to be considered. Tiles and logs are written
+// before the revision is finalized, and revisions are claimed before either,
+// so any of these tables may contain the latest revision.
+const maxRevisionQuery = "SELECT MAX(revision) FROM (SELECT revision FROM tiles UNION ALL SELECT revision FROM logs UNION ALL SELECT revision FROM revisions UNION ALL SELECT revision FROM buildlocks)"
+
 // NextWriteRevision gets the revision that the next generation of the map should be written at.
+// Builders should claim the revision with ClaimRevision before writing to it.
 func (d *TileDB) NextWriteRevision() (int, error) {
 	var rev sql.NullInt32
-	// TODO(mhutchinson): This should be updated to include the max of "tiles" or "logs".
-	if err := d.db.QueryRow("SELECT MAX(revision) FROM tiles").Scan(&rev); err != nil {
+	if err := d.db.QueryRow(maxRevisionQuery).Scan(&rev); err != nil {
 		return 0, fmt.Errorf("failed to get max revision: %v", err)
 	}
 	if rev.Valid {
@@ -75,47 +236,453 @@ func (d *TileDB) NextWriteRevision() (int, error) {
 }
 
 // LatestRevision gets the metadata for the last completed write.
+// If no revisions have been written then ErrNoRevisions is returned.
 func (d *TileDB) LatestRevision() (rev int, logroot []byte, count int64, err error) {
 	var sqlRev sql.NullInt32
 	if err := d.db.QueryRow("SELECT revision, logroot, count FROM revisions ORDER BY revision DESC LIMIT 1").Scan(&sqlRev, &logroot, &count); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil, 0, ErrNoRevisions
+		}
 		return 0, nil, 0, fmt.Errorf("failed to get latest revision: %v", err)
 	}
 	if sqlRev.Valid {
 		return int(sqlRev.Int32), logroot, count, nil
 	}
-	return 0, nil, 0, NoRevisionsFound(errors.New("no revisions found"))
+	return 0, nil, 0, ErrNoRevisions
+}
+
+// RevisionInfo is the metadata recorded for a completed revision of the map.
+type RevisionInfo struct {
+	Revision int
+	Datetime time.Time
+	// LogRoot is the checkpoint of the input log that the revision was built from.
+	LogRoot []byte
+	// Count is the number of entries from the input log committed to by the revision.
+	Count int64
+	// RootHash is the root hash of the map. This is nil for revisions
+	// written before the root hash was recorded.
+	RootHash []byte
+	// CommitmentIndex is the index of the leaf in the commitment log that
+	// commits to this revision, or -1 if it has not been logged.
+	CommitmentIndex int64
+}
+
+// Revision gets the metadata for the given completed revision.
+// If the revision hasn't been completed then ErrRevisionNotFound is returned.
+func (d *TileDB) Revision(rev int) (*RevisionInfo, error) {
+	info := &RevisionInfo{Revision: rev, CommitmentIndex: -1}
+	var commitment sql.NullInt64
+	if err := d.db.QueryRow("SELECT datetime, logroot, count, roothash, commitmentindex FROM revisions WHERE revision=?", rev).Scan(&info.Datetime, &info.LogRoot, &info.Count, &info.RootHash, &commitment); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("%w: revision %d", ErrRevisionNotFound, rev)
+		}
+		return nil, fmt.Errorf("failed to get revision %d: %w", rev, err)
+	}
+	if commitment.Valid {
+		info.CommitmentIndex = commitment.Int64
+	}
+	return info, nil
+}
+
+// ListRevisions returns every revision that has been written, in order.
+// Revisions that were claimed but never completed are not included.
+func (d *TileDB) ListRevisions() ([]RevisionInfo, error) {
+	rows, err := d.db.Query("SELECT revision, datetime, logroot, count, roothash, commitmentindex FROM revisions ORDER BY revision")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query revisions: %v", err)
+	}
+	defer rows.Close()
+	var infos []RevisionInfo
+	for rows.Next() {
+		info := RevisionInfo{CommitmentIndex: -1}
+		var commitment sql.NullInt64
+		if err := rows.Scan(&info.Revision, &info.Datetime, &info.LogRoot, &info.Count, &info.RootHash, &commitment); err != nil {
+			return nil, fmt.Errorf("failed to scan revision: %v", err)
+		}
+		if commitment.Valid {
+			info.CommitmentIndex = commitment.Int64
+		}
+		infos = append(infos, info)
+	}
+	return infos, rows.Err()
 }
 
 // Tile gets the tile at the given path in the given revision of the map.
+// If there is no such tile then ErrTileNotFound is returned.
 func (d *TileDB) Tile(revision int, path []byte) (*batchmap.Tile, error) {
 	var bs []byte
 	if err := d.db.QueryRow("SELECT tile FROM tiles WHERE revision=? AND path=?", revision, path).Scan(&bs); err != nil {
-		return nil, err
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("%w at revision %d with path %x", ErrTileNotFound, revision, path)
+		}
+		return nil, fmt.Errorf("failed to read tile at revision %d with path %x: %w", revision, path, err)
 	}
-	tile := &batchmap.Tile{}
-	if err := json.Unmarshal(bs, tile); err != nil {
+	tile, err := DecodeTile(bs)
+	if err != nil {
 		return nil, fmt.Errorf("failed to parse tile at revision=%d, path=%x: %v", revision, path, err)
 	}
 	return tile, nil
 }
 
+// Tiles calls fn with every tile in the given revision of the map, at the given
+// depth in the tree. The depth is the length of the tile path in bytes, i.e. 0
+// is the root tile, and the leaf tiles are at the depth of the prefix strata.
+func (d *TileDB) Tiles(revision, depth int, fn func(*batchmap.Tile) error) error {
+	rows, err := d.db.Query("SELECT path, tile FROM tiles WHERE revision=? AND length(path)=?", revision, depth)
+	if err != nil {
+		return fmt.Errorf("failed to query tiles: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var path, bs []byte
+		if err := rows.Scan(&path, &bs); err != nil {
+			return fmt.Errorf("failed to scan tile: %v", err)
+		}
+		tile, err := DecodeTile(bs)
+		if err != nil {
+			return fmt.Errorf("failed to parse tile at revision=%d, path=%x: %v", revision, path, err)
+		}
+		if err := fn(tile); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// WriteTilesBatchSize is the number of tiles that WriteTiles writes in each
+// transaction.
+const WriteTilesBatchSize = 250
+
+// WriteTiles writes the tiles into the given revision of the map, in
+// transactions of up to WriteTilesBatchSize tiles. This allows tiles built
+// outside of the Beam pipeline to be stored and served in the same way. The
+// revision isn't visible to readers until it is committed with CommitRevision.
+func (d *TileDB) WriteTiles(rev int, tiles []*batchmap.Tile) error {
+	for start := 0; start < len(tiles); start += WriteTilesBatchSize {
+		end := start + WriteTilesBatchSize
+		if end > len(tiles) {
+			end = len(tiles)
+		}
+		if err := d.writeTileBatch(rev, tiles[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *TileDB) writeTileBatch(rev int, tiles []*batchmap.Tile) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare("INSERT INTO tiles (revision, path, tile) VALUES (?, ?, ?)")
+	if err != nil {
+		return fmt.Errorf("failed to prepare insert: %v", err)
+	}
+	defer stmt.Close()
+	for _, t := range tiles {
+		bs, err := EncodeTile(t, false)
+		if err != nil {
+			return fmt.Errorf("failed to encode tile at path %x: %v", t.Path, err)
+		}
+		if _, err := stmt.Exec(rev, t.Path, bs); err != nil {
+			return fmt.Errorf("failed to write tile at revision %d with path %x: %w", rev, t.Path, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// ReplaceTiles rewrites tiles in a revision that has already been written, in
+// a single transaction, replacing any tiles stored at the same paths and then
+// deleting the tiles at the paths in remove. This allows the tiles reported by
+// Verify to be repaired without writing a new revision.
+func (d *TileDB) ReplaceTiles(rev int, tiles []*batchmap.Tile, remove [][]byte) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+	for _, t := range tiles {
+		bs, err := EncodeTile(t, false)
+		if err != nil {
+			return fmt.Errorf("failed to encode tile at path %x: %v", t.Path, err)
+		}
+		if _, err := tx.Exec("INSERT OR REPLACE INTO tiles (revision, path, tile) VALUES (?, ?, ?)", rev, t.Path, bs); err != nil {
+			return fmt.Errorf("failed to write tile at revision %d with path %x: %w", rev, t.Path, err)
+		}
+	}
+	for _, path := range remove {
+		if _, err := tx.Exec("DELETE FROM tiles WHERE revision=? AND path=?", rev, path); err != nil {
+			return fmt.Errorf("failed to delete tile at revision %d with path %x: %w", rev, path, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// CommitRevision completes a revision whose tiles have been written with
+// WriteTiles, recording the log checkpoint and the number of log entries that
+// it was built from along with the root hash of its root tile. If the root tile
+// hasn't been written then an error wrapping ErrTileNotFound is returned.
+// As for WriteRevision, the revision must not have been claimed by another TileDB.
+func (d *TileDB) CommitRevision(rev int, logCheckpoint []byte, count int64) error {
+	root, err := d.Tile(rev, []byte{})
+	if err != nil {
+		return err
+	}
+	return d.WriteRevision(rev, logCheckpoint, count, root.RootHash)
+}
+
+// ClaimRevision atomically claims the given revision for this builder, so that
+// concurrent builders against the same DB don't write to the same revision.
+// The revision must be later than any revision that has already been claimed
+// or written to, which normally means it was returned by NextWriteRevision.
+// If it isn't then an error wrapping ErrRevisionLocked is returned.
+// Claims are never released, so a revision left by a failed build is skipped
+// rather than reused.
+func (d *TileDB) ClaimRevision(rev int) error {
+	owner, err := newOwner()
+	if err != nil {
+		return err
+	}
+	// This is a single statement so that checking and claiming the revision
+	// is atomic, without relying on the transaction isolation of the DB.
+	res, err := d.db.Exec("INSERT INTO buildlocks (revision, owner, datetime) SELECT ?, ?, ? WHERE ? > COALESCE(("+maxRevisionQuery+"), -1)", rev, owner, time.Now(), rev)
+	if err != nil {
+		return fmt.Errorf("failed to claim revision %d: %w", rev, err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n != 1 {
+		return d.lockedError(rev)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.claims[rev] = owner
+	return nil
+}
+
+// lockedError returns an error wrapping ErrRevisionLocked which describes
+// who holds the claim on rev, if anyone.
+func (d *TileDB) lockedError(rev int) error {
+	var owner string
+	var claimed time.Time
+	if err := d.db.QueryRow("SELECT owner, datetime FROM buildlocks WHERE revision=?", rev).Scan(&owner, &claimed); err != nil {
+		return fmt.Errorf("%w: revision %d has already been written to, or a later revision has been claimed", ErrRevisionLocked, rev)
+	}
+	return fmt.Errorf("%w: revision %d was claimed by %q at %v", ErrRevisionLocked, rev, owner, claimed)
+}
+
+// newOwner returns a string that uniquely identifies a claim on a revision,
+// which is also useful for working out which builder made it.
+func newOwner() (string, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate owner nonce: %v", err)
+	}
+	return fmt.Sprintf("%s/%d/%s", host, os.Getpid(), hex.EncodeToString(nonce)), nil
+}
+
+// RevisionOption configures the writing of a revision by WriteRevision.
+type RevisionOption func(*revisionOptions)
+
+type revisionOptions struct {
+	copyValuesFrom *int
+}
+
+// CopyValuesFrom makes WriteRevision copy the KV index of an earlier revision
+// into the revision being written, so that an incremental update only needs
+// to write the values for the new entries. This is done in the transaction
+// that writes the revision, so readers never see the revision with only part
+// of its KV index.
+func CopyValuesFrom(from int) RevisionOption {
+	return func(o *revisionOptions) {
+		o.copyValuesFrom = &from
+	}
+}
+
 // WriteRevision writes the metadata for a completed run into the database.
 // If this method isn't called then the tiles may be written but this revision will be
 // skipped by sensible readers because the provenance information isn't available.
-func (d *TileDB) WriteRevision(rev int, logCheckpoint []byte, count int64) error {
-	now := time.Now()
-	_, err := d.db.Exec("INSERT INTO revisions (revision, datetime, logroot, count) VALUES (?, ?, ?, ?)", rev, now, logCheckpoint, count)
+// If the revision has been claimed then it must have been claimed by this
+// TileDB, otherwise an error wrapping ErrRevisionLocked is returned.
+func (d *TileDB) WriteRevision(rev int, logCheckpoint []byte, count int64, rootHash []byte, opts ...RevisionOption) error {
+	var o revisionOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	d.mu.Lock()
+	want, claimed := d.claims[rev]
+	d.mu.Unlock()
+
+	tx, err := d.db.Begin()
 	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+	var owner string
+	switch err := tx.QueryRow("SELECT owner FROM buildlocks WHERE revision=?", rev).Scan(&owner); {
+	case errors.Is(err, sql.ErrNoRows):
+		if claimed {
+			return fmt.Errorf("%w: claim on revision %d has been removed", ErrRevisionLocked, rev)
+		}
+	case err != nil:
+		return fmt.Errorf("failed to check claim on revision %d: %v", rev, err)
+	case owner != want:
+		return fmt.Errorf("%w: revision %d is claimed by %q", ErrRevisionLocked, rev, owner)
+	}
+	if from := o.copyValuesFrom; from != nil {
+		if _, err := tx.Exec("INSERT INTO kv (revision, map_key, value) SELECT ?, map_key, value FROM kv WHERE revision=?", rev, *from); err != nil {
+			return fmt.Errorf("failed to copy KV index from revision %d to %d: %w", *from, rev, err)
+		}
+	}
+	now := time.Now()
+	if _, err := tx.Exec("INSERT INTO revisions (revision, datetime, logroot, count, roothash) VALUES (?, ?, ?, ?, ?)", rev, now, logCheckpoint, count, rootHash); err != nil {
 		return fmt.Errorf("failed to write revision: %w", err)
 	}
+	return tx.Commit()
+}
+
+// WriteCommitment records the index of the leaf in the commitment log that
+// commits to the given revision.
+func (d *TileDB) WriteCommitment(rev int, index int64) error {
+	res, err := d.db.Exec("UPDATE revisions SET commitmentindex=? WHERE revision=?", index, rev)
+	if err != nil {
+		return fmt.Errorf("failed to write commitment: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n != 1 {
+		return fmt.Errorf("%w: revision %d", ErrRevisionNotFound, rev)
+	}
+	return nil
+}
+
+// BuildParams are the configuration parameters that a map revision was built with.
+// Any revision created by incrementally updating another revision must have been
+// built with the same parameters, or the resulting map will be corrupt.
+type BuildParams struct {
+	TreeID       int64
+	PrefixStrata int
+	// StratumBits is the height of each stratum of tiles, or 0 for revisions
+	// written before this was recorded, which all had 8-bit strata.
+	StratumBits int
+	Hash        string
+	// VersionList is true if the revision contains the module version logs.
+	VersionList bool
+	// ModuleFilter is the regular expression that modules had to match to be
+	// included in the map, or empty if the map contains all modules.
+	ModuleFilter string
+	// KeyDomain is mixed into the derivation of every key in the map, or
+	// empty if the keys are derived from the module and version alone.
+	KeyDomain string
+	// LatestIndex is true if the revision contains the latest version of
+	// each module.
+	LatestIndex bool
+	// KVIndex is true if the values of the module version entries in the
+	// revision were written to the KV index.
+	KVIndex bool
+}
+
+// WriteBuildParams records the parameters used to build the given revision.
+func (d *TileDB) WriteBuildParams(rev int, params BuildParams) error {
+	bs, err := json.Marshal(params)
+	if err != nil {
+		return fmt.Errorf("failed to marshal build params: %v", err)
+	}
+	if _, err := d.db.Exec("INSERT INTO buildparams (revision, params) VALUES (?, ?)", rev, bs); err != nil {
+		return fmt.Errorf("failed to write build params: %w", err)
+	}
+	return nil
+}
+
+// BuildParams gets the parameters that the given revision was built with.
+// Revisions written before parameters were recorded will return ErrNoBuildParams.
+func (d *TileDB) BuildParams(rev int) (*BuildParams, error) {
+	var bs []byte
+	if err := d.db.QueryRow("SELECT params FROM buildparams WHERE revision=?", rev).Scan(&bs); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("%w for revision %d", ErrNoBuildParams, rev)
+		}
+		return nil, fmt.Errorf("failed to read build params for revision %d: %w", rev, err)
+	}
+	params := &BuildParams{}
+	if err := json.Unmarshal(bs, params); err != nil {
+		return nil, fmt.Errorf("failed to parse build params at revision=%d: %v", rev, err)
+	}
+	return params, nil
+}
+
+// BuildCounts are the counts of the work done by the build of a map revision.
+// A count is -1 if it isn't known.
+type BuildCounts struct {
+	// Records is the number of SumDB entries read by the build.
+	Records int64
+	// Entries is the number of map entries created from the records.
+	Entries int64
+	// Tiles is the number of tiles written for the revision.
+	Tiles int64
+	// SkippedVersionLogs is the number of modules left out of the version
+	// list because their logs couldn't be built. If this isn't 0 then the
+	// version list of the revision is incomplete.
+	SkippedVersionLogs int64
+	// Source is where the counts came from: "metrics" if they were reported
+	// by the pipeline runner, or "map_db" if the runner doesn't report metrics
+	// and they were derived from the map DB instead.
+	Source string
+}
+
+// WriteBuildCounts records the counts of the work done to build the given revision.
+func (d *TileDB) WriteBuildCounts(rev int, counts BuildCounts) error {
+	bs, err := json.Marshal(counts)
+	if err != nil {
+		return fmt.Errorf("failed to marshal build counts: %v", err)
+	}
+	if _, err := d.db.Exec("INSERT INTO buildcounts (revision, counts) VALUES (?, ?)", rev, bs); err != nil {
+		return fmt.Errorf("failed to write build counts: %w", err)
+	}
 	return nil
 }
 
+// BuildCounts gets the counts of the work done to build the given revision.
+// Revisions written before counts were recorded will return ErrNoBuildCounts.
+func (d *TileDB) BuildCounts(rev int) (*BuildCounts, error) {
+	var bs []byte
+	if err := d.db.QueryRow("SELECT counts FROM buildcounts WHERE revision=?", rev).Scan(&bs); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("%w for revision %d", ErrNoBuildCounts, rev)
+		}
+		return nil, fmt.Errorf("failed to read build counts for revision %d: %w", rev, err)
+	}
+	counts := &BuildCounts{}
+	if err := json.Unmarshal(bs, counts); err != nil {
+		return nil, fmt.Errorf("failed to parse build counts at revision=%d: %v", rev, err)
+	}
+	return counts, nil
+}
+
+// CountTiles returns the number of tiles in the given revision of the map.
+func (d *TileDB) CountTiles(rev int) (int64, error) {
+	var n int64
+	if err := d.db.QueryRow("SELECT COUNT(*) FROM tiles WHERE revision=?", rev).Scan(&n); err != nil {
+		return 0, fmt.Errorf("failed to count tiles for revision %d: %w", rev, err)
+	}
+	return n, nil
+}
+
 // Versions gets the log of versions for the given module in the given map revision.
+// If there is no log for the module then ErrModuleNotFound is returned.
 func (d *TileDB) Versions(revision int, module string) ([]string, error) {
 	var bs []byte
 	if err := d.db.QueryRow("SELECT leaves FROM logs WHERE revision=? AND module=?", revision, module).Scan(&bs); err != nil {
-		return nil, err
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("%w: no version log for %q at revision %d", ErrModuleNotFound, module, revision)
+		}
+		return nil, fmt.Errorf("failed to read version log for %q at revision %d: %w", module, revision, err)
 	}
 	var versions []string
 	if err := json.Unmarshal(bs, &versions); err != nil {
@@ -123,3 +690,20 @@ func (d *TileDB) Versions(revision int, module string) ([]string, error) {
 	}
 	return versions, nil
 }
+
+// Value gets the value stored under the key in the KV index of the given map
+// revision, i.e. the preimage of the leaf hash for the key in the map. This
+// avoids walking the tiles to find the value, but a proof for it must still be
+// computed from the tiles if it is to be verified.
+// If there is no value for the key then ErrKeyNotFound is returned, which is
+// always the case for revisions built without the KV index.
+func (d *TileDB) Value(revision int, key []byte) (string, error) {
+	var value string
+	if err := d.db.QueryRow("SELECT value FROM kv WHERE revision=? AND map_key=?", revision, key).Scan(&value); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", fmt.Errorf("%w: no value for %x at revision %d", ErrKeyNotFound, key, revision)
+		}
+		return "", fmt.Errorf("failed to read value for %x at revision %d: %w", key, revision, err)
+	}
+	return value, nil
+}
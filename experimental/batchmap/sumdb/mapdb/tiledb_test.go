@@ -0,0 +1,395 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapdb
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/google/trillian/experimental/batchmap"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func newTestTileDB(t *testing.T, location string) *TileDB {
+	t.Helper()
+	tiledb, err := NewTileDB(location)
+	if err != nil {
+		t.Fatalf("NewTileDB(): %v", err)
+	}
+	if err := tiledb.Init(); err != nil {
+		t.Fatalf("Init(): %v", err)
+	}
+	return tiledb
+}
+
+func TestClaimRevisionRace(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "map.db")
+	newTestTileDB(t, location)
+
+	const builders = 2
+	dbs := make([]*TileDB, builders)
+	for i := range dbs {
+		dbs[i] = newTestTileDB(t, location)
+	}
+	// Both builders see the same next revision before either claims it,
+	// which is the race that claiming has to resolve.
+	var rev int
+	for i := range dbs {
+		var err error
+		if rev, err = dbs[i].NextWriteRevision(); err != nil || rev != 0 {
+			t.Fatalf("NextWriteRevision() = %d, %v; want 0, nil", rev, err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, builders)
+	start := make(chan struct{})
+	for i := range dbs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			errs[i] = dbs[i].ClaimRevision(rev)
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	var winners int
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			winners++
+		case errors.Is(err, ErrRevisionLocked):
+		default:
+			t.Errorf("builder %d got unexpected error: %v", i, err)
+		}
+	}
+	if winners != 1 {
+		t.Fatalf("got %d builders claiming a revision, want 1 (errors: %v)", winners, errs)
+	}
+}
+
+func TestClaimRevision(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "map.db")
+	owner := newTestTileDB(t, location)
+	other := newTestTileDB(t, location)
+
+	if err := owner.ClaimRevision(0); err != nil {
+		t.Fatalf("ClaimRevision(0): %v", err)
+	}
+	if err := other.ClaimRevision(0); !errors.Is(err, ErrRevisionLocked) {
+		t.Errorf("ClaimRevision(0) on claimed revision: got %v, want ErrRevisionLocked", err)
+	}
+	if rev, err := other.NextWriteRevision(); err != nil || rev != 1 {
+		t.Errorf("NextWriteRevision() with revision 0 claimed = %d, %v; want 1, nil", rev, err)
+	}
+
+	if err := other.WriteRevision(0, []byte("checkpoint"), 10, []byte("root")); !errors.Is(err, ErrRevisionLocked) {
+		t.Errorf("WriteRevision(0) by non-owner: got %v, want ErrRevisionLocked", err)
+	}
+	if err := owner.WriteRevision(0, []byte("checkpoint"), 10, []byte("root")); err != nil {
+		t.Fatalf("WriteRevision(0) by owner: %v", err)
+	}
+
+	// Claims are kept once the revision is written, so a builder that read
+	// the next revision before it was written still can't claim it.
+	if err := other.ClaimRevision(0); !errors.Is(err, ErrRevisionLocked) {
+		t.Errorf("ClaimRevision(0) on written revision: got %v, want ErrRevisionLocked", err)
+	}
+	if err := other.ClaimRevision(1); err != nil {
+		t.Errorf("ClaimRevision(1): %v", err)
+	}
+}
+
+func TestInitMigratesOldDB(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "map.db")
+	// Create a DB with the schema used before the schema was versioned, or
+	// the root hash of each revision was recorded.
+	db, err := sql.Open("sqlite3", location)
+	if err != nil {
+		t.Fatalf("sql.Open(): %v", err)
+	}
+	for _, stmt := range []string{
+		"CREATE TABLE revisions (revision INTEGER PRIMARY KEY, datetime TIMESTAMP, logroot BLOB, count INTEGER)",
+		"CREATE TABLE tiles (revision INTEGER, path BLOB, tile BLOB, PRIMARY KEY (revision, path))",
+		"CREATE TABLE logs (module TEXT, revision INTEGER, leaves BLOB, PRIMARY KEY (module, revision))",
+		"INSERT INTO revisions (revision, datetime, logroot, count) VALUES (0, CURRENT_TIMESTAMP, 'checkpoint', 10)",
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("Exec(%q): %v", stmt, err)
+		}
+	}
+	db.Close()
+
+	tiledb := newTestTileDB(t, location)
+	if got, err := tiledb.schemaVersion(); err != nil || got != SchemaVersion() {
+		t.Fatalf("schemaVersion() = %d, %v; want %d, nil", got, err, SchemaVersion())
+	}
+	// Init must be safe to run again on an up to date DB.
+	if err := tiledb.Init(); err != nil {
+		t.Fatalf("second Init(): %v", err)
+	}
+
+	// The existing revision is kept, and the migrated schema can be written to.
+	info, err := tiledb.Revision(0)
+	if err != nil {
+		t.Fatalf("Revision(0): %v", err)
+	}
+	if info.Count != 10 || info.RootHash != nil || info.CommitmentIndex != -1 {
+		t.Errorf("Revision(0) = %+v, want count 10 with no root hash or commitment", info)
+	}
+	if err := tiledb.ClaimRevision(1); err != nil {
+		t.Fatalf("ClaimRevision(1): %v", err)
+	}
+	if err := tiledb.WriteRevision(1, []byte("checkpoint"), 20, []byte("root")); err != nil {
+		t.Fatalf("WriteRevision(1): %v", err)
+	}
+	if err := tiledb.WriteCommitment(1, 7); err != nil {
+		t.Fatalf("WriteCommitment(1): %v", err)
+	}
+	if err := tiledb.WriteBuildParams(1, BuildParams{TreeID: 1}); err != nil {
+		t.Fatalf("WriteBuildParams(1): %v", err)
+	}
+	if info, err := tiledb.Revision(1); err != nil || !bytes.Equal(info.RootHash, []byte("root")) || info.CommitmentIndex != 7 {
+		t.Errorf("Revision(1) = %+v, %v; want root hash and commitment index 7", info, err)
+	}
+}
+
+func TestInitRefusesNewerSchema(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "map.db")
+	tiledb := newTestTileDB(t, location)
+	if _, err := tiledb.db.Exec("INSERT INTO schemaversion (version) VALUES (?)", SchemaVersion()+1); err != nil {
+		t.Fatalf("failed to bump schema version: %v", err)
+	}
+	if err := tiledb.Init(); err == nil {
+		t.Error("Init() on DB with newer schema: expected error")
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tiledb := newTestTileDB(t, filepath.Join(t.TempDir(), "map.db"))
+	if _, _, _, err := tiledb.LatestRevision(); !errors.Is(err, ErrNoRevisions) {
+		t.Errorf("LatestRevision() on empty DB = %v, want %v", err, ErrNoRevisions)
+	}
+	if err := tiledb.ClaimRevision(0); err != nil {
+		t.Fatalf("ClaimRevision(): %v", err)
+	}
+	if err := tiledb.WriteRevision(0, []byte("checkpoint"), 10, []byte("root")); err != nil {
+		t.Fatalf("WriteRevision(): %v", err)
+	}
+
+	for _, test := range []struct {
+		name string
+		err  error
+		want error
+	}{
+		{name: "Revision", err: errOnly(tiledb.Revision(1)), want: ErrRevisionNotFound},
+		{name: "WriteCommitment", err: tiledb.WriteCommitment(1, 0), want: ErrRevisionNotFound},
+		{name: "Tile", err: errOnly(tiledb.Tile(0, []byte{0x01})), want: ErrTileNotFound},
+		{name: "BuildParams", err: errOnly(tiledb.BuildParams(0)), want: ErrNoBuildParams},
+		{name: "BuildCounts", err: errOnly(tiledb.BuildCounts(0)), want: ErrNoBuildCounts},
+		{name: "Versions", err: errOnly(tiledb.Versions(0, "example.com/foo")), want: ErrModuleNotFound},
+		{name: "Value", err: errOnly(tiledb.Value(0, []byte("key"))), want: ErrKeyNotFound},
+	} {
+		if !errors.Is(test.err, test.want) {
+			t.Errorf("%s() = %v, want %v", test.name, test.err, test.want)
+		}
+	}
+}
+
+func TestBuildCounts(t *testing.T) {
+	tiledb := newTestTileDB(t, filepath.Join(t.TempDir(), "map.db"))
+	for _, path := range []string{"", "\x01", "\x02"} {
+		if _, err := tiledb.db.Exec("INSERT INTO tiles (revision, path, tile) VALUES (?, ?, ?)", 1, []byte(path), []byte("{}")); err != nil {
+			t.Fatalf("failed to write tile: %v", err)
+		}
+	}
+	for rev, want := range []int64{0, 3} {
+		if got, err := tiledb.CountTiles(rev); err != nil || got != want {
+			t.Errorf("CountTiles(%d) = %d, %v; want %d, nil", rev, got, err, want)
+		}
+	}
+
+	want := BuildCounts{Records: 10, Entries: -1, Tiles: 3, Source: "map_db"}
+	if err := tiledb.WriteBuildCounts(1, want); err != nil {
+		t.Fatalf("WriteBuildCounts(): %v", err)
+	}
+	if got, err := tiledb.BuildCounts(1); err != nil || *got != want {
+		t.Errorf("BuildCounts(1) = %+v, %v; want %+v, nil", got, err, want)
+	}
+}
+
+func TestWriteTilesAndCommitRevision(t *testing.T) {
+	tiledb := newTestTileDB(t, filepath.Join(t.TempDir(), "map.db"))
+	// Enough tiles to need more than one batch.
+	tiles := []*batchmap.Tile{{Path: []byte{}, RootHash: []byte("root")}}
+	for i := 0; i < WriteTilesBatchSize; i++ {
+		tiles = append(tiles, &batchmap.Tile{Path: []byte{byte(i)}, RootHash: []byte{byte(i)}})
+	}
+	if err := tiledb.CommitRevision(0, []byte("checkpoint"), 10); !errors.Is(err, ErrTileNotFound) {
+		t.Errorf("CommitRevision() before WriteTiles() = %v, want %v", err, ErrTileNotFound)
+	}
+	if err := tiledb.WriteTiles(0, tiles); err != nil {
+		t.Fatalf("WriteTiles(): %v", err)
+	}
+	if got, err := tiledb.CountTiles(0); err != nil || got != int64(len(tiles)) {
+		t.Errorf("CountTiles() = %d, %v; want %d, nil", got, err, len(tiles))
+	}
+	if got, err := tiledb.Tile(0, []byte{7}); err != nil || !reflect.DeepEqual(got, tiles[8]) {
+		t.Errorf("Tile(0, 07) = %+v, %v; want %+v, nil", got, err, tiles[8])
+	}
+	if _, _, _, err := tiledb.LatestRevision(); !errors.Is(err, ErrNoRevisions) {
+		t.Errorf("LatestRevision() before CommitRevision() = %v, want %v", err, ErrNoRevisions)
+	}
+
+	if err := tiledb.CommitRevision(0, []byte("checkpoint"), 10); err != nil {
+		t.Fatalf("CommitRevision(): %v", err)
+	}
+	info, err := tiledb.Revision(0)
+	if err != nil {
+		t.Fatalf("Revision(0): %v", err)
+	}
+	if !bytes.Equal(info.LogRoot, []byte("checkpoint")) || info.Count != 10 || !bytes.Equal(info.RootHash, []byte("root")) {
+		t.Errorf("Revision(0) = %+v, want checkpoint, count 10 and root hash from the root tile", info)
+	}
+	// Tiles can't be written twice.
+	if err := tiledb.WriteTiles(0, tiles[:1]); err == nil {
+		t.Error("WriteTiles() of existing tile: expected error")
+	}
+}
+
+func TestValues(t *testing.T) {
+	tiledb := newTestTileDB(t, filepath.Join(t.TempDir(), "map.db"))
+	for _, row := range []struct {
+		rev   int
+		key   string
+		value string
+	}{
+		{rev: 0, key: "a", value: "h1:a"},
+		{rev: 0, key: "b", value: "h1:b"},
+		{rev: 1, key: "c", value: "h1:c"},
+	} {
+		if _, err := tiledb.db.Exec("INSERT INTO kv (revision, map_key, value) VALUES (?, ?, ?)", row.rev, []byte(row.key), row.value); err != nil {
+			t.Fatalf("failed to write value: %v", err)
+		}
+	}
+	if err := tiledb.WriteRevision(1, []byte("checkpoint"), 20, []byte("root"), CopyValuesFrom(0)); err != nil {
+		t.Fatalf("WriteRevision(1) copying values from 0: %v", err)
+	}
+	// If the revision can't be written then its values aren't copied either.
+	if _, err := tiledb.db.Exec("INSERT INTO revisions (revision) VALUES (2)"); err != nil {
+		t.Fatalf("failed to write revision: %v", err)
+	}
+	if err := tiledb.WriteRevision(2, []byte("checkpoint"), 30, []byte("root"), CopyValuesFrom(0)); err == nil {
+		t.Fatal("WriteRevision(2) over existing revision: expected error")
+	}
+
+	for _, test := range []struct {
+		rev     int
+		key     string
+		want    string
+		wantErr error
+	}{
+		{rev: 1, key: "a", want: "h1:a"},
+		{rev: 1, key: "c", want: "h1:c"},
+		{rev: 0, key: "c", wantErr: ErrKeyNotFound},
+		{rev: 2, key: "a", wantErr: ErrKeyNotFound},
+	} {
+		got, err := tiledb.Value(test.rev, []byte(test.key))
+		if !errors.Is(err, test.wantErr) || got != test.want {
+			t.Errorf("Value(%d, %q) = %q, %v; want %q, %v", test.rev, test.key, got, err, test.want, test.wantErr)
+		}
+	}
+}
+
+func TestListRevisions(t *testing.T) {
+	tiledb := newTestTileDB(t, filepath.Join(t.TempDir(), "map.db"))
+	if revs, err := tiledb.ListRevisions(); err != nil || len(revs) != 0 {
+		t.Errorf("ListRevisions() on empty DB = %v, %v; want none", revs, err)
+	}
+	for rev := 0; rev < 3; rev++ {
+		if err := tiledb.ClaimRevision(rev); err != nil {
+			t.Fatalf("ClaimRevision(%d): %v", rev, err)
+		}
+		// Revision 1 is left incomplete, as by a failed build.
+		if rev == 1 {
+			continue
+		}
+		if err := tiledb.WriteRevision(rev, []byte(fmt.Sprintf("checkpoint %d", rev)), int64(10*(rev+1)), []byte{byte(rev)}); err != nil {
+			t.Fatalf("WriteRevision(%d): %v", rev, err)
+		}
+	}
+	if err := tiledb.WriteCommitment(2, 7); err != nil {
+		t.Fatalf("WriteCommitment(): %v", err)
+	}
+
+	revs, err := tiledb.ListRevisions()
+	if err != nil {
+		t.Fatalf("ListRevisions(): %v", err)
+	}
+	if len(revs) != 2 {
+		t.Fatalf("ListRevisions() returned %d revisions, want 2", len(revs))
+	}
+	for i, want := range []RevisionInfo{
+		{Revision: 0, LogRoot: []byte("checkpoint 0"), Count: 10, RootHash: []byte{0}, CommitmentIndex: -1},
+		{Revision: 2, LogRoot: []byte("checkpoint 2"), Count: 30, RootHash: []byte{2}, CommitmentIndex: 7},
+	} {
+		got := revs[i]
+		if got.Datetime.IsZero() {
+			t.Errorf("revision %d has no datetime", got.Revision)
+		}
+		got.Datetime = want.Datetime
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("ListRevisions()[%d] = %+v, want %+v", i, got, want)
+		}
+	}
+}
+
+func TestCloseReleasesFiles(t *testing.T) {
+	openFiles := func() int {
+		t.Helper()
+		fds, err := ioutil.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Skipf("can't count open files: %v", err)
+		}
+		return len(fds)
+	}
+	location := filepath.Join(t.TempDir(), "map.db")
+	before := openFiles()
+	for i := 0; i < 100; i++ {
+		tiledb := newTestTileDB(t, location)
+		if _, err := tiledb.NextWriteRevision(); err != nil {
+			t.Fatalf("NextWriteRevision(): %v", err)
+		}
+		if err := tiledb.Close(); err != nil {
+			t.Fatalf("Close(): %v", err)
+		}
+	}
+	if after := openFiles(); after > before {
+		t.Errorf("%d files open after opening and closing the DB repeatedly, want %d", after, before)
+	}
+}
+
+func errOnly(_ interface{}, err error) error {
+	return err
+}
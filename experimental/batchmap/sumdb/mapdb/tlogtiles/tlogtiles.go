@@ -0,0 +1,154 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tlogtiles writes map tiles as static files in the tile/H/L/NNN
+// layout used by SumDB (see golang.org/x/mod/sumdb/tlog), so that they can
+// be served and fetched using the same conventions.
+//
+// The map is a sparse Merkle tree of depth 256 where each prefix stratum is
+// 8 levels high, which matches tiles of height 8. A prefix tile with a path
+// of d bytes holds the 256 hashes of its children, which are at height
+// 8*(31-d) above the leaves, so it is written as the full tlog tile at level
+// 31-d with index equal to its path read as a big-endian integer. Children
+// that are absent from the sparse tile are filled with the hash of the empty
+// subtree, so every hash tile is complete.
+//
+// There are some gaps between the two models:
+//   - The final stratum is much taller than 8 levels, so it can't be laid
+//     out as hash tiles. Instead each final stratum tile is written as the
+//     data tile (tile/8/data/NNN) for its path, containing the JSON encoding
+//     of the batchmap.Tile as stored by mapdb.
+//   - Hashes are computed with the CONIKS hasher used by the map rather
+//     than the RFC 6962 hashing used by tlog, so generic tlog clients can
+//     fetch the tiles but can't use tlog to verify them.
+//   - As in any sparse Merkle tree, a node whose children are both empty has
+//     the empty hash for its position rather than the hash of its children,
+//     so recomputing the root of a tile needs to know the empty hashes.
+//   - The root hash of the map is not in any tile, just as the tree hash
+//     of a log isn't; it is recorded with the revision in the map DB.
+//   - Tile indices are int64s, so the map can have at most 7 prefix strata.
+package tlogtiles
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/google/trillian/experimental/batchmap"
+	"github.com/google/trillian/merkle/coniks"
+	"github.com/google/trillian/merkle/smt/node"
+	"golang.org/x/mod/sumdb/tlog"
+
+	"github.com/google/trillian-examples/experimental/batchmap/sumdb/mapdb"
+)
+
+// Height is the height of the tiles, which is the height of a prefix stratum.
+const Height = 8
+
+// MaxPrefixStrata is the largest number of prefix strata that the layout supports.
+const MaxPrefixStrata = 7
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*writeTileFn)(nil)).Elem())
+}
+
+// WriteTiles writes each *batchmap.Tile in the PCollection to the file for its
+// tlog tile under <dir>/<revision>/. The map must have been built with the
+// given tree ID and number of prefix strata.
+func WriteTiles(s beam.Scope, dir string, revision int, treeID int64, prefixStrata int, tiles beam.PCollection) error {
+	if prefixStrata < 0 || prefixStrata > MaxPrefixStrata {
+		return fmt.Errorf("prefix strata must be in range [0, %d], got %d", MaxPrefixStrata, prefixStrata)
+	}
+	beam.ParDo0(s.Scope("tlogtiles.WriteTiles"), &writeTileFn{
+		Dir:          filepath.Join(dir, strconv.Itoa(revision)),
+		TreeID:       treeID,
+		PrefixStrata: prefixStrata,
+	}, tiles)
+	return nil
+}
+
+// TileFor returns the tlog tile that the map tile at the given path is
+// written as. This is a data tile for tiles in the final stratum, and a
+// hash tile otherwise.
+func TileFor(path []byte, prefixStrata int) (tlog.Tile, error) {
+	d := len(path)
+	if d > prefixStrata || prefixStrata > MaxPrefixStrata {
+		return tlog.Tile{}, fmt.Errorf("no tile for path %x with %d prefix strata", path, prefixStrata)
+	}
+	t := tlog.Tile{H: Height, L: 31 - d, N: new(big.Int).SetBytes(path).Int64(), W: 1 << Height}
+	if d == prefixStrata {
+		t.L = -1
+	}
+	return t, nil
+}
+
+// HashTile returns the contents of the hash tile for a map tile in one of
+// the prefix strata: the hashes of its 256 children in order, with the hash
+// of the empty subtree for each child that isn't present.
+func HashTile(t *batchmap.Tile, treeID int64) ([]byte, error) {
+	hashes := make([][]byte, 1<<Height)
+	for _, l := range t.Leaves {
+		if len(l.Path) != 1 {
+			return nil, fmt.Errorf("tile %x has leaf with path %x, which is not in a prefix stratum", t.Path, l.Path)
+		}
+		hashes[l.Path[0]] = l.Hash
+	}
+	data := make([]byte, 0, len(hashes)*tlog.HashSize)
+	for i, h := range hashes {
+		if h == nil {
+			child := append(append([]byte{}, t.Path...), byte(i))
+			h = coniks.Default.HashEmpty(treeID, node.NewID(string(child), uint(len(child)*8)))
+		}
+		if len(h) != tlog.HashSize {
+			return nil, fmt.Errorf("tile %x has hash of length %d for child %d, want %d", t.Path, len(h), i, tlog.HashSize)
+		}
+		data = append(data, h...)
+	}
+	return data, nil
+}
+
+type writeTileFn struct {
+	Dir          string
+	TreeID       int64
+	PrefixStrata int
+}
+
+func (fn *writeTileFn) ProcessElement(t *batchmap.Tile) error {
+	tile, err := TileFor(t.Path, fn.PrefixStrata)
+	if err != nil {
+		return err
+	}
+	var data []byte
+	if tile.L == -1 {
+		data, err = mapdb.EncodeTile(t, false)
+	} else {
+		data, err = HashTile(t, fn.TreeID)
+	}
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(fn.Dir, filepath.FromSlash(tile.Path()))
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(name, data, 0644); err != nil {
+		return fmt.Errorf("failed to write %q: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tlogtiles
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/testing/ptest"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/trillian/experimental/batchmap"
+	"github.com/google/trillian/merkle/coniks"
+	"github.com/google/trillian/merkle/smt/node"
+	"golang.org/x/mod/sumdb/tlog"
+
+	"github.com/google/trillian-examples/experimental/batchmap/sumdb/mapdb"
+	"github.com/google/trillian-examples/experimental/batchmap/sumdb/mapdb/files"
+)
+
+const treeID = 12345
+
+func TestMain(m *testing.M) {
+	ptest.Main(m)
+}
+
+func TestTileFor(t *testing.T) {
+	for _, test := range []struct {
+		path         []byte
+		prefixStrata int
+		want         string
+		wantErr      bool
+	}{
+		{path: []byte{}, prefixStrata: 2, want: "tile/8/31/000"},
+		{path: []byte{0x01, 0x02}, prefixStrata: 3, want: "tile/8/29/258"},
+		{path: []byte{0x01, 0x02}, prefixStrata: 2, want: "tile/8/data/258"},
+		{path: []byte{}, prefixStrata: 0, want: "tile/8/data/000"},
+		{path: []byte{0x01, 0x02, 0x03}, prefixStrata: 2, wantErr: true},
+		{path: []byte{}, prefixStrata: 8, wantErr: true},
+	} {
+		got, err := TileFor(test.path, test.prefixStrata)
+		if gotErr := err != nil; gotErr != test.wantErr {
+			t.Errorf("TileFor(%x, %d) = %v, wantErr %t", test.path, test.prefixStrata, err, test.wantErr)
+			continue
+		}
+		if err == nil && got.Path() != test.want {
+			t.Errorf("TileFor(%x, %d).Path() = %q, want %q", test.path, test.prefixStrata, got.Path(), test.want)
+		}
+	}
+}
+
+func TestWriteTiles(t *testing.T) {
+	tlogDir, filesDir := t.TempDir(), t.TempDir()
+	var entries []*batchmap.Entry
+	for i := 0; i < 50; i++ {
+		key := sha256.Sum256([]byte(fmt.Sprintf("key %d", i)))
+		leafID := node.NewID(string(key[:]), uint(len(key)*8))
+		entries = append(entries, &batchmap.Entry{
+			HashKey:   key[:],
+			HashValue: coniks.Default.HashLeaf(treeID, leafID, []byte(fmt.Sprintf("value %d", i))),
+		})
+	}
+
+	p, s := beam.NewPipelineWithRoot()
+	tiles, err := batchmap.Create(s, beam.CreateList(s, entries), treeID, crypto.SHA512_256, 1)
+	if err != nil {
+		t.Fatalf("failed to create pipeline: %v", err)
+	}
+	if err := WriteTiles(s, tlogDir, 0, treeID, 1, tiles); err != nil {
+		t.Fatalf("WriteTiles(): %v", err)
+	}
+	files.WriteTiles(s, filesDir, 0, tiles)
+	if err := ptest.Run(p); err != nil {
+		t.Fatalf("pipeline failed: %v", err)
+	}
+	ts := files.NewTileStore(filesDir)
+
+	root, err := ts.Tile(0, []byte{})
+	if err != nil {
+		t.Fatalf("failed to read root tile: %v", err)
+	}
+	data := readTile(t, tlogDir, tlog.Tile{H: Height, L: 31, N: 0, W: 1 << Height})
+	if got, want := len(data), (1<<Height)*tlog.HashSize; got != want {
+		t.Fatalf("got root hash tile of %d bytes, want %d", got, want)
+	}
+	// The root of the map must be derivable from the hash tile.
+	var hashes [][]byte
+	for i := 0; i < len(data); i += tlog.HashSize {
+		hashes = append(hashes, data[i:i+tlog.HashSize])
+	}
+	if got := subtreeRoot(hashes, nil, 0); !bytes.Equal(got, root.RootHash) {
+		t.Errorf("root computed from hash tile = %x, want %x", got, root.RootHash)
+	}
+
+	// Each child of the root is in the final stratum, so is a data tile.
+	for _, l := range root.Leaves {
+		want, err := ts.Tile(0, l.Path)
+		if err != nil {
+			t.Fatalf("failed to read tile %x: %v", l.Path, err)
+		}
+		got, err := mapdb.DecodeTile(readTile(t, tlogDir, tlog.Tile{H: Height, L: -1, N: int64(l.Path[0]), W: 1 << Height}))
+		if err != nil {
+			t.Fatalf("failed to decode data tile %x: %v", l.Path, err)
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("data tile %x diff (-want +got):\n%s", l.Path, diff)
+		}
+	}
+}
+
+func readTile(t *testing.T, dir string, tile tlog.Tile) []byte {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join(dir, "0", filepath.FromSlash(tile.Path())))
+	if err != nil {
+		t.Fatalf("failed to read tile %v: %v", tile, err)
+	}
+	return data
+}
+
+// subtreeRoot computes the root of the subtree at the given path and depth
+// within a tile from the hashes at the bottom of the tile, which are those
+// below the path. As in the sparse Merkle tree, a node with two empty
+// children is itself empty, and has the empty hash for its position.
+func subtreeRoot(hashes [][]byte, path []byte, depth uint) []byte {
+	if len(hashes) == 1 {
+		return hashes[0]
+	}
+	half := len(hashes) / 2
+	l := subtreeRoot(hashes[:half], path, depth+1)
+	r := subtreeRoot(hashes[half:], setBit(path, depth), depth+1)
+	leftEmpty := bytes.Equal(l, emptyHash(path, depth+1))
+	rightEmpty := bytes.Equal(r, emptyHash(setBit(path, depth), depth+1))
+	if leftEmpty && rightEmpty {
+		return emptyHash(path, depth)
+	}
+	return coniks.Default.HashChildren(l, r)
+}
+
+func setBit(path []byte, bit uint) []byte {
+	p := append([]byte{}, path...)
+	for uint(len(p)) <= bit/8 {
+		p = append(p, 0)
+	}
+	p[bit/8] |= 0x80 >> (bit % 8)
+	return p
+}
+
+func emptyHash(path []byte, depth uint) []byte {
+	p := append([]byte{}, path...)
+	for uint(len(p)*8) < depth {
+		p = append(p, 0)
+	}
+	return coniks.Default.HashEmpty(treeID, node.NewID(string(p), depth))
+}
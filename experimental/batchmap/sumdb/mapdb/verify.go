@@ -0,0 +1,240 @@
+// Copyright 2021 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapdb
+
+import (
+	"bytes"
+	"crypto"
+	"fmt"
+	"sort"
+
+	"github.com/google/trillian/experimental/batchmap"
+	"github.com/google/trillian/merkle/coniks"
+	"github.com/google/trillian/merkle/smt"
+	"github.com/google/trillian/merkle/smt/node"
+)
+
+// TileProblem is a tile of a revision that failed verification by Verify.
+type TileProblem struct {
+	// Path is the path of the tile.
+	Path []byte
+	// Missing is true if the tile is referenced by the tile above it, but
+	// isn't stored.
+	Missing bool
+	// Unreferenced is true if the tile is stored, but the tile above it
+	// doesn't reference it or is itself missing or damaged.
+	Unreferenced bool
+	// Reason describes what is wrong with the tile.
+	Reason string
+}
+
+func (p TileProblem) String() string {
+	return fmt.Sprintf("tile %x: %s", p.Path, p.Reason)
+}
+
+// Verify checks the tiles stored for the given revision, without reference to
+// the entries that the map was built from. Every tile must decode, the root
+// hash of every tile must be the hash of its leaves, and each leaf of a tile
+// above the last stratum must be the root hash of the tile below it. The tiles
+// that fail these checks, including those that are referenced but missing or
+// stored but not referenced, are returned sorted by path. The build params of
+// the revision are needed to hash the tiles.
+//
+// The tiles are read one stratum at a time from the bottom up, so that only
+// the root hashes of a single stratum are held in memory.
+func (d *TileDB) Verify(rev int) ([]TileProblem, error) {
+	info, err := d.Revision(rev)
+	if err != nil {
+		return nil, err
+	}
+	params, err := d.BuildParams(rev)
+	if err != nil {
+		return nil, err
+	}
+	if params.Hash != crypto.SHA512_256.String() {
+		return nil, fmt.Errorf("can't verify tiles hashed with %s", params.Hash)
+	}
+	v := tileVerifier{treeID: params.TreeID, prefixStrata: params.PrefixStrata}
+
+	var problems []TileProblem
+	report := func(p TileProblem, format string, args ...interface{}) {
+		p.Reason = fmt.Sprintf(format, args...)
+		problems = append(problems, p)
+	}
+	if err := d.tilePaths(rev, "length(path)>?", params.PrefixStrata, func(path []byte) {
+		report(TileProblem{Path: path}, "is deeper than the %d prefix strata", params.PrefixStrata)
+	}); err != nil {
+		return nil, err
+	}
+
+	// below holds the root hash of each tile in the stratum below, keyed by
+	// path. This is nil for tiles that failed verification, as the tile above
+	// them can't be checked against their root hash.
+	var below map[string][]byte
+	for depth := params.PrefixStrata; depth >= 0; depth-- {
+		current := make(map[string][]byte)
+		referenced := make(map[string]bool)
+		err := d.rawTiles(rev, depth, func(path, bs []byte) {
+			current[string(path)] = nil
+			tile, err := DecodeTile(bs)
+			if err != nil {
+				report(TileProblem{Path: path}, "failed to decode: %v", err)
+				return
+			}
+			if !bytes.Equal(tile.Path, path) {
+				report(TileProblem{Path: path}, "has path %x", tile.Path)
+				return
+			}
+			if err := v.checkTile(tile); err != nil {
+				report(TileProblem{Path: path}, "%v", err)
+				return
+			}
+			ok := true
+			if depth < params.PrefixStrata {
+				for _, l := range tile.Leaves {
+					childPath := append(append([]byte{}, path...), l.Path...)
+					referenced[string(childPath)] = true
+					root, found := below[string(childPath)]
+					if !found {
+						report(TileProblem{Path: childPath, Missing: true}, "is missing but is referenced by the tile above")
+					} else if root != nil && !bytes.Equal(root, l.Hash) {
+						report(TileProblem{Path: path}, "has hash %x for leaf %x, but the tile below has root hash %x", l.Hash, l.Path, root)
+						ok = false
+					}
+				}
+			}
+			if ok {
+				current[string(path)] = tile.RootHash
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		for path := range below {
+			parent := path[:len(path)-1]
+			if _, found := current[parent]; !found || !referenced[path] && current[parent] != nil {
+				report(TileProblem{Path: []byte(path), Unreferenced: true}, "is not referenced by the tile above")
+			}
+		}
+		below = current
+	}
+
+	if root, found := below[""]; !found {
+		report(TileProblem{Path: []byte{}, Missing: true}, "root tile is missing")
+	} else if root != nil && len(info.RootHash) > 0 && !bytes.Equal(root, info.RootHash) {
+		report(TileProblem{Path: []byte{}}, "has root hash %x, but the revision has root hash %x", root, info.RootHash)
+	}
+	sort.Slice(problems, func(i, j int) bool {
+		return bytes.Compare(problems[i].Path, problems[j].Path) < 0
+	})
+	return problems, nil
+}
+
+// rawTiles calls fn with the path and encoded tile of every tile stored at the
+// given depth in the revision.
+func (d *TileDB) rawTiles(rev, depth int, fn func(path, bs []byte)) error {
+	rows, err := d.db.Query("SELECT path, tile FROM tiles WHERE revision=? AND length(path)=?", rev, depth)
+	if err != nil {
+		return fmt.Errorf("failed to query tiles: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var path, bs []byte
+		if err := rows.Scan(&path, &bs); err != nil {
+			return fmt.Errorf("failed to scan tile: %v", err)
+		}
+		if path == nil {
+			path = []byte{}
+		}
+		fn(path, bs)
+	}
+	return rows.Err()
+}
+
+// tilePaths calls fn with the path of every tile in the revision whose path
+// matches the condition, which has a single parameter.
+func (d *TileDB) tilePaths(rev int, cond string, arg interface{}, fn func(path []byte)) error {
+	rows, err := d.db.Query(fmt.Sprintf("SELECT path FROM tiles WHERE revision=? AND %s", cond), rev, arg)
+	if err != nil {
+		return fmt.Errorf("failed to query tiles: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var path []byte
+		if err := rows.Scan(&path); err != nil {
+			return fmt.Errorf("failed to scan tile path: %v", err)
+		}
+		fn(path)
+	}
+	return rows.Err()
+}
+
+// tileVerifier checks that tiles are internally consistent. The map keys are
+// all SHA512_256 hashes, and are hashed with the CONIKS hasher.
+type tileVerifier struct {
+	treeID       int64
+	prefixStrata int
+}
+
+// checkTile returns an error if the leaves of the tile aren't the right
+// length for its depth, or don't hash to its root hash.
+func (v tileVerifier) checkTile(tile *batchmap.Tile) error {
+	if len(tile.Leaves) == 0 {
+		return fmt.Errorf("has no leaves")
+	}
+	depth := len(tile.Path)
+	leafLen := 1
+	if depth == v.prefixStrata {
+		leafLen = crypto.SHA512_256.Size() - depth
+	}
+	nodes := make([]smt.Node, len(tile.Leaves))
+	for i, l := range tile.Leaves {
+		if len(l.Path) != leafLen {
+			return fmt.Errorf("has leaf %x of length %d, want %d", l.Path, len(l.Path), leafLen)
+		}
+		path := append(append([]byte{}, tile.Path...), l.Path...)
+		nodes[i] = smt.Node{ID: node.NewID(string(path), uint(len(path))*8), Hash: l.Hash}
+	}
+	height := uint(depth+leafLen) * 8
+	if err := smt.Prepare(nodes, height); err != nil {
+		return fmt.Errorf("has invalid leaves: %v", err)
+	}
+	hs, err := smt.NewHStar3(nodes, coniks.Default.HashChildren, height, uint(depth)*8)
+	if err != nil {
+		return fmt.Errorf("failed to hash: %v", err)
+	}
+	roots, err := hs.Update(emptyTree{treeID: v.treeID})
+	if err != nil {
+		return fmt.Errorf("failed to hash: %v", err)
+	}
+	if len(roots) != 1 {
+		return fmt.Errorf("hashes to %d roots, want 1", len(roots))
+	}
+	if !bytes.Equal(roots[0].Hash, tile.RootHash) {
+		return fmt.Errorf("has root hash %x, but its leaves hash to %x", tile.RootHash, roots[0].Hash)
+	}
+	return nil
+}
+
+// emptyTree is an smt.NodeAccessor for the empty subtrees of a map.
+type emptyTree struct {
+	treeID int64
+}
+
+func (e emptyTree) Get(id node.ID) ([]byte, error) {
+	return coniks.Default.HashEmpty(e.treeID, id), nil
+}
+
+func (e emptyTree) Set(id node.ID, hash []byte) {}
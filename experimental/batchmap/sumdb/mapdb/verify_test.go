@@ -0,0 +1,280 @@
+// Copyright 2021 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapdb
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/trillian/experimental/batchmap"
+	"github.com/google/trillian/merkle/coniks"
+	"github.com/google/trillian/merkle/smt/node"
+)
+
+const verifyTreeID = 12345
+
+// oracleRoot returns the hash of the subtree at the given depth in bits that
+// contains the keys, which all share their first depth bits and have leaves at
+// leafDepth bits. It is computed directly from the binary tree rather than from
+// tiles.
+func oracleRoot(leaves map[string][]byte, keys []string, depth, leafDepth uint) []byte {
+	if depth == leafDepth {
+		return leaves[keys[0]]
+	}
+	var sides [2][]string
+	for _, k := range keys {
+		bit := k[depth/8] >> (7 - depth%8) & 1
+		sides[bit] = append(sides[bit], k)
+	}
+	var hashes [2][]byte
+	for bit, ks := range sides {
+		if len(ks) > 0 {
+			hashes[bit] = oracleRoot(leaves, ks, depth+1, leafDepth)
+		} else {
+			id := node.NewID(sides[1-bit][0], 256).Prefix(depth + 1).Sibling()
+			hashes[bit] = coniks.Default.HashEmpty(verifyTreeID, id)
+		}
+	}
+	return coniks.Default.HashChildren(hashes[0], hashes[1])
+}
+
+// testTiles returns the tiles of a map with one prefix stratum containing
+// entries for the given number of keys.
+func testTiles(n int) []*batchmap.Tile {
+	leaves := make(map[string][]byte)
+	byPrefix := make(map[byte][]string)
+	var all []string
+	for i := 0; i < n; i++ {
+		k := sha256.Sum256([]byte(fmt.Sprintf("key%d", i)))
+		key := string(k[:])
+		leaves[key] = coniks.Default.HashLeaf(verifyTreeID, node.NewID(key, 256), []byte(fmt.Sprintf("value%d", i)))
+		byPrefix[key[0]] = append(byPrefix[key[0]], key)
+		all = append(all, key)
+	}
+	root := &batchmap.Tile{Path: []byte{}, RootHash: oracleRoot(leaves, all, 0, 256)}
+	tiles := []*batchmap.Tile{root}
+	for b := 0; b < 256; b++ {
+		keys := byPrefix[byte(b)]
+		if len(keys) == 0 {
+			continue
+		}
+		t := &batchmap.Tile{Path: []byte{byte(b)}, RootHash: oracleRoot(leaves, keys, 8, 256)}
+		for _, k := range keys {
+			t.Leaves = append(t.Leaves, &batchmap.TileLeaf{Path: []byte(k[1:]), Hash: leaves[k]})
+		}
+		root.Leaves = append(root.Leaves, &batchmap.TileLeaf{Path: t.Path, Hash: t.RootHash})
+		tiles = append(tiles, t)
+	}
+	return tiles
+}
+
+func TestVerify(t *testing.T) {
+	const rev = 1
+	tiles := testTiles(20)
+	leafTile := tiles[1]
+	otherTile := tiles[2]
+	var extra *batchmap.Tile
+	for _, e := range testTiles(30)[1:] {
+		if !hasTile(tiles, e.Path) {
+			extra = e
+			break
+		}
+	}
+	for _, test := range []struct {
+		desc    string
+		corrupt func(t *testing.T, d *TileDB)
+		want    []TileProblem
+	}{
+		{
+			desc:    "valid",
+			corrupt: func(*testing.T, *TileDB) {},
+		},
+		{
+			desc: "wrong leaf hash",
+			corrupt: func(t *testing.T, d *TileDB) {
+				bad := *leafTile
+				bad.Leaves = append([]*batchmap.TileLeaf{{Path: leafTile.Leaves[0].Path, Hash: []byte("corrupt")}}, leafTile.Leaves[1:]...)
+				replaceTiles(t, d, &bad)
+			},
+			want: []TileProblem{{Path: leafTile.Path}},
+		},
+		{
+			desc: "wrong root hash in child",
+			corrupt: func(t *testing.T, d *TileDB) {
+				bad := *leafTile
+				bad.RootHash = []byte("corrupt")
+				replaceTiles(t, d, &bad)
+			},
+			want: []TileProblem{{Path: leafTile.Path}},
+		},
+		{
+			desc: "wrong leaf in parent",
+			corrupt: func(t *testing.T, d *TileDB) {
+				bad := *tiles[0]
+				bad.Leaves = append([]*batchmap.TileLeaf{}, tiles[0].Leaves...)
+				bad.Leaves[0] = &batchmap.TileLeaf{Path: bad.Leaves[0].Path, Hash: otherTile.RootHash}
+				bad.RootHash = testRoot(&bad)
+				replaceTiles(t, d, &bad)
+			},
+			want: []TileProblem{{Path: []byte{}}},
+		},
+		{
+			desc: "missing child",
+			corrupt: func(t *testing.T, d *TileDB) {
+				if err := d.ReplaceTiles(rev, nil, [][]byte{leafTile.Path}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: []TileProblem{{Path: leafTile.Path, Missing: true}},
+		},
+		{
+			desc: "missing root",
+			corrupt: func(t *testing.T, d *TileDB) {
+				if err := d.ReplaceTiles(rev, nil, [][]byte{{}}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			// Every child is now unreferenced.
+			want: append([]TileProblem{{Path: []byte{}, Missing: true}}, childProblems(tiles)...),
+		},
+		{
+			desc: "undecodable",
+			corrupt: func(t *testing.T, d *TileDB) {
+				if _, err := d.db.Exec("UPDATE tiles SET tile=? WHERE revision=? AND path=?", []byte("not a tile"), rev, leafTile.Path); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: []TileProblem{{Path: leafTile.Path}},
+		},
+		{
+			desc: "unreferenced",
+			corrupt: func(t *testing.T, d *TileDB) {
+				replaceTiles(t, d, extra)
+			},
+			want: []TileProblem{{Path: extra.Path, Unreferenced: true}},
+		},
+		{
+			desc: "too deep",
+			corrupt: func(t *testing.T, d *TileDB) {
+				bad := *leafTile
+				bad.Path = []byte{1, 2}
+				replaceTiles(t, d, &bad)
+			},
+			want: []TileProblem{{Path: []byte{1, 2}}},
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			d := newTestTileDB(t, filepath.Join(t.TempDir(), "map.db"))
+			if err := d.WriteTiles(rev, tiles); err != nil {
+				t.Fatalf("WriteTiles(): %v", err)
+			}
+			if err := d.WriteBuildParams(rev, BuildParams{TreeID: verifyTreeID, PrefixStrata: 1, Hash: crypto.SHA512_256.String()}); err != nil {
+				t.Fatalf("WriteBuildParams(): %v", err)
+			}
+			if err := d.CommitRevision(rev, []byte("checkpoint"), 20); err != nil {
+				t.Fatalf("CommitRevision(): %v", err)
+			}
+			test.corrupt(t, d)
+
+			got, err := d.Verify(rev)
+			if err != nil {
+				t.Fatalf("Verify(): %v", err)
+			}
+			// There's no one right way to describe each problem, so
+			// only the paths are compared.
+			for i := range got {
+				got[i].Reason = ""
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("Verify() diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestReplaceTilesRepairs(t *testing.T) {
+	const rev = 1
+	tiles := testTiles(20)
+	d := newTestTileDB(t, filepath.Join(t.TempDir(), "map.db"))
+	if err := d.WriteTiles(rev, tiles); err != nil {
+		t.Fatalf("WriteTiles(): %v", err)
+	}
+	if err := d.WriteBuildParams(rev, BuildParams{TreeID: verifyTreeID, PrefixStrata: 1, Hash: crypto.SHA512_256.String()}); err != nil {
+		t.Fatalf("WriteBuildParams(): %v", err)
+	}
+	if err := d.CommitRevision(rev, []byte("checkpoint"), 20); err != nil {
+		t.Fatalf("CommitRevision(): %v", err)
+	}
+	bad := *tiles[1]
+	bad.RootHash = []byte("corrupt")
+	extra := &batchmap.Tile{Path: []byte{1, 2}, RootHash: []byte("extra")}
+	if err := d.ReplaceTiles(rev, []*batchmap.Tile{&bad, extra}, [][]byte{tiles[2].Path}); err != nil {
+		t.Fatalf("ReplaceTiles(): %v", err)
+	}
+	if problems, err := d.Verify(rev); err != nil || len(problems) != 3 {
+		t.Fatalf("Verify() = %v, %v; want 3 problems", problems, err)
+	}
+
+	if err := d.ReplaceTiles(rev, tiles[1:3], [][]byte{extra.Path}); err != nil {
+		t.Fatalf("ReplaceTiles(): %v", err)
+	}
+	if problems, err := d.Verify(rev); err != nil || len(problems) != 0 {
+		t.Errorf("Verify() after repair = %v, %v; want no problems", problems, err)
+	}
+	if n, err := d.CountTiles(rev); err != nil || n != int64(len(tiles)) {
+		t.Errorf("CountTiles() = %d, %v; want %d", n, err, len(tiles))
+	}
+}
+
+func replaceTiles(t *testing.T, d *TileDB, tiles ...*batchmap.Tile) {
+	t.Helper()
+	if err := d.ReplaceTiles(1, tiles, nil); err != nil {
+		t.Fatalf("ReplaceTiles(): %v", err)
+	}
+}
+
+// testRoot returns the root hash of a tile in the first stratum computed from
+// its leaves.
+func testRoot(tile *batchmap.Tile) []byte {
+	leaves := make(map[string][]byte)
+	var keys []string
+	for _, l := range tile.Leaves {
+		key := string(append(append([]byte{}, l.Path...), make([]byte, 31)...))
+		keys = append(keys, key)
+		leaves[key] = l.Hash
+	}
+	return oracleRoot(leaves, keys, 0, 8)
+}
+
+func childProblems(tiles []*batchmap.Tile) []TileProblem {
+	var problems []TileProblem
+	for _, t := range tiles[1:] {
+		problems = append(problems, TileProblem{Path: t.Path, Unreferenced: true})
+	}
+	return problems
+}
+
+func hasTile(tiles []*batchmap.Tile, path []byte) bool {
+	for _, t := range tiles {
+		if string(t.Path) == string(path) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+// Copyright 2021 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// mapdiff compares the leaves of two revisions of the map and reports the
+// keys that were added, removed, or changed between them.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"sort"
+
+	"github.com/golang/glog"
+	"github.com/google/trillian/experimental/batchmap"
+
+	"github.com/google/trillian-examples/experimental/batchmap/sumdb/mapdb"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var (
+	mapDB        = flag.String("map_db", "", "sqlite DB containing the map tiles.")
+	prefixStrata = flag.Int("prefix_strata", 2, "The number of strata of 8-bit strata before the final strata. Only used for revisions with no recorded build params.")
+	fromRev      = flag.Int("from", -1, "The earlier map revision to compare, or -1 to use the revision before --to.")
+	toRev        = flag.Int("to", -1, "The later map revision to compare, or -1 to use the latest revision.")
+	maxDiffs     = flag.Int("max_diffs", 10, "The maximum number of differing keys to print for each kind of difference.")
+)
+
+func main() {
+	flag.Parse()
+
+	if *mapDB == "" {
+		glog.Exitf("No map_db provided")
+	}
+
+	tiledb, err := mapdb.NewTileDB(*mapDB)
+	if err != nil {
+		glog.Exitf("Failed to open map DB at %q: %v", *mapDB, err)
+	}
+	defer tiledb.Close()
+	to := *toRev
+	if to < 0 {
+		if to, _, _, err = tiledb.LatestRevision(); err != nil {
+			glog.Exitf("No revisions found in map DB at %q: %v", *mapDB, err)
+		}
+	}
+	from := *fromRev
+	if from < 0 {
+		from = to - 1
+	}
+	if from < 0 || from >= to {
+		glog.Exitf("Revision to compare from (%d) must be before revision to compare to (%d)", from, to)
+	}
+
+	before, err := loadLeaves(tiledb, from)
+	if err != nil {
+		glog.Exit(err)
+	}
+	after, err := loadLeaves(tiledb, to)
+	if err != nil {
+		glog.Exit(err)
+	}
+
+	var added, removed, changed []string
+	for k, v := range after {
+		if old, ok := before[k]; !ok {
+			added = append(added, k)
+		} else if !bytes.Equal(old, v) {
+			changed = append(changed, k)
+		}
+	}
+	for k := range before {
+		if _, ok := after[k]; !ok {
+			removed = append(removed, k)
+		}
+	}
+
+	fmt.Printf("Comparing map revision %d (%d keys) to revision %d (%d keys)\n", from, len(before), to, len(after))
+	printKeys("Added", added)
+	printKeys("Changed", changed)
+	printKeys("Removed", removed)
+
+	// Entries in SumDB are immutable, so nothing should ever be removed from the map.
+	if len(removed) > 0 {
+		glog.Exitf("%d keys were removed between revisions %d and %d", len(removed), from, to)
+	}
+}
+
+// loadLeaves returns the hash of every leaf in the given map revision, keyed by
+// the full path of the leaf.
+func loadLeaves(tiledb *mapdb.TileDB, rev int) (map[string][]byte, error) {
+	strata := *prefixStrata
+	if params, err := tiledb.BuildParams(rev); err == nil {
+		strata = params.PrefixStrata
+	} else {
+		glog.Warningf("Failed to read build params for revision %d, using flag values: %v", rev, err)
+	}
+	leaves := make(map[string][]byte)
+	if err := tiledb.Tiles(rev, strata, func(t *batchmap.Tile) error {
+		for _, l := range t.Leaves {
+			leaves[string(append(append([]byte{}, t.Path...), l.Path...))] = l.Hash
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to read leaf tiles for revision %d: %v", rev, err)
+	}
+	return leaves, nil
+}
+
+func printKeys(kind string, keys []string) {
+	fmt.Printf("%s: %d\n", kind, len(keys))
+	sort.Strings(keys)
+	for i, k := range keys {
+		if i == *maxDiffs {
+			fmt.Printf(" ... and %d more\n", len(keys)-i)
+			break
+		}
+		fmt.Printf(" * %x\n", k)
+	}
+}
@@ -0,0 +1,313 @@
+// Copyright 2021 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// mapmonitor periodically samples random entries from the live SumDB, and
+// checks that the map served over HTTP commits to the same hashes for them.
+// A mismatch means that either the map or the mirror it was built from is
+// inconsistent with SumDB. The results are exported as Prometheus metrics.
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/google/trillian-examples/experimental/batchmap/sumdb/client"
+	"github.com/google/trillian-examples/experimental/batchmap/sumdb/mapdb"
+	"github.com/google/trillian-examples/sumdbaudit/audit"
+)
+
+var (
+	mapURL     = flag.String("map_url", "", "The base URL that the map tiles are served from, e.g. the out_dir of the files sink served by a static file server.")
+	tileSuffix = flag.String("tile_suffix", ".json", "The suffix of the name of each tile served. Set this to '' for tiles served from a bucket written by the gcs sink.")
+	manifest   = flag.String("manifest", "", "The path of the JSON manifest written by the build of the revision being served. This is read again before each sample, so that a new revision is picked up when its manifest replaces this one.")
+	height     = flag.Int("h", 8, "The height of the SumDB tiles that leaves are fetched from.")
+	vkey       = flag.String("k", "sum.golang.org+033de0ae+Ac4zctda0e5eza+HJyk9SxEdh+s3Ux18htTTAD8OuAn8", "The verifier key of the SumDB.")
+	sampleSize = flag.Int("sample_size", 10, "The number of SumDB entries to check on each run. Each entry has two hashes to check, for the module and its go.mod file.")
+	interval   = flag.Duration("interval", 5*time.Minute, "How long to wait between runs. If 0 then a single run is made, and the exit status is non-zero if any hash didn't match.")
+	listenAddr = flag.String("listen", ":8080", "The address that metrics are served on at /metrics. Unused if interval is 0.")
+)
+
+// Results of a check, used as the label on checksTotal.
+const (
+	resultMatch    = "match"
+	resultMismatch = "mismatch"
+	resultMissing  = "missing"
+	resultBadProof = "bad_proof"
+	resultError    = "error"
+)
+
+var (
+	checksTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mapmonitor_checks_total",
+		Help: "Number of hashes sampled from SumDB and checked against the map, by result: match, mismatch (the map has a different hash), missing (the map has no hash), bad_proof (the tiles don't verify to the map root) or error (the check couldn't be made).",
+	}, []string{"result"})
+	runsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mapmonitor_runs_total",
+		Help: "Number of runs that sampled SumDB.",
+	})
+	runFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mapmonitor_run_failures_total",
+		Help: "Number of runs that failed before checking any hashes, e.g. because SumDB or the manifest couldn't be read.",
+	})
+	mapRevision = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mapmonitor_map_revision",
+		Help: "The revision of the map checked by the last run.",
+	})
+	lastRunTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mapmonitor_last_run_timestamp_seconds",
+		Help: "The time that the last run completed, in seconds since the epoch.",
+	})
+)
+
+// buildManifest holds the fields of the manifest written by the build that
+// are needed to verify against the revision.
+type buildManifest struct {
+	Revision     int    `json:"revision"`
+	TreeID       int64  `json:"tree_id"`
+	PrefixStrata int    `json:"prefix_strata"`
+	StratumBits  int    `json:"stratum_bits"`
+	Hash         string `json:"hash"`
+	ModuleFilter string `json:"module_filter"`
+	KeyDomain    string `json:"key_domain"`
+	EndID        int64  `json:"end_id"`
+	RootHash     string `json:"root_hash"`
+}
+
+// leafHash is one of the two hashes committed to by a SumDB leaf.
+type leafHash struct {
+	id      int64
+	module  string
+	version string
+	hash    string
+}
+
+func main() {
+	flag.Parse()
+
+	if *mapURL == "" {
+		glog.Exitf("No map_url provided")
+	}
+	if *manifest == "" {
+		glog.Exitf("No manifest provided")
+	}
+	if *sampleSize <= 0 {
+		glog.Exitf("sample_size must be positive, got %d", *sampleSize)
+	}
+	sumDB := audit.NewSumDB(*height, *vkey)
+	ctx := context.Background()
+
+	if *interval == 0 {
+		failed, err := run(ctx, sumDB)
+		if err != nil {
+			glog.Exitf("Failed to check map: %v", err)
+		}
+		if failed > 0 {
+			glog.Exitf("%d hashes sampled from SumDB were not committed to by the map", failed)
+		}
+		return
+	}
+
+	http.Handle("/metrics", promhttp.Handler())
+	go func() {
+		glog.Exitf("Failed to serve metrics: %v", http.ListenAndServe(*listenAddr, nil))
+	}()
+	for {
+		if _, err := run(ctx, sumDB); err != nil {
+			glog.Errorf("Failed to check map: %v", err)
+		}
+		time.Sleep(*interval)
+	}
+}
+
+// run checks a sample of hashes from SumDB against the map revision
+// described by the manifest, and returns how many of them weren't committed
+// to by the map. Checks that couldn't be made aren't counted as failures.
+func run(ctx context.Context, sumDB *audit.SumDBClient) (int, error) {
+	defer func() { lastRunTimestamp.SetToCurrentTime() }()
+	runsTotal.Inc()
+	m, err := readManifest(*manifest)
+	if err != nil {
+		runFailuresTotal.Inc()
+		return 0, err
+	}
+	c, filter, err := newClient(m)
+	if err != nil {
+		runFailuresTotal.Inc()
+		return 0, err
+	}
+	hashes, err := sample(sumDB, m.EndID, *sampleSize)
+	if err != nil {
+		runFailuresTotal.Inc()
+		return 0, err
+	}
+	mapRevision.Set(float64(m.Revision))
+
+	failed := 0
+	for _, h := range hashes {
+		if filter != nil && !filter.MatchString(h.module) {
+			continue
+		}
+		result := check(ctx, c, h)
+		checksTotal.WithLabelValues(result).Inc()
+		if result != resultMatch && result != resultError {
+			failed++
+		}
+	}
+	glog.Infof("Checked %d hashes against map revision %d: %d not committed to by the map", len(hashes), m.Revision, failed)
+	return failed, nil
+}
+
+// check verifies a single hash against the map, and returns the result.
+func check(ctx context.Context, c *client.Client, h leafHash) string {
+	err := c.Verify(ctx, h.module, h.version, h.hash)
+	switch {
+	case err == nil:
+		return resultMatch
+	case errors.Is(err, client.ErrValueMismatch):
+		glog.Errorf("Map has a different hash for %s %s than SumDB entry %d: %v", h.module, h.version, h.id, err)
+		return resultMismatch
+	case errors.Is(err, client.ErrNotFound):
+		glog.Errorf("Map has no hash for %s %s from SumDB entry %d: %v", h.module, h.version, h.id, err)
+		return resultMissing
+	case errors.Is(err, client.ErrProofMismatch):
+		glog.Errorf("Map tiles for %s %s don't verify to the map root: %v", h.module, h.version, err)
+		return resultBadProof
+	default:
+		glog.Warningf("Failed to check %s %s: %v", h.module, h.version, err)
+		return resultError
+	}
+}
+
+func readManifest(path string) (buildManifest, error) {
+	var m buildManifest
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return m, fmt.Errorf("failed to read manifest: %v", err)
+	}
+	if err := json.Unmarshal(bs, &m); err != nil {
+		return m, fmt.Errorf("failed to parse manifest %q: %v", path, err)
+	}
+	return m, nil
+}
+
+// newClient returns a client that verifies against the revision described by
+// the manifest, and the regular expression that modules in it match, if any.
+func newClient(m buildManifest) (*client.Client, *regexp.Regexp, error) {
+	root, err := hex.DecodeString(m.RootHash)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode root hash %q: %v", m.RootHash, err)
+	}
+	c, err := client.New(*mapURL, m.Revision, root, mapdb.BuildParams{
+		TreeID:       m.TreeID,
+		PrefixStrata: m.PrefixStrata,
+		StratumBits:  m.StratumBits,
+		Hash:         m.Hash,
+		KeyDomain:    m.KeyDomain,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	c.TileSuffix = *tileSuffix
+	var filter *regexp.Regexp
+	if m.ModuleFilter != "" {
+		if filter, err = regexp.Compile(m.ModuleFilter); err != nil {
+			return nil, nil, fmt.Errorf("failed to compile module filter %q: %v", m.ModuleFilter, err)
+		}
+	}
+	return c, filter, nil
+}
+
+// sample returns the hashes committed to by n random leaves of SumDB. Only
+// the first endID leaves are sampled, as later leaves aren't in the map yet.
+func sample(sumDB *audit.SumDBClient, endID int64, n int) ([]leafHash, error) {
+	cp, err := sumDB.LatestCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+	size := endID
+	if cp.N < size {
+		// The map can't be ahead of SumDB unless the mirror is inconsistent,
+		// which will be detected when the map is compared with the mirror.
+		glog.Warningf("Map commits to %d entries but the latest SumDB checkpoint has only %d", endID, cp.N)
+		size = cp.N
+	}
+	if size <= 0 {
+		return nil, fmt.Errorf("no entries to sample: map has %d and SumDB has %d", endID, cp.N)
+	}
+
+	var hashes []leafHash
+	width := int64(1) << uint(*height)
+	for i := 0; i < n; i++ {
+		id := rand.Int63n(size)
+		offset := id / width
+		var leaves [][]byte
+		if (offset+1)*width <= cp.N {
+			leaves, err = sumDB.FullLeavesAtOffset(int(offset))
+		} else {
+			leaves, err = sumDB.PartialLeavesAtOffset(int(offset), int(cp.N-offset*width))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch leaves at offset %d: %v", offset, err)
+		}
+		idx := id - offset*width
+		if idx >= int64(len(leaves)) {
+			return nil, fmt.Errorf("tile at offset %d has %d leaves, want at least %d", offset, len(leaves), idx+1)
+		}
+		hs, err := parseLeaf(id, leaves[idx])
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hs...)
+	}
+	return hashes, nil
+}
+
+// parseLeaf returns the module and go.mod hashes committed to by the leaf
+// data, which is of the form:
+//
+//	<module> <version> <hash>
+//	<module> <version>/go.mod <hash>
+func parseLeaf(id int64, leaf []byte) ([]leafHash, error) {
+	lines := strings.Split(strings.TrimSpace(string(leaf)), "\n")
+	if len(lines) != 2 {
+		return nil, fmt.Errorf("leaf %d has %d lines, want 2", id, len(lines))
+	}
+	var hashes []leafHash
+	for _, l := range lines {
+		tokens := strings.Split(l, " ")
+		if len(tokens) != 3 {
+			return nil, fmt.Errorf("leaf %d has malformed line %q", id, l)
+		}
+		hashes = append(hashes, leafHash{id: id, module: tokens[0], version: tokens[1], hash: tokens[2]})
+	}
+	if hashes[0].module != hashes[1].module || hashes[0].version+"/go.mod" != hashes[1].version {
+		return nil, fmt.Errorf("leaf %d has mismatched lines %q", id, lines)
+	}
+	return hashes, nil
+}
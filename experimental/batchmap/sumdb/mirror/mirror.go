@@ -0,0 +1,346 @@
+// Copyright 2021 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mirror reads the module metadata committed to by SumDB from a
+// mirror of its log, such as the database written by sumdbaudit. This is
+// shared by the tools that build the map from the mirror and that read the
+// mirror back to compare it with the map.
+//
+// The database/sql driver for the mirror must be registered by the caller.
+package mirror
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/apache/beam/sdks/go/pkg/beam"
+	"github.com/apache/beam/sdks/go/pkg/beam/io/databaseio"
+	"github.com/google/trillian/merkle/compact"
+	"golang.org/x/mod/sumdb/tlog"
+
+	"github.com/google/trillian-examples/experimental/batchmap/sumdb/build/pipeline"
+)
+
+// Schema is the names of the tables and columns in the SumDB mirror.
+// The defaults are those used by sumdbaudit.
+type Schema struct {
+	leafTable string
+	// leafColumns maps the lowercase names of the fields of pipeline.Metadata
+	// to the columns that they are read from.
+	leafColumns     map[string]string
+	checkpointTable string
+	// checkpointColumns maps "checkpoint" and "datetime" to the columns that
+	// contain the checkpoint and the time it was fetched.
+	checkpointColumns map[string]string
+}
+
+var sqlIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// NewSchema returns the Schema with the given tables, as taken by the
+// --leaf_table and --checkpoint_table flags of the tools, and columns
+// overridden by the comma-separated field=column pairs taken by the
+// --leaf_columns and --checkpoint_columns flags.
+func NewSchema(leafTable, leafColumns, checkpointTable, checkpointColumns string) (*Schema, error) {
+	schema := &Schema{
+		leafTable:         leafTable,
+		leafColumns:       map[string]string{"id": "id", "module": "module", "version": "version", "repohash": "repohash", "modhash": "modhash"},
+		checkpointTable:   checkpointTable,
+		checkpointColumns: map[string]string{"checkpoint": "checkpoint", "datetime": "datetime"},
+	}
+	if err := parseColumns(leafColumns, schema.leafColumns); err != nil {
+		return nil, fmt.Errorf("invalid leaf_columns: %v", err)
+	}
+	if err := parseColumns(checkpointColumns, schema.checkpointColumns); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint_columns: %v", err)
+	}
+	for _, t := range []string{schema.leafTable, schema.checkpointTable} {
+		if !sqlIdentifier.MatchString(t) {
+			return nil, fmt.Errorf("invalid table name %q", t)
+		}
+	}
+	return schema, nil
+}
+
+// parseColumns parses comma-separated field=column pairs into columns, which
+// must already contain every valid field.
+func parseColumns(flagValue string, columns map[string]string) error {
+	if len(flagValue) == 0 {
+		return nil
+	}
+	for _, kv := range strings.Split(flagValue, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("%q is not of the form field=column", kv)
+		}
+		field, column := strings.ToLower(strings.TrimSpace(parts[0])), strings.TrimSpace(parts[1])
+		if _, ok := columns[field]; !ok {
+			return fmt.Errorf("unknown field %q", field)
+		}
+		if !sqlIdentifier.MatchString(column) {
+			return fmt.Errorf("invalid column name %q", column)
+		}
+		columns[field] = column
+	}
+	return nil
+}
+
+// leafSelect returns a SELECT statement for the pipeline.Metadata fields of
+// the leaves, with each column aliased to the name of its field.
+func (s *Schema) leafSelect() string {
+	c := s.leafColumns
+	return fmt.Sprintf("SELECT %s AS id, %s AS module, %s AS version, %s AS repohash, %s AS modhash FROM %s", c["id"], c["module"], c["version"], c["repohash"], c["modhash"], s.leafTable)
+}
+
+func (s *Schema) entriesQuery(start, end int64) string {
+	return fmt.Sprintf("%s WHERE %s >= %d AND %s < %d", s.leafSelect(), s.leafColumns["id"], start, s.leafColumns["id"], end)
+}
+
+func (s *Schema) leafCountQuery() string {
+	return fmt.Sprintf("SELECT COUNT(*) FROM %s", s.leafTable)
+}
+
+func (s *Schema) checkpointQuery() string {
+	c := s.checkpointColumns
+	return fmt.Sprintf("SELECT %s FROM %s ORDER BY %s DESC LIMIT 1", c["checkpoint"], s.checkpointTable, c["datetime"])
+}
+
+// probe checks that the tables and columns exist in the database, so that a
+// misconfigured schema fails at startup rather than part way through a build.
+func (s *Schema) probe(db *sql.DB) error {
+	if _, err := db.Exec(s.leafSelect() + " LIMIT 0"); err != nil {
+		return fmt.Errorf("failed to read leaves from table %q with columns %v: %v", s.leafTable, s.leafColumns, err)
+	}
+	c := s.checkpointColumns
+	if _, err := db.Exec(fmt.Sprintf("SELECT %s, %s FROM %s LIMIT 0", c["checkpoint"], c["datetime"], s.checkpointTable)); err != nil {
+		return fmt.Errorf("failed to read checkpoints from table %q with columns %v: %v", s.checkpointTable, c, err)
+	}
+	return nil
+}
+
+// DataSource returns the database/sql driver and data source name of the
+// mirror from the values of the --sum_db, --sum_db_driver and --sum_db_dsn
+// flags of the tools. The path of a SQLite file given by sumDB is shorthand
+// for the sqlite3 driver and that path as the DSN.
+func DataSource(sumDB, driver, dsn string) (string, string, error) {
+	switch {
+	case len(sumDB) > 0 && len(dsn) > 0:
+		return "", "", errors.New("only one of sum_db or sum_db_dsn may be set")
+	case len(sumDB) > 0:
+		return "sqlite3", sumDB, nil
+	case len(dsn) == 0:
+		return "", "", errors.New("missing flag: one of sum_db or sum_db_dsn must be set")
+	}
+	return driver, dsn, nil
+}
+
+// Mirror is a pipeline.InputLog that reads the leaves of a SumDB mirror.
+type Mirror struct {
+	driver            string
+	dbString          string
+	db                *sql.DB
+	schema            *Schema
+	useCheckpointSize bool
+
+	// Checkpoint is the verified checkpoint note to use instead of the one
+	// stored in the mirror, or nil to read it from the mirror.
+	Checkpoint []byte
+}
+
+// New connects to the SumDB mirror using the database/sql driver and checks
+// that it has the expected schema. The queries are plain enough to be valid
+// for any of the supported drivers. If useCheckpointSize is true then Head
+// returns the tree size of the checkpoint rather than the number of leaves.
+// The Mirror returned should have Close called when done.
+func New(driver, dsn string, schema *Schema, useCheckpointSize bool) (*Mirror, error) {
+	switch driver {
+	case "sqlite3", "postgres":
+	default:
+		return nil, fmt.Errorf("unsupported sum_db_driver %q", driver)
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to SumDB mirror: %v", err)
+	}
+	if err := schema.probe(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("SumDB mirror does not match the configured schema: %v", err)
+	}
+	return &Mirror{
+		driver:            driver,
+		dbString:          dsn,
+		db:                db,
+		schema:            schema,
+		useCheckpointSize: useCheckpointSize,
+	}, nil
+}
+
+// Close closes the connection to the SumDB mirror.
+func (m *Mirror) Close() error {
+	return m.db.Close()
+}
+
+// readCheckpoint returns the checkpoint read from the checkpoint file if
+// there was one, and otherwise the latest checkpoint stored in the mirror.
+func (m *Mirror) readCheckpoint() ([]byte, error) {
+	if m.Checkpoint != nil {
+		return m.Checkpoint, nil
+	}
+	var cp []byte
+	if err := m.db.QueryRow(m.schema.checkpointQuery()).Scan(&cp); err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+// Head gets the STH and the total number of entries available to process.
+// If the mirror is configured to use the checkpoint size, then the number of
+// entries is the tree size committed to by the checkpoint. This ensures that
+// the map is built from exactly the entries the checkpoint commits to, even if
+// the mirror contains additional entries. A checkpoint read from a file is
+// always checked against the number of entries in the mirror, as the mirror
+// may not have caught up with it.
+func (m *Mirror) Head() ([]byte, int64, error) {
+	var leafCount int64
+
+	cp, err := m.readCheckpoint()
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := m.db.QueryRow(m.schema.leafCountQuery()).Scan(&leafCount); err != nil {
+		return nil, 0, err
+	}
+	if !m.useCheckpointSize && m.Checkpoint == nil {
+		return cp, leafCount, nil
+	}
+	size, err := checkpointSize(cp)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to parse checkpoint: %v", err)
+	}
+	if leafCount < size {
+		return nil, 0, fmt.Errorf("checkpoint has tree size %d but mirror only has %d entries", size, leafCount)
+	}
+	if !m.useCheckpointSize {
+		return cp, leafCount, nil
+	}
+	return cp, size, nil
+}
+
+// checkpointSize returns the tree size from a SumDB checkpoint note.
+func checkpointSize(cp []byte) (int64, error) {
+	tree, err := CheckpointTree(cp)
+	if err != nil {
+		return 0, err
+	}
+	return tree.N, nil
+}
+
+// CheckpointTree returns the tree committed to by a SumDB checkpoint note.
+func CheckpointTree(cp []byte) (tlog.Tree, error) {
+	// The signatures on the note follow the first blank line.
+	text := cp
+	if i := bytes.Index(cp, []byte("\n\n")); i >= 0 {
+		text = cp[:i+1]
+	}
+	return tlog.ParseTree(text)
+}
+
+// Leaves calls f with the Metadata of each of the first end leaves in the
+// mirror, in order of ID, stopping at the first error.
+func (m *Mirror) Leaves(end int64, f func(pipeline.Metadata) error) error {
+	rows, err := m.db.Query(fmt.Sprintf("%s ORDER BY %s", m.schema.entriesQuery(0, end), m.schema.leafColumns["id"]))
+	if err != nil {
+		return fmt.Errorf("failed to query leaves: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var l pipeline.Metadata
+		if err := rows.Scan(&l.ID, &l.Module, &l.Version, &l.RepoHash, &l.ModHash); err != nil {
+			return fmt.Errorf("failed to scan leaf: %v", err)
+		}
+		if err := f(l); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read leaves: %v", err)
+	}
+	return nil
+}
+
+// VerifyTree checks that the leaves in the mirror hash up to the root hash of
+// the checkpoint file, or else the latest checkpoint that the mirror stores,
+// which sumdbaudit only stores after verifying its signature. Each leaf is
+// reconstructed from its metadata as the pair of go.sum lines that make up the
+// SumDB record. The first end leaves are going to be committed to by the map,
+// so this fails if any of them are beyond the tree size of the checkpoint.
+func (m *Mirror) VerifyTree(end int64) error {
+	cp, err := m.readCheckpoint()
+	if err != nil {
+		return fmt.Errorf("failed to read checkpoint: %v", err)
+	}
+	tree, err := CheckpointTree(cp)
+	if err != nil {
+		return fmt.Errorf("failed to parse checkpoint: %v", err)
+	}
+	if end > tree.N {
+		return fmt.Errorf("the map would commit to %d entries, but only the first %d are committed to by the checkpoint; use --use_checkpoint_size to build from these", end, tree.N)
+	}
+
+	rf := &compact.RangeFactory{
+		// This is the RFC 6962 hashing used by the SumDB log.
+		Hash: func(left, right []byte) []byte {
+			var lHash, rHash tlog.Hash
+			copy(lHash[:], left)
+			copy(rHash[:], right)
+			thash := tlog.NodeHash(lHash, rHash)
+			return thash[:]
+		},
+	}
+	cr := rf.NewEmptyRange(0)
+	if err := m.Leaves(tree.N, func(l pipeline.Metadata) error {
+		if want := int64(cr.End()); l.ID != want {
+			return fmt.Errorf("mirror has leaf %d where leaf %d was expected", l.ID, want)
+		}
+		record := fmt.Sprintf("%s %s %s\n%s %s/go.mod %s\n", l.Module, l.Version, l.RepoHash, l.Module, l.Version, l.ModHash)
+		h := tlog.RecordHash([]byte(record))
+		return cr.Append(h[:], nil)
+	}); err != nil {
+		return err
+	}
+	if got := int64(cr.End()); got != tree.N {
+		return fmt.Errorf("mirror has %d of the %d leaves committed to by the checkpoint", got, tree.N)
+	}
+	root, err := cr.GetRootHash(nil)
+	if err != nil {
+		return fmt.Errorf("failed to compute root hash: %v", err)
+	}
+	if !bytes.Equal(root, tree.Hash[:]) {
+		return fmt.Errorf("leaves hash to %x, but the checkpoint for tree size %d has root hash %x", root, tree.N, tree.Hash[:])
+	}
+	return nil
+}
+
+// Entries returns a PCollection of Metadata, containing entries in range [start, end).
+func (m *Mirror) Entries(s beam.Scope, start, end int64) beam.PCollection {
+	return databaseio.Query(s, m.driver, m.dbString, m.schema.entriesQuery(start, end), reflect.TypeOf(pipeline.Metadata{}))
+}
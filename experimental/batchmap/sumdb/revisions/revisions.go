@@ -0,0 +1,109 @@
+// Copyright 2021 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// revisions lists the history of the map: the root hash and number of SumDB
+// entries of every revision written to the map DB. This is intended to be
+// polled by monitors, so that they can track the growth of the map and flag
+// a revision that commits to fewer entries than the revision before it, or
+// to the same entries with a different root hash. These are only warnings, as
+// rebuilding with different build parameters also changes the root hash.
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/google/trillian-examples/experimental/batchmap/sumdb/mapdb"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var (
+	mapDB  = flag.String("map_db", "", "sqlite DB containing the map tiles.")
+	asJSON = flag.Bool("json", false, "If set then the revisions are written to stdout as a JSON array rather than as a table.")
+)
+
+// revision is the JSON representation of a mapdb.RevisionInfo.
+type revision struct {
+	Revision        int       `json:"revision"`
+	Datetime        time.Time `json:"datetime"`
+	LeafCount       int64     `json:"leaf_count"`
+	RootHash        string    `json:"root_hash,omitempty"`
+	CommitmentIndex *int64    `json:"commitment_index,omitempty"`
+}
+
+func main() {
+	flag.Parse()
+
+	if *mapDB == "" {
+		glog.Exitf("No map_db provided")
+	}
+	tiledb, err := mapdb.NewTileDB(*mapDB)
+	if err != nil {
+		glog.Exitf("Failed to open map DB at %q: %v", *mapDB, err)
+	}
+	defer tiledb.Close()
+	infos, err := tiledb.ListRevisions()
+	if err != nil {
+		glog.Exitf("Failed to list revisions: %v", err)
+	}
+
+	revs := make([]revision, 0, len(infos))
+	for i, info := range infos {
+		if i > 0 {
+			prev := infos[i-1]
+			if info.Count < prev.Count {
+				glog.Warningf("Revision %d commits to %d SumDB entries, fewer than the %d of revision %d", info.Revision, info.Count, prev.Count, prev.Revision)
+			}
+			if info.Count == prev.Count && len(info.RootHash) > 0 && len(prev.RootHash) > 0 && !bytes.Equal(info.RootHash, prev.RootHash) {
+				glog.Warningf("Revisions %d and %d commit to the same %d SumDB entries with different root hashes", prev.Revision, info.Revision, info.Count)
+			}
+		}
+		r := revision{
+			Revision:  info.Revision,
+			Datetime:  info.Datetime,
+			LeafCount: info.Count,
+			RootHash:  hex.EncodeToString(info.RootHash),
+		}
+		if info.CommitmentIndex >= 0 {
+			index := info.CommitmentIndex
+			r.CommitmentIndex = &index
+		}
+		revs = append(revs, r)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(revs); err != nil {
+			glog.Exitf("Failed to write revisions: %v", err)
+		}
+		return
+	}
+	fmt.Printf("%-8s  %-25s  %10s  %s\n", "REVISION", "DATETIME", "ENTRIES", "ROOT HASH")
+	for _, r := range revs {
+		root := r.RootHash
+		if len(root) == 0 {
+			root = "(not recorded)"
+		}
+		fmt.Printf("%-8d  %-25s  %10d  %s\n", r.Revision, r.Datetime.Format(time.RFC3339), r.LeafCount, root)
+	}
+}
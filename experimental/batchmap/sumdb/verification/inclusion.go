@@ -19,6 +19,7 @@ package verification
 import (
 	"bytes"
 	"crypto"
+	"errors"
 	"fmt"
 
 	"github.com/google/trillian/experimental/batchmap"
@@ -27,10 +28,23 @@ import (
 	"github.com/google/trillian/merkle/smt/node"
 )
 
+var (
+	// ErrKeyNotFound is returned by CheckInclusion if the tiles on the path
+	// to the key have no leaf for it. This only proves that the key is
+	// absent from the map if the root hash returned with it is trusted.
+	ErrKeyNotFound = errors.New("key not found")
+	// ErrValueMismatch is returned by CheckInclusion if the map has a leaf
+	// for the key, but it commits to a different value. As with
+	// ErrKeyNotFound, this only holds if the root hash returned is trusted.
+	ErrValueMismatch = errors.New("value does not match")
+)
+
 // TileFetch gets the tile at the specified path in the given map revision.
 // There is currently an assumption that this is very fast and thus it looks
 // up tiles one at a time. This can be replaced with a batch version if that
 // assumption is invalidated (e.g. this method triggers network operations).
+// A nil tile may be returned for a path below the root with no tile, which
+// is checked against the leaves of the tile above it.
 type TileFetch func(revision int, path []byte) (*batchmap.Tile, error)
 
 // MapVerifier verifies inclusion of key/values in a map.
@@ -54,14 +68,20 @@ func NewMapVerifier(tileFetch TileFetch, prefixStrata int, treeID int64, hash cr
 
 // CheckInclusion confirms that the key & value are committed to by the map in the given
 // directory, and returns the computed and confirmed root hash that commits to this.
-func (v *MapVerifier) CheckInclusion(rev int, key string, value []byte) ([]byte, error) {
+// The key is the hashed key in the map, e.g. as returned by pipeline.MapKey.
+//
+// If the map has no leaf for the key, or its leaf commits to a different
+// value, then the error wraps ErrKeyNotFound or ErrValueMismatch. The root
+// hash that the tiles commit to is returned along with these errors, and the
+// caller must check it against a trusted root before relying on the error.
+func (v *MapVerifier) CheckInclusion(rev int, keyPath []byte, value []byte) ([]byte, error) {
 	// Determine the key/value we expect to find.
 	// Note that the map tiles do not contain raw values, but commitments to the values.
 	// If the map needs to return the values to clients then it is recommended that the
 	// map operator uses a Content Addressable Store to store these values.
-	h := v.hash.New()
-	h.Write([]byte(key))
-	keyPath := h.Sum(nil)
+	if got, want := len(keyPath), v.hash.Size(); got != want {
+		return nil, fmt.Errorf("key has length %d, want %d", got, want)
+	}
 	leafID := node.NewID(string(keyPath), uint(len(keyPath)*8))
 
 	expectedValueHash := coniks.Default.HashLeaf(v.treeID, leafID, value)
@@ -69,7 +89,7 @@ func (v *MapVerifier) CheckInclusion(rev int, key string, value []byte) ([]byte,
 	// Read the tiles required for this check from disk.
 	tiles, err := v.getTilesForKey(rev, keyPath)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't load tiles: %v", err)
+		return nil, fmt.Errorf("couldn't load tiles: %w", err)
 	}
 
 	// Perform the verification.
@@ -81,7 +101,22 @@ func (v *MapVerifier) CheckInclusion(rev int, key string, value []byte) ([]byte,
 	et := emptyTree{treeID: v.treeID, hasher: coniks.Default}
 	needPath, needValue := keyPath, expectedValueHash
 
-	for i := v.prefixStrata; i >= 0; i-- {
+	// If a tile below the root is missing then the key can't be in the map,
+	// so instead check that the tile above has no leaf on the path to it.
+	deepest := v.prefixStrata
+	for deepest >= 0 && tiles[deepest] == nil {
+		deepest--
+	}
+	if deepest < 0 {
+		return nil, errors.New("no root tile")
+	}
+	if deepest < v.prefixStrata {
+		needPath = keyPath[:deepest+1]
+	}
+
+	// The error to return if the tiles verify, if the value wasn't found.
+	var mismatch error
+	for i := deepest; i >= 0; i-- {
 		tile := tiles[i]
 		// Check the prefix of what we are looking for matches the tile's path.
 		if got, want := tile.Path, needPath[:len(tile.Path)]; !bytes.Equal(got, want) {
@@ -102,17 +137,27 @@ func (v *MapVerifier) CheckInclusion(rev int, key string, value []byte) ([]byte,
 		}
 
 		// Confirm we found the leaf we needed, and that it had the value we expected.
-		if leaf == nil {
+		// Only the deepest tile can be missing the leaf, and only the leaf tile
+		// holds the key/value; a mismatch in the tiles above them means that
+		// the tiles are inconsistent with each other. Otherwise the tiles are
+		// still hashed up to the root, so that the caller can trust the error.
+		switch {
+		case leaf == nil && i == deepest:
+			mismatch = fmt.Errorf("%w: couldn't find expected leaf %x in tile %x", ErrKeyNotFound, needLeafPath, tile.Path)
+		case leaf == nil:
 			return nil, fmt.Errorf("couldn't find expected leaf %x in tile %x", needLeafPath, tile.Path)
-		}
-		if !bytes.Equal(leaf.Hash, needValue) {
+		case i == deepest && deepest < v.prefixStrata:
+			return nil, fmt.Errorf("tile %x has leaf %x but the tile below it is missing", tile.Path, leaf.Path)
+		case !bytes.Equal(leaf.Hash, needValue) && i == v.prefixStrata:
+			mismatch = fmt.Errorf("%w: wrong leaf value in tile %x, leaf %x: got %x, want %x", ErrValueMismatch, tile.Path, leaf.Path, leaf.Hash, needValue)
+		case !bytes.Equal(leaf.Hash, needValue):
 			return nil, fmt.Errorf("wrong leaf value in tile %x, leaf %x: got %x, want %x", tile.Path, leaf.Path, leaf.Hash, needValue)
 		}
 
 		// Hash this tile given its leaf values, and confirm that the value we compute
 		// matches the value reported in the tile.
 		hs, err := smt.NewHStar3(nodes, et.hasher.HashChildren,
-			uint(len(tile.Path)+len(leaf.Path))*8, uint(len(tile.Path))*8)
+			uint(len(tile.Path)+len(needLeafPath))*8, uint(len(tile.Path))*8)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create HStar3 for tile %x: %v", tile.Path, err)
 		}
@@ -131,17 +176,21 @@ func (v *MapVerifier) CheckInclusion(rev int, key string, value []byte) ([]byte,
 		needPath, needValue = tile.Path, res[0].Hash
 	}
 
-	return needValue, nil
+	return needValue, mismatch
 }
 
 // getTilesForKey loads the tiles on the path from the root to the given leaf.
+// If a tile is missing then it and the tiles below it are left nil.
 func (v *MapVerifier) getTilesForKey(rev int, key []byte) ([]*batchmap.Tile, error) {
 	tiles := make([]*batchmap.Tile, v.prefixStrata+1)
 	for i := 0; i <= v.prefixStrata; i++ {
 		tilePath := key[0:i]
 		tile, err := v.tileFetch(rev, tilePath)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read tile %x @ revision %d: %v", tilePath, rev, err)
+			return nil, fmt.Errorf("failed to read tile %x @ revision %d: %w", tilePath, rev, err)
+		}
+		if tile == nil {
+			break
 		}
 		tiles[i] = tile
 	}
@@ -19,26 +19,32 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"crypto"
+	"context"
 	"flag"
 	"os"
 	"strings"
 
 	"github.com/golang/glog"
 
+	"github.com/google/trillian-examples/experimental/batchmap/sumdb/build/pipeline"
 	"github.com/google/trillian-examples/experimental/batchmap/sumdb/mapdb"
+	"github.com/google/trillian-examples/experimental/batchmap/sumdb/mapdb/files"
+	"github.com/google/trillian-examples/experimental/batchmap/sumdb/mapdb/gcs"
+	"github.com/google/trillian-examples/experimental/batchmap/sumdb/mapdb/spannerdb"
 	"github.com/google/trillian-examples/experimental/batchmap/sumdb/verification"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
-const hash = crypto.SHA512_256
-
 var (
-	sumFile      = flag.String("sum_file", "", "go.sum file to check for integrity.")
-	mapDB        = flag.String("map_db", "", "sqlite DB containing the map tiles.")
-	treeID       = flag.Int64("tree_id", 12345, "The ID of the tree. Used as a salt in hashing.")
-	prefixStrata = flag.Int("prefix_strata", 2, "The number of strata of 8-bit strata before the final strata.")
+	sumFile       = flag.String("sum_file", "", "go.sum file to check for integrity.")
+	mapDB         = flag.String("map_db", "", "sqlite DB containing the map tiles.")
+	treeID        = flag.Int64("tree_id", 12345, "The ID of the tree. Used as a salt in hashing.")
+	prefixStrata  = flag.Int("prefix_strata", 2, "The number of strata of 8-bit strata before the final strata.")
+	keyDomain     = flag.String("key_domain", "", "The key domain that the map was built with, if any.")
+	tileBucket    = flag.String("tile_bucket", "", "If set then tiles will be read from this GCS bucket instead of the map DB. Revision metadata is always read from the map DB.")
+	tileSpannerDB = flag.String("tile_spanner_db", "", "If set then tiles will be read from this Spanner database instead of the map DB. Revision metadata is always read from the map DB.")
+	tileDir       = flag.String("tile_dir", "", "If set then tiles will be read from this directory, as written by --sink=files, instead of the map DB. Revision metadata is always read from the map DB.")
 )
 
 func main() {
@@ -55,13 +61,35 @@ func main() {
 	if err != nil {
 		glog.Exitf("Failed to open map DB at %q: %v", *mapDB, err)
 	}
+	defer tiledb.Close()
 	var rev int
 	var logRoot []byte
 	if rev, logRoot, _, err = tiledb.LatestRevision(); err != nil {
 		glog.Exitf("No revisions found in map DB at %q: %v", *mapDB, err)
 	}
 
-	mv := verification.NewMapVerifier(tiledb.Tile, *prefixStrata, *treeID, hash)
+	tileFetch := tiledb.Tile
+	if len(*tileBucket) > 0 {
+		ts, err := gcs.NewTileStore(context.Background(), *tileBucket)
+		if err != nil {
+			glog.Exitf("Failed to open tile bucket %q: %v", *tileBucket, err)
+		}
+		defer ts.Close()
+		tileFetch = ts.Tile
+	}
+	if len(*tileSpannerDB) > 0 {
+		sdb, err := spannerdb.NewTileDB(context.Background(), *tileSpannerDB)
+		if err != nil {
+			glog.Exitf("Failed to open Spanner DB %q: %v", *tileSpannerDB, err)
+		}
+		defer sdb.Close()
+		tileFetch = sdb.Tile
+	}
+	if len(*tileDir) > 0 {
+		tileFetch = files.NewTileStore(*tileDir).Tile
+	}
+
+	mv := verification.NewMapVerifier(tileFetch, *prefixStrata, *treeID, pipeline.Hash)
 
 	// Open the go.sum file for reading a line at a time.
 	file, err := os.Open(*sumFile)
@@ -81,13 +109,15 @@ func main() {
 	// for every single line in the go.sum file).
 	for scanner.Scan() {
 		line := scanner.Text()
-		split := strings.LastIndex(line, " ")
-		key := line[:split]
-		expectedString := line[split+1:]
-		glog.V(1).Infof("checking key %q value %q", key, expectedString)
-		newRoot, err := mv.CheckInclusion(rev, key, []byte(expectedString))
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			glog.Exitf("malformed line in %q: %q", *sumFile, line)
+		}
+		module, version, expectedString := fields[0], fields[1], fields[2]
+		glog.V(1).Infof("checking key %q value %q", module+" "+version, expectedString)
+		newRoot, err := mv.CheckInclusion(rev, pipeline.MapKey(*keyDomain, module, version), []byte(expectedString))
 		if err != nil {
-			glog.Exitf("inclusion check failed for key %q value %q: %q", key, expectedString, err)
+			glog.Exitf("inclusion check failed for key %q value %q: %q", module+" "+version, expectedString, err)
 		}
 		if root != nil && !bytes.Equal(root, newRoot) {
 			glog.Exitf("map root changed while verifying file")
@@ -0,0 +1,89 @@
+// Copyright 2021 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// verifyinclusion checks that a single module version's hash is committed to
+// by a revision of the map. It exits with a non-zero status unless the value
+// is found and the proof verifies up to the root hash stored for the revision.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+
+	"github.com/golang/glog"
+
+	"github.com/google/trillian-examples/experimental/batchmap/sumdb/build/pipeline"
+	"github.com/google/trillian-examples/experimental/batchmap/sumdb/mapdb"
+	"github.com/google/trillian-examples/experimental/batchmap/sumdb/verification"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var (
+	module       = flag.String("module", "", "The module path, e.g. golang.org/x/mod.")
+	version      = flag.String("version", "", "The module version, e.g. v0.4.2. Add the /go.mod suffix to check the hash of the go.mod file.")
+	hash         = flag.String("hash", "", "The expected go.sum hash, e.g. h1:...")
+	mapDB        = flag.String("map_db", "", "sqlite DB containing the map tiles.")
+	revision     = flag.Int("revision", -1, "The map revision to check, or -1 to use the latest revision.")
+	treeID       = flag.Int64("tree_id", 12345, "The ID of the tree. Only used for revisions with no recorded build params.")
+	prefixStrata = flag.Int("prefix_strata", 2, "The number of strata of 8-bit strata before the final strata. Only used for revisions with no recorded build params.")
+	keyDomain    = flag.String("key_domain", "", "The key domain that the map was built with. Only used for revisions with no recorded build params.")
+)
+
+func main() {
+	flag.Parse()
+
+	if *mapDB == "" {
+		glog.Exitf("No map_db provided")
+	}
+	if *module == "" || *version == "" || *hash == "" {
+		glog.Exitf("module, version and hash must all be provided")
+	}
+
+	tiledb, err := mapdb.NewTileDB(*mapDB)
+	if err != nil {
+		glog.Exitf("Failed to open map DB at %q: %v", *mapDB, err)
+	}
+	defer tiledb.Close()
+	rev := *revision
+	if rev < 0 {
+		if rev, _, _, err = tiledb.LatestRevision(); err != nil {
+			glog.Exitf("No revisions found in map DB at %q: %v", *mapDB, err)
+		}
+	}
+	info, err := tiledb.Revision(rev)
+	if err != nil {
+		glog.Exitf("Failed to read revision %d: %v", rev, err)
+	}
+	if len(info.RootHash) == 0 {
+		glog.Exitf("Map revision %d has no recorded root hash to verify against", rev)
+	}
+	tid, strata, domain := *treeID, *prefixStrata, *keyDomain
+	if params, err := tiledb.BuildParams(rev); err == nil {
+		tid, strata, domain = params.TreeID, params.PrefixStrata, params.KeyDomain
+	} else {
+		glog.Warningf("Failed to read build params for revision %d, using flag values: %v", rev, err)
+	}
+
+	mv := verification.NewMapVerifier(tiledb.Tile, strata, tid, pipeline.Hash)
+	root, err := mv.CheckInclusion(rev, pipeline.MapKey(domain, *module, *version), []byte(*hash))
+	if err != nil {
+		glog.Exitf("Inclusion check failed for %s %s %s: %v", *module, *version, *hash, err)
+	}
+	if !bytes.Equal(root, info.RootHash) {
+		glog.Exitf("Inclusion proof for %s %s verifies to root %x, but map revision %d has root %x", *module, *version, root, rev, info.RootHash)
+	}
+	fmt.Printf("Verified %s %s %s is committed to by map revision %d with root %x\n", *module, *version, *hash, rev, root)
+}
@@ -16,7 +16,6 @@
 package main
 
 import (
-	"crypto"
 	"flag"
 	"fmt"
 	"regexp"
@@ -24,6 +23,7 @@ import (
 	"github.com/golang/glog"
 	"golang.org/x/mod/sumdb/tlog"
 
+	"github.com/google/trillian-examples/experimental/batchmap/sumdb/build/pipeline"
 	"github.com/google/trillian-examples/experimental/batchmap/sumdb/mapdb"
 	"github.com/google/trillian-examples/experimental/batchmap/sumdb/verification"
 	"github.com/google/trillian/merkle/compact"
@@ -31,13 +31,12 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
-const hash = crypto.SHA512_256
-
 var (
 	module       = flag.String("module", "", "module to get versions for.")
 	mapDB        = flag.String("map_db", "", "sqlite DB containing the map tiles.")
 	treeID       = flag.Int64("tree_id", 12345, "The ID of the tree. Used as a salt in hashing.")
 	prefixStrata = flag.Int("prefix_strata", 2, "The number of strata of 8-bit strata before the final strata.")
+	keyDomain    = flag.String("key_domain", "", "The key domain that the map was built with, if any.")
 	showAll      = flag.Bool("all", false, "Only release versions are shown by default, but setting this flag will also show ephemeral versions.")
 )
 
@@ -55,6 +54,7 @@ func main() {
 	if err != nil {
 		glog.Exitf("Failed to open map DB at %q: %v", *mapDB, err)
 	}
+	defer tiledb.Close()
 	var rev int
 	if rev, _, _, err = tiledb.LatestRevision(); err != nil {
 		glog.Exitf("No revisions found in map DB at %q: %v", *mapDB, err)
@@ -64,6 +64,9 @@ func main() {
 	if err != nil {
 		glog.Exitf("Failed to list versions for %q: %v", *module, err)
 	}
+	if len(versions) == 0 {
+		glog.Exitf("%q was left out of the version list of revision %d because its records couldn't be logged", *module, rev)
+	}
 
 	rf := &compact.RangeFactory{
 		// This needs to be the same function used in the log construction.
@@ -85,8 +88,8 @@ func main() {
 		glog.Exitf("Failed to calculate expected log root: %v", err)
 	}
 
-	mv := verification.NewMapVerifier(tiledb.Tile, *prefixStrata, *treeID, hash)
-	mr, err := mv.CheckInclusion(rev, *module, logRoot)
+	mv := verification.NewMapVerifier(tiledb.Tile, *prefixStrata, *treeID, pipeline.Hash)
+	mr, err := mv.CheckInclusion(rev, pipeline.ModuleLogKey(*keyDomain, *module), logRoot)
 	if err != nil {
 		glog.Exitf("Failed to verify inclusion: %v", err)
 	}
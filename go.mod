@@ -3,6 +3,8 @@ module github.com/google/trillian-examples
 go 1.16
 
 require (
+	cloud.google.com/go/spanner v1.22.0
+	cloud.google.com/go/storage v1.10.0
 	github.com/apache/beam v2.31.0+incompatible
 	github.com/cenkalti/backoff/v4 v4.1.1
 	github.com/dsoprea/go-ext4 v0.0.0-20190528173430-c13b09fc0ff8
@@ -14,13 +16,18 @@ require (
 	github.com/google/go-cmp v0.5.6
 	github.com/google/trillian v1.3.14-0.20210708134248-637bb0ae2c99
 	github.com/gorilla/mux v1.8.0
+	github.com/lib/pq v1.10.2
 	github.com/mattn/go-sqlite3 v1.14.8
 	github.com/niemeyer/pretty v0.0.0-20200227124842-a10e7caefd8e // indirect
 	github.com/perlin-network/life v0.0.0-20191203030451-05c0e0f7eaea
+	github.com/prometheus/client_golang v1.11.0
+	github.com/prometheus/client_model v0.3.0 // indirect
 	github.com/u-root/u-root v7.0.0+incompatible
 	golang.org/x/crypto v0.0.0-20201002170205-7f63de1d35b0
 	golang.org/x/mod v0.4.2
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
+	google.golang.org/api v0.50.0
+	google.golang.org/genproto v0.0.0-20210624195500-8bfb893ecb84
 	google.golang.org/grpc v1.39.0
 	google.golang.org/protobuf v1.27.1
 	gopkg.in/check.v1 v1.0.0-20200227125254-8fa46927fb4f // indirect